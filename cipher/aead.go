@@ -0,0 +1,281 @@
+package cipher
+
+import (
+	"crypto/cipher"
+	"crypto/hkdf"
+	"crypto/rand"
+	"crypto/sha1"
+	"encoding/binary"
+	"fmt"
+	"io"
+	"net"
+
+	"github.com/daogan/socksproxy/internal/bytepool"
+)
+
+// AEAD methods follow the shadowsocks AEAD construction: each direction
+// starts with a random salt, the session subkey is HKDF-SHA1(key, salt,
+// "ss-subkey"), and the stream is made of chunks:
+//
+//	[encrypted payload length][length tag][encrypted payload][payload tag]
+//
+// Every AEAD operation uses a little endian counter nonce starting at zero.
+const aeadMaxPayload = 0x3fff
+
+// incNonce increments a little endian counter nonce.
+func incNonce(nonce []byte) {
+	for i := range nonce {
+		nonce[i]++
+		if nonce[i] != 0 {
+			return
+		}
+	}
+}
+
+func IsAEAD(method string) bool {
+	info, ok := ciphers[method]
+	return ok && info.NewAEAD != nil
+}
+
+type aeadConn struct {
+	net.Conn
+	newAEAD func(key []byte) (cipher.AEAD, error)
+	key     []byte
+	ivs     *IVCache
+
+	enc, dec           cipher.AEAD
+	encNonce, decNonce []byte
+
+	// the keys of the users the server tries on the first chunk
+	userKeys [][]byte
+	user     int
+
+	buf     []byte // frame buffer for reading
+	pending []byte // plaintext not yet returned by Read
+}
+
+func NewAEADConn(conn net.Conn, method, password string, compat bool, ivs *IVCache) (net.Conn, error) {
+	info, err := Lookup(method)
+	if err != nil {
+		return nil, err
+	}
+	if info.NewAEAD == nil {
+		return nil, fmt.Errorf("not an AEAD method: %s", method)
+	}
+	return &aeadConn{Conn: conn, newAEAD: info.NewAEAD, key: Key(method, password, compat), ivs: ivs, user: -1}, nil
+}
+
+// NewAEADServerConn is the server side of NewAEADConn for the users with the
+// passwords users. Nothing tells them apart, the key of each is tried on the
+// first chunk until one opens it.
+func NewAEADServerConn(conn net.Conn, method string, users []string, compat bool, ivs *IVCache) (net.Conn, error) {
+	c, err := NewAEADConn(conn, method, "", compat, ivs)
+	if err != nil {
+		return nil, err
+	}
+	ac := c.(*aeadConn)
+	for _, u := range users {
+		ac.userKeys = append(ac.userKeys, Key(method, u, compat))
+	}
+	return ac, nil
+}
+
+// User returns the index of the user whose key opened the stream, or -1.
+func (c *aeadConn) User() int {
+	return c.user
+}
+
+func (c *aeadConn) CloseWrite() error { return closeWrite(c.Conn) }
+func (c *aeadConn) CloseRead() error  { return closeRead(c.Conn) }
+
+// findUser opens the first length chunk with the key of each user, and keeps
+// the key of the first one that does.
+func (c *aeadConn) findUser(salt []byte) ([]byte, error) {
+	frame := c.buf[:2+c.dec.Overhead()]
+	if _, err := io.ReadFull(c.Conn, frame); err != nil {
+		return nil, err
+	}
+	for i, key := range c.userKeys {
+		c.key = key
+		dec, err := c.sessionAEAD(salt)
+		if err != nil {
+			return nil, err
+		}
+		if b, err := dec.Open(nil, c.decNonce, frame, nil); err == nil {
+			incNonce(c.decNonce)
+			c.dec, c.user = dec, i
+			return b, nil
+		}
+	}
+	return nil, ErrDecrypt
+}
+
+func (c *aeadConn) sessionAEAD(salt []byte) (cipher.AEAD, error) {
+	subkey, err := hkdf.Key(sha1.New, c.key, salt, "ss-subkey", len(c.key))
+	if err != nil {
+		return nil, err
+	}
+	return c.newAEAD(subkey)
+}
+
+// readFrame reads and opens one sealed frame of n plaintext bytes.
+func (c *aeadConn) readFrame(n int) ([]byte, error) {
+	frame := c.buf[:n+c.dec.Overhead()]
+	if _, err := io.ReadFull(c.Conn, frame); err != nil {
+		return nil, err
+	}
+	b, err := c.dec.Open(frame[:0], c.decNonce, frame, nil)
+	incNonce(c.decNonce)
+	if err != nil {
+		return nil, ErrDecrypt
+	}
+	return b, nil
+}
+
+// readSalt reads the salt of the peer, once, and with users the first chunk
+// of the key that opens it.
+func (c *aeadConn) readSalt() error {
+	if c.dec != nil {
+		return nil
+	}
+	salt := make([]byte, len(c.key))
+	if _, err := io.ReadFull(c.Conn, salt); err != nil {
+		return err
+	}
+	if !c.ivs.Check(salt) {
+		return ErrReplay
+	}
+	var err error
+	if c.dec, err = c.sessionAEAD(salt); err != nil {
+		return err
+	}
+	c.decNonce = make([]byte, c.dec.NonceSize())
+	c.buf = make([]byte, aeadMaxPayload+c.dec.Overhead())
+	if c.userKeys != nil {
+		l, err := c.findUser(salt)
+		if err != nil {
+			return err
+		}
+		size := int(binary.BigEndian.Uint16(l)) & aeadMaxPayload
+		if c.pending, err = c.readFrame(size); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// readChunk reads the next chunk into c.pending.
+func (c *aeadConn) readChunk() error {
+	l, err := c.readFrame(2)
+	if err != nil {
+		return err
+	}
+	size := int(binary.BigEndian.Uint16(l)) & aeadMaxPayload
+	c.pending, err = c.readFrame(size)
+	return err
+}
+
+func (c *aeadConn) Read(b []byte) (n int, err error) {
+	if err = c.readSalt(); err != nil {
+		return
+	}
+	for len(c.pending) == 0 {
+		if err = c.readChunk(); err != nil {
+			return
+		}
+	}
+	n = copy(b, c.pending)
+	c.pending = c.pending[n:]
+	return
+}
+
+// WriteTo writes each chunk to w as it is opened, sparing the copy Read
+// makes. It returns nil at EOF, as io.Copy does.
+func (c *aeadConn) WriteTo(w io.Writer) (n int64, err error) {
+	if err = c.readSalt(); err == io.EOF {
+		return 0, nil
+	} else if err != nil {
+		return
+	}
+	for {
+		if len(c.pending) > 0 {
+			nw, ew := w.Write(c.pending)
+			n += int64(nw)
+			c.pending = c.pending[nw:]
+			if ew != nil {
+				return n, ew
+			}
+		}
+		if err = c.readChunk(); err == io.EOF {
+			return n, nil
+		} else if err != nil {
+			return n, err
+		}
+	}
+}
+
+// seal appends the chunks of b to out, after the salt on the first call.
+func (c *aeadConn) seal(out, b []byte) ([]byte, error) {
+	if c.enc == nil {
+		salt := make([]byte, len(c.key))
+		if _, err := io.ReadFull(rand.Reader, salt); err != nil {
+			return nil, fmt.Errorf("Can't build random salt: %v", err)
+		}
+		var err error
+		if c.enc, err = c.sessionAEAD(salt); err != nil {
+			return nil, err
+		}
+		c.encNonce = make([]byte, c.enc.NonceSize())
+		out = append(out, salt...)
+	}
+	for len(b) > 0 {
+		chunk := b
+		if len(chunk) > aeadMaxPayload {
+			chunk = chunk[:aeadMaxPayload]
+		}
+		size := binary.BigEndian.AppendUint16(nil, uint16(len(chunk)))
+		out = c.enc.Seal(out, c.encNonce, size, nil)
+		incNonce(c.encNonce)
+		out = c.enc.Seal(out, c.encNonce, chunk, nil)
+		incNonce(c.encNonce)
+		b = b[len(chunk):]
+	}
+	return out, nil
+}
+
+func (c *aeadConn) Write(b []byte) (n int, err error) {
+	out, err := c.seal(nil, b)
+	if err != nil {
+		return
+	}
+	if _, err = c.Conn.Write(out); err != nil {
+		return
+	}
+	return len(b), nil
+}
+
+// ReadFrom seals what it reads from r into a buffer kept across the chunks,
+// where Write allocates one each call.
+func (c *aeadConn) ReadFrom(r io.Reader) (n int64, err error) {
+	buf := bytepool.Default.Get()
+	defer bytepool.Default.Put(buf)
+	var out []byte
+	for {
+		nr, er := r.Read(buf)
+		if nr > 0 {
+			if out, err = c.seal(out[:0], buf[:nr]); err != nil {
+				return
+			}
+			if _, err = c.Conn.Write(out); err != nil {
+				return
+			}
+			n += int64(nr)
+		}
+		if er == io.EOF {
+			return n, nil
+		}
+		if er != nil {
+			return n, er
+		}
+	}
+}
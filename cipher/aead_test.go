@@ -0,0 +1,154 @@
+package cipher
+
+import (
+	"bytes"
+	"crypto/hkdf"
+	"crypto/rand"
+	"crypto/sha1"
+	"encoding/binary"
+	"errors"
+	"io"
+	"testing"
+	"time"
+)
+
+// sealChunks is the shadowsocks AEAD stream of the payloads with the session
+// subkey for salt, built from the spec rather than by aeadConn.
+func sealChunks(t *testing.T, method string, subkey, salt []byte, payloads ...[]byte) []byte {
+	t.Helper()
+	aead, err := ciphers[method].NewAEAD(subkey)
+	if err != nil {
+		t.Fatal(err)
+	}
+	nonce := make([]byte, aead.NonceSize())
+	out := append([]byte{}, salt...)
+	for _, p := range payloads {
+		out = aead.Seal(out, nonce, binary.BigEndian.AppendUint16(nil, uint16(len(p))), nil)
+		incNonce(nonce)
+		out = aead.Seal(out, nonce, p, nil)
+		incNonce(nonce)
+	}
+	return out
+}
+
+// The subkeys are those of `openssl kdf -kdfopt digest:SHA1 -kdfopt
+// info:ss-subkey HKDF` for the EVP_BytesToKey key of "password" and the salt
+// 000102..., the one of shadowsocks.
+func TestAEADInterop(t *testing.T) {
+	for _, tt := range []struct {
+		method, subkey string
+	}{
+		{"aes-128-gcm", "ed2a618d9490d1701de885d82aa80616"},
+		{"aes-256-gcm", "ee187aed3f87574907a39db98606f60a526114831288097cac66054b33a9464f"},
+	} {
+		subkey := unhex(t, tt.subkey)
+		stream := sealChunks(t, tt.method, subkey, counting(len(subkey)), []byte("hello, "), []byte("shadowsocks"))
+		c, err := NewAEADConn(&bufConn{r: bytes.NewReader(stream)}, tt.method, "password", true, nil)
+		if err != nil {
+			t.Fatal(err)
+		}
+		got, err := io.ReadAll(c)
+		if err != nil {
+			t.Fatalf("%s: %v", tt.method, err)
+		}
+		if string(got) != "hello, shadowsocks" {
+			t.Errorf("%s: read %q", tt.method, got)
+		}
+	}
+}
+
+// A write longer than a chunk is split into chunks of at most 0x3fff bytes,
+// each with its sealed length.
+func TestAEADChunking(t *testing.T) {
+	payload := make([]byte, 2*aeadMaxPayload+1000)
+	rand.Read(payload)
+	bc := &bufConn{}
+	c, err := NewAEADConn(bc, "chacha20-ietf-poly1305", "password", false, nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if _, err = c.Write(payload); err != nil {
+		t.Fatal(err)
+	}
+
+	out := bc.w.Bytes()
+	key := Key("chacha20-ietf-poly1305", "password", false)
+	salt, out := out[:len(key)], out[len(key):]
+	subkey, _ := hkdf.Key(sha1.New, key, salt, "ss-subkey", len(key))
+	aead, _ := ciphers["chacha20-ietf-poly1305"].NewAEAD(subkey)
+	nonce := make([]byte, aead.NonceSize())
+	var sizes []int
+	var got []byte
+	for len(out) > 0 {
+		l, err := aead.Open(nil, nonce, out[:2+aead.Overhead()], nil)
+		if err != nil {
+			t.Fatalf("chunk %d length: %v", len(sizes), err)
+		}
+		incNonce(nonce)
+		out = out[2+aead.Overhead():]
+		size := int(binary.BigEndian.Uint16(l))
+		p, err := aead.Open(nil, nonce, out[:size+aead.Overhead()], nil)
+		if err != nil {
+			t.Fatalf("chunk %d payload: %v", len(sizes), err)
+		}
+		incNonce(nonce)
+		out = out[size+aead.Overhead():]
+		sizes = append(sizes, size)
+		got = append(got, p...)
+	}
+	if len(sizes) != 3 || sizes[0] != aeadMaxPayload || sizes[1] != aeadMaxPayload || sizes[2] != 1000 {
+		t.Errorf("chunk sizes %v, want [%d %d 1000]", sizes, aeadMaxPayload, aeadMaxPayload)
+	}
+	if !bytes.Equal(got, payload) {
+		t.Error("chunks don't make up the payload")
+	}
+
+	c, _ = NewAEADConn(&bufConn{r: bytes.NewReader(bc.w.Bytes())}, "chacha20-ietf-poly1305", "password", false, nil)
+	if got, err = io.ReadAll(c); err != nil || !bytes.Equal(got, payload) {
+		t.Errorf("read back %d bytes, %v", len(got), err)
+	}
+}
+
+func TestAEADFindUser(t *testing.T) {
+	users := []string{"alice", "bob", "carol"}
+	for _, tt := range []struct {
+		password string
+		user     int
+	}{{"alice", 0}, {"carol", 2}, {"mallory", -1}} {
+		bc := &bufConn{}
+		c, _ := NewAEADConn(bc, "aes-256-gcm", tt.password, false, nil)
+		if _, err := c.Write([]byte("hello")); err != nil {
+			t.Fatal(err)
+		}
+		s, err := NewAEADServerConn(&bufConn{r: bytes.NewReader(bc.w.Bytes())}, "aes-256-gcm", users, false, nil)
+		if err != nil {
+			t.Fatal(err)
+		}
+		got, err := io.ReadAll(s)
+		if tt.user < 0 {
+			if !errors.Is(err, ErrDecrypt) {
+				t.Errorf("%s: err %v, want ErrDecrypt", tt.password, err)
+			}
+			continue
+		}
+		if err != nil || string(got) != "hello" {
+			t.Errorf("%s: read %q, %v", tt.password, got, err)
+		}
+		if u := s.(*aeadConn).User(); u != tt.user {
+			t.Errorf("%s: user %d, want %d", tt.password, u, tt.user)
+		}
+	}
+}
+
+func TestAEADReplay(t *testing.T) {
+	bc := &bufConn{}
+	c, _ := NewAEADConn(bc, "aes-128-gcm", "password", false, nil)
+	c.Write([]byte("hello"))
+	ivs := NewIVCache(time.Minute)
+	for i, want := range []error{nil, ErrReplay} {
+		s, _ := NewAEADConn(&bufConn{r: bytes.NewReader(bc.w.Bytes())}, "aes-128-gcm", "password", false, ivs)
+		if _, err := io.ReadAll(s); err != want {
+			t.Errorf("session %d: err %v, want %v", i, err, want)
+		}
+	}
+}
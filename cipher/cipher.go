@@ -0,0 +1,276 @@
+// Package cipher implements the encryption methods of the tunnel: stream
+// ciphers, shadowsocks AEAD and Shadowsocks 2022, as net.Conn wrappers.
+package cipher
+
+import (
+	"errors"
+	"fmt"
+	"io"
+	"runtime"
+	"sync"
+	"time"
+
+	"crypto/aes"
+	"crypto/cipher"
+	"crypto/hkdf"
+	"crypto/md5"
+	"crypto/rand"
+	"crypto/sha256"
+
+	"golang.org/x/crypto/chacha20"
+	"golang.org/x/crypto/chacha20poly1305"
+	"golang.org/x/sys/cpu"
+)
+
+// Info describes an encryption method. Stream methods set NewEncrypter
+// and NewDecrypter, AEAD methods set NewAEAD and use a salt of KeyLen bytes.
+type Info struct {
+	KeyLen int
+	IVLen  int
+
+	NewEncrypter func(key, iv []byte) (cipher.Stream, error)
+	NewDecrypter func(key, iv []byte) (cipher.Stream, error)
+	NewAEAD      func(key []byte) (cipher.AEAD, error)
+}
+
+// MethodNone leaves the tunnel unencrypted, for debugging and benchmarks.
+const MethodNone = "none"
+
+var ciphers = map[string]*Info{
+	MethodNone: {},
+
+	"aes-128-cfb":   {KeyLen: 16, IVLen: aes.BlockSize, NewEncrypter: newCFBEncrypter, NewDecrypter: newCFBDecrypter},
+	"aes-192-cfb":   {KeyLen: 24, IVLen: aes.BlockSize, NewEncrypter: newCFBEncrypter, NewDecrypter: newCFBDecrypter},
+	"aes-256-cfb":   {KeyLen: 32, IVLen: aes.BlockSize, NewEncrypter: newCFBEncrypter, NewDecrypter: newCFBDecrypter},
+	"chacha20-ietf": {KeyLen: chacha20.KeySize, IVLen: chacha20.NonceSize, NewEncrypter: newChacha20, NewDecrypter: newChacha20},
+	"xchacha20":     {KeyLen: chacha20.KeySize, IVLen: chacha20.NonceSizeX, NewEncrypter: newChacha20, NewDecrypter: newChacha20},
+
+	"aes-128-gcm":            {KeyLen: 16, NewAEAD: newGCM},
+	"aes-192-gcm":            {KeyLen: 24, NewAEAD: newGCM},
+	"aes-256-gcm":            {KeyLen: 32, NewAEAD: newGCM},
+	"chacha20-ietf-poly1305": {KeyLen: 32, NewAEAD: chacha20poly1305.New},
+
+	"2022-blake3-aes-128-gcm":       {KeyLen: 16, NewAEAD: newGCM},
+	"2022-blake3-aes-256-gcm":       {KeyLen: 32, NewAEAD: newGCM},
+	"2022-blake3-chacha20-poly1305": {KeyLen: 32, NewAEAD: chacha20poly1305.New},
+}
+
+// Register makes a new encryption method available to -m. Methods whose
+// name starts with "2022-" use the SIP022 framing and must be AEAD.
+func Register(method string, info Info) {
+	if info.NewAEAD == nil && (info.NewEncrypter == nil || info.NewDecrypter == nil) {
+		panic("cipher " + method + " has no constructor")
+	}
+	if info.NewAEAD == nil && IsSS2022(method) {
+		panic("cipher " + method + " must be AEAD")
+	}
+	ciphers[method] = &info
+}
+
+func Lookup(method string) (*Info, error) {
+	info, ok := ciphers[method]
+	if !ok {
+		return nil, fmt.Errorf("not supported method: %s", method)
+	}
+	return info, nil
+}
+
+func newCFBEncrypter(key, iv []byte) (cipher.Stream, error) {
+	block, err := aes.NewCipher(key)
+	if err != nil {
+		return nil, err
+	}
+	return cipher.NewCFBEncrypter(block, iv), nil
+}
+
+func newCFBDecrypter(key, iv []byte) (cipher.Stream, error) {
+	block, err := aes.NewCipher(key)
+	if err != nil {
+		return nil, err
+	}
+	return cipher.NewCFBDecrypter(block, iv), nil
+}
+
+// newChacha20 is both the encrypter and the decrypter, the nonce size picks
+// chacha20 or xchacha20.
+func newChacha20(key, iv []byte) (cipher.Stream, error) {
+	return chacha20.NewUnauthenticatedCipher(key, iv)
+}
+
+// HasAESHardware reports whether the CPU accelerates AES, without it the
+// chacha20 methods are usually faster.
+func HasAESHardware() bool {
+	switch runtime.GOARCH {
+	case "amd64", "386":
+		return cpu.X86.HasAES && cpu.X86.HasPCLMULQDQ
+	case "arm64":
+		return cpu.ARM64.HasAES && cpu.ARM64.HasPMULL
+	case "s390x":
+		return cpu.S390X.HasAES && cpu.S390X.HasAESGCM
+	}
+	return false
+}
+
+func newGCM(key []byte) (cipher.AEAD, error) {
+	block, err := aes.NewCipher(key)
+	if err != nil {
+		return nil, err
+	}
+	return cipher.NewGCM(block)
+}
+
+type Cipher struct {
+	info    *Info
+	enc     cipher.Stream
+	dec     cipher.Stream
+	key     []byte
+	compat  bool
+	subkeys bool
+}
+
+// Key derives the master key of method from password, like shadowsocks when
+// compat is set.
+func Key(method, password string, compat bool) []byte {
+	var keyLen int
+	if info, ok := ciphers[method]; ok {
+		keyLen = info.KeyLen
+	} else {
+		keyLen = 32
+	}
+	if compat {
+		return evpBytesToKey(password, keyLen)
+	}
+	bs := sha256.Sum256([]byte(password))
+	return bs[:keyLen]
+}
+
+// evpBytesToKey is OpenSSL's EVP_BytesToKey with MD5, no salt and a single
+// iteration, the key derivation used by shadowsocks.
+func evpBytesToKey(password string, keyLen int) []byte {
+	var key, prev []byte
+	for len(key) < keyLen {
+		h := md5.New()
+		h.Write(prev)
+		h.Write([]byte(password))
+		prev = h.Sum(nil)
+		key = append(key, prev...)
+	}
+	return key[:keyLen]
+}
+
+var ErrReplay = errors.New("iv already seen, possible replay attack")
+
+// ErrDecrypt is returned by the reads of AEAD connections whose frames don't
+// authenticate.
+var ErrDecrypt = errors.New("fail to decrypt, wrong password or corrupted stream")
+
+// IVCache remembers the IVs (or salts) seen within window on the server, so
+// replayed sessions are rejected. A nil IVCache accepts everything.
+type IVCache struct {
+	sync.Mutex
+	window   time.Duration
+	seen     map[string]struct{}
+	queue    []ivEntry // in arrival order, for expiry
+	rejected uint64
+}
+
+type ivEntry struct {
+	iv   string
+	seen time.Time
+}
+
+func NewIVCache(window time.Duration) *IVCache {
+	if window <= 0 {
+		return nil
+	}
+	return &IVCache{window: window, seen: make(map[string]struct{})}
+}
+
+// Check records iv and reports whether it is new.
+func (c *IVCache) Check(iv []byte) bool {
+	if c == nil {
+		return true
+	}
+	c.Lock()
+	defer c.Unlock()
+	now := time.Now()
+	i := 0
+	for ; i < len(c.queue) && now.Sub(c.queue[i].seen) > c.window; i++ {
+		delete(c.seen, c.queue[i].iv)
+	}
+	c.queue = c.queue[i:]
+	if _, ok := c.seen[string(iv)]; ok {
+		c.rejected++
+		return false
+	}
+	c.seen[string(iv)] = struct{}{}
+	c.queue = append(c.queue, ivEntry{iv: string(iv), seen: now})
+	return true
+}
+
+// Rejected returns the number of replays rejected so far.
+func (c *IVCache) Rejected() uint64 {
+	if c == nil {
+		return 0
+	}
+	c.Lock()
+	defer c.Unlock()
+	return c.rejected
+}
+
+// NewCipher returns the stream cipher of method keyed by password. With
+// subkeys every session is keyed with its own subkey, see sessionKey.
+func NewCipher(method, password string, compat, subkeys bool) (*Cipher, error) {
+	info, err := Lookup(method)
+	if err != nil {
+		return nil, err
+	}
+	if info.NewEncrypter == nil {
+		return nil, fmt.Errorf("not a stream method: %s", method)
+	}
+	return &Cipher{info: info, key: Key(method, password, compat), compat: compat, subkeys: subkeys}, nil
+}
+
+// sessionKey returns the key of a single session. Like shadowsocks it is the
+// master key as is, unless subkeys is set without compat: then it is derived
+// from the master key and the session iv, so the master key never encrypts
+// anything directly.
+func (c *Cipher) sessionKey(iv []byte) ([]byte, error) {
+	if c.compat || !c.subkeys {
+		return c.key, nil
+	}
+	return hkdf.Key(sha256.New, c.key, iv, "socksproxy subkey", len(c.key))
+}
+
+func (c *Cipher) initEncrypt() (iv []byte, err error) {
+	iv = make([]byte, c.info.IVLen)
+	if _, err = io.ReadFull(rand.Reader, iv); err != nil {
+		return nil, fmt.Errorf("Can't build random iv: %v", err)
+	}
+	key, err := c.sessionKey(iv)
+	if err != nil {
+		return
+	}
+	c.enc, err = c.info.NewEncrypter(key, iv)
+	return
+}
+
+func (c *Cipher) initDecrypt(iv []byte) error {
+	if len(iv) != c.info.IVLen {
+		return fmt.Errorf("Invalid IV length: %d", len(iv))
+	}
+	key, err := c.sessionKey(iv)
+	if err != nil {
+		return err
+	}
+	c.dec, err = c.info.NewDecrypter(key, iv)
+	return err
+}
+
+func (c *Cipher) decrypt(dst, src []byte) {
+	c.dec.XORKeyStream(dst, src)
+}
+
+func (c *Cipher) encrypt(dst, src []byte) {
+	c.enc.XORKeyStream(dst, src)
+}
@@ -0,0 +1,135 @@
+package cipher
+
+import (
+	"bytes"
+	"crypto/aes"
+	"crypto/cipher"
+	"encoding/hex"
+	"io"
+	"net"
+	"testing"
+	"time"
+)
+
+// bufConn reads from r and records the writes, enough of a net.Conn for the
+// ciphers.
+type bufConn struct {
+	net.Conn
+	r io.Reader
+	w bytes.Buffer
+}
+
+func (c *bufConn) Read(b []byte) (int, error)  { return c.r.Read(b) }
+func (c *bufConn) Write(b []byte) (int, error) { return c.w.Write(b) }
+
+func unhex(t *testing.T, s string) []byte {
+	t.Helper()
+	b, err := hex.DecodeString(s)
+	if err != nil {
+		t.Fatal(err)
+	}
+	return b
+}
+
+// counting returns the bytes 0, 1, ... n-1, the IVs and salts of the vectors.
+func counting(n int) []byte {
+	b := make([]byte, n)
+	for i := range b {
+		b[i] = byte(i)
+	}
+	return b
+}
+
+// The compat keys are those of `openssl enc -md md5 -nosalt -k <password> -P`,
+// EVP_BytesToKey like shadowsocks, the others the SHA-256 of the password.
+func TestKey(t *testing.T) {
+	for _, tt := range []struct {
+		method, password string
+		compat           bool
+		want             string
+	}{
+		{"aes-128-cfb", "password", true, "5f4dcc3b5aa765d61d8327deb882cf99"},
+		{"aes-192-cfb", "password", true, "5f4dcc3b5aa765d61d8327deb882cf992b95990a9151374a"},
+		{"aes-256-cfb", "password", true, "5f4dcc3b5aa765d61d8327deb882cf992b95990a9151374abd8ff8c5a7a0fe08"},
+		{"aes-256-gcm", "foobar", true, "3858f62230ac3c915f300c664312c63f568378529614d22ddb49237d2f60bfdf"},
+		{"aes-256-cfb", "password", false, "5e884898da28047151d0e56f8dc6292773603d0d6aabbdd62a11ef721d1542d8"},
+		{"aes-128-gcm", "password", false, "5e884898da28047151d0e56f8dc62927"},
+	} {
+		if got := hex.EncodeToString(Key(tt.method, tt.password, tt.compat)); got != tt.want {
+			t.Errorf("Key(%q, %q, %v) = %s, want %s", tt.method, tt.password, tt.compat, got, tt.want)
+		}
+	}
+}
+
+// The ciphertext is the one of `openssl enc -aes-256-cfb` with the key of
+// "password" and the IV 000102...0f.
+func TestStreamInterop(t *testing.T) {
+	const plain = "hello, shadowsocks"
+	stream := append(counting(16), unhex(t, "bbaee255bcec52bf43b57e1b6508be215210")...)
+	c, err := NewCipher("aes-256-cfb", "password", true, false)
+	if err != nil {
+		t.Fatal(err)
+	}
+	got, err := io.ReadAll(NewConn(&bufConn{r: bytes.NewReader(stream)}, c, nil))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if string(got) != plain {
+		t.Errorf("read %q, want %q", got, plain)
+	}
+
+	// and the other way, the IV first and then the plain CFB of the master key
+	c, _ = NewCipher("aes-256-cfb", "password", true, false)
+	bc := &bufConn{}
+	if _, err = NewConn(bc, c, nil).Write([]byte(plain)); err != nil {
+		t.Fatal(err)
+	}
+	out := bc.w.Bytes()
+	block, _ := aes.NewCipher(Key("aes-256-cfb", "password", true))
+	dec := make([]byte, len(out)-16)
+	cipher.NewCFBDecrypter(block, out[:16]).XORKeyStream(dec, out[16:])
+	if string(dec) != plain {
+		t.Errorf("wrote %q, want %q", dec, plain)
+	}
+}
+
+func TestStreamSubkeys(t *testing.T) {
+	const plain = "hello, subkeys"
+	for _, method := range []string{"aes-128-cfb", "chacha20-ietf", "xchacha20"} {
+		enc, err := NewCipher(method, "password", false, true)
+		if err != nil {
+			t.Fatal(err)
+		}
+		bc := &bufConn{}
+		if _, err = NewConn(bc, enc, nil).Write([]byte(plain)); err != nil {
+			t.Fatal(err)
+		}
+		for _, subkeys := range []bool{true, false} {
+			dec, _ := NewCipher(method, "password", false, subkeys)
+			got, err := io.ReadAll(NewConn(&bufConn{r: bytes.NewReader(bc.w.Bytes())}, dec, nil))
+			if err != nil {
+				t.Fatal(err)
+			}
+			// without subkeys the master key decrypts garbage
+			if (string(got) == plain) != subkeys {
+				t.Errorf("%s: subkeys %v read %q", method, subkeys, got)
+			}
+		}
+	}
+}
+
+func TestIVCache(t *testing.T) {
+	c := NewIVCache(time.Minute)
+	if !c.Check([]byte("iv1")) || !c.Check([]byte("iv2")) {
+		t.Fatal("new IVs rejected")
+	}
+	if c.Check([]byte("iv1")) {
+		t.Error("replayed IV accepted")
+	}
+	if c.Rejected() != 1 {
+		t.Errorf("rejected %d, want 1", c.Rejected())
+	}
+	if NewIVCache(0) != nil || !(*IVCache)(nil).Check([]byte("iv1")) {
+		t.Error("a zero window should disable the cache")
+	}
+}
@@ -0,0 +1,156 @@
+package cipher
+
+import (
+	"errors"
+	"io"
+	"net"
+
+	"github.com/daogan/socksproxy/internal/bytepool"
+)
+
+// Conn encrypts a connection with a stream cipher, the IV of each direction
+// is sent first.
+type Conn struct {
+	net.Conn
+	cipher *Cipher
+	ivs    *IVCache
+}
+
+func NewConn(conn net.Conn, cipher *Cipher, ivs *IVCache) *Conn {
+	return &Conn{Conn: conn, cipher: cipher, ivs: ivs}
+}
+
+func (c *Conn) Close() error {
+	return c.Conn.Close()
+}
+
+// CloseWrite and CloseRead half-close the underlying connection, writes
+// being sent as they are made there is nothing to flush.
+func (c *Conn) CloseWrite() error { return closeWrite(c.Conn) }
+func (c *Conn) CloseRead() error  { return closeRead(c.Conn) }
+
+// closeWrite and closeRead half-close conn, or return errors.ErrUnsupported
+// if it can't.
+func closeWrite(conn net.Conn) error {
+	if c, ok := conn.(interface{ CloseWrite() error }); ok {
+		return c.CloseWrite()
+	}
+	return errors.ErrUnsupported
+}
+
+func closeRead(conn net.Conn) error {
+	if c, ok := conn.(interface{ CloseRead() error }); ok {
+		return c.CloseRead()
+	}
+	return errors.ErrUnsupported
+}
+
+// readIV reads the IV of the peer, once.
+func (c *Conn) readIV() error {
+	if c.cipher.dec != nil {
+		return nil
+	}
+	iv := make([]byte, c.cipher.info.IVLen)
+	if _, err := io.ReadFull(c.Conn, iv); err != nil {
+		return err
+	}
+	if !c.ivs.Check(iv) {
+		return ErrReplay
+	}
+	return c.cipher.initDecrypt(iv)
+}
+
+func (c *Conn) Read(b []byte) (n int, err error) {
+	if err = c.readIV(); err != nil {
+		return
+	}
+	buf := bytepool.Default.GetAtLeast(len(b))
+	defer bytepool.Default.Put(buf)
+	encBytes := buf[:len(b)]
+	n, err = c.Conn.Read(encBytes)
+	if n > 0 {
+		c.cipher.decrypt(b[:n], encBytes[:n])
+	}
+	return
+}
+
+func (c *Conn) Write(b []byte) (n int, err error) {
+	var iv []byte
+	if c.cipher.enc == nil {
+		iv, err = c.cipher.initEncrypt()
+		if err != nil {
+			return
+		}
+	}
+	encLen := len(iv) + len(b)
+	buf := bytepool.Default.GetAtLeast(encLen)
+	defer bytepool.Default.Put(buf)
+	encBytes := buf[:encLen]
+	if len(iv) > 0 {
+		copy(encBytes, iv)
+	}
+	c.cipher.encrypt(encBytes[len(iv):], b)
+	// n counts the bytes of b, not of the IV
+	n, err = c.Conn.Write(encBytes)
+	n = max(0, n-len(iv))
+	return
+}
+
+// WriteTo decrypts what c reads in place and writes it to w, sparing the copy
+// Read makes. It returns nil at EOF, as io.Copy does.
+func (c *Conn) WriteTo(w io.Writer) (n int64, err error) {
+	if err = c.readIV(); err == io.EOF {
+		return 0, nil
+	} else if err != nil {
+		return
+	}
+	buf := bytepool.Default.Get()
+	defer bytepool.Default.Put(buf)
+	for {
+		nr, er := c.Conn.Read(buf)
+		if nr > 0 {
+			c.cipher.decrypt(buf[:nr], buf[:nr])
+			nw, ew := w.Write(buf[:nr])
+			n += int64(nw)
+			if ew != nil {
+				return n, ew
+			}
+		}
+		if er == io.EOF {
+			return n, nil
+		}
+		if er != nil {
+			return n, er
+		}
+	}
+}
+
+// ReadFrom encrypts what it reads from r in place and writes it to c, sparing
+// the copy Write makes.
+func (c *Conn) ReadFrom(r io.Reader) (n int64, err error) {
+	buf := bytepool.Default.Get()
+	defer bytepool.Default.Put(buf)
+	for {
+		nr, er := r.Read(buf)
+		if nr > 0 {
+			var ew error
+			if c.cipher.enc == nil {
+				// the first write carries the IV
+				_, ew = c.Write(buf[:nr])
+			} else {
+				c.cipher.encrypt(buf[:nr], buf[:nr])
+				_, ew = c.Conn.Write(buf[:nr])
+			}
+			if ew != nil {
+				return n, ew
+			}
+			n += int64(nr)
+		}
+		if er == io.EOF {
+			return n, nil
+		}
+		if er != nil {
+			return n, er
+		}
+	}
+}
@@ -0,0 +1,392 @@
+package cipher
+
+import (
+	"bytes"
+	"crypto/aes"
+	"crypto/cipher"
+	"crypto/rand"
+	"encoding/base64"
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"io"
+	mrand "math/rand"
+	"net"
+	"strings"
+	"time"
+
+	"github.com/daogan/socksproxy/socks5"
+	"lukechampine.com/blake3"
+)
+
+// Shadowsocks 2022 edition (SIP022):
+// https://github.com/Shadowsocks-NET/shadowsocks-specs/blob/main/2022-1-shadowsocks-2022-edition.md
+//
+// The password is the base64 encoded PSK. Request stream:
+//
+//	salt | AEAD(type, timestamp, len(var header)) | AEAD(ATYP, ADDR, PORT, padding len, padding, payload)
+//	     | AEAD(len(payload)) | AEAD(payload) | ...
+//
+// Response stream:
+//
+//	salt | AEAD(type, timestamp, request salt, len(payload)) | AEAD(payload)
+//	     | AEAD(len(payload)) | AEAD(payload) | ...
+//
+// Every AEAD operation uses a 12 byte little endian counter nonce.
+//
+// With several users on one server (SIP023) the request salt is followed by
+// the identity header, AES(identity subkey, BLAKE3(user PSK)[:16]), the
+// identity subkey being derived from the server PSK and the salt. The client
+// password is then "server PSK:user PSK", and the session subkeys of both
+// directions derive from the user PSK. Only the AES methods have it.
+const (
+	ss2022TypeRequest  = 0
+	ss2022TypeResponse = 1
+
+	ss2022MaxPayload  = 0xffff
+	ss2022MaxPadding  = 900
+	ss2022TimeWindow  = 30 * time.Second
+	SS2022SaltTTL     = 60 * time.Second // minimum replay window
+	ss2022SubkeyCtx   = "shadowsocks 2022 session subkey"
+	ss2022IdentityCtx = "shadowsocks 2022 identity subkey"
+	ss2022EIHLen      = aes.BlockSize
+	ss2022TagOverhead = 16
+)
+
+func IsSS2022(method string) bool {
+	return strings.HasPrefix(method, "2022-")
+}
+
+// SS2022Key returns the PSK of password, or the user PSK of "server
+// PSK:user PSK".
+func SS2022Key(method, password string) ([]byte, error) {
+	keys, err := ss2022Keys(method, password)
+	if err != nil {
+		return nil, err
+	}
+	return keys[len(keys)-1], nil
+}
+
+func ss2022Keys(method, password string) ([][]byte, error) {
+	info, err := Lookup(method)
+	if err != nil {
+		return nil, err
+	}
+	parts := strings.Split(password, ":")
+	if len(parts) > 2 {
+		return nil, errors.New("invalid psk, expect psk or server psk:user psk")
+	}
+	if len(parts) == 2 && !SS2022Identity(method) {
+		return nil, fmt.Errorf("%s has no identity header for the user psk", method)
+	}
+	var keys [][]byte
+	for _, p := range parts {
+		key, err := base64.StdEncoding.DecodeString(p)
+		if err != nil {
+			return nil, fmt.Errorf("invalid psk, expect base64: %v", err)
+		}
+		if len(key) != info.KeyLen {
+			return nil, fmt.Errorf("invalid psk length: %d, expect %d", len(key), info.KeyLen)
+		}
+		keys = append(keys, key)
+	}
+	return keys, nil
+}
+
+// SS2022Identity reports whether method has identity headers for several
+// users on one server.
+func SS2022Identity(method string) bool {
+	return IsSS2022(method) && strings.Contains(method, "-aes-")
+}
+
+type ss2022Conn struct {
+	net.Conn
+	key    []byte
+	client bool
+
+	identity []byte           // server PSK, before the headers of the user
+	users    map[[16]byte]int // user PSK hash to index, on the server
+	userKeys [][]byte
+	user     int
+	newAEAD  func(key []byte) (cipher.AEAD, error)
+	ivs      *IVCache
+
+	enc, dec           cipher.AEAD
+	encNonce, decNonce []byte
+	salt, reqSalt      []byte
+
+	buf     []byte // frame buffer for reading
+	pending []byte // plaintext not yet returned by Read
+}
+
+func NewSS2022Conn(conn net.Conn, method, password string, client bool, ivs *IVCache) (net.Conn, error) {
+	keys, err := ss2022Keys(method, password)
+	if err != nil {
+		return nil, err
+	}
+	c := &ss2022Conn{Conn: conn, key: keys[len(keys)-1], client: client, newAEAD: ciphers[method].NewAEAD, ivs: ivs, user: -1}
+	if len(keys) == 2 {
+		c.identity = keys[0]
+	}
+	return c, nil
+}
+
+// NewSS2022ServerConn is the server side of NewSS2022Conn for the users with
+// the PSKs users, told apart by their identity headers. password is the
+// server PSK.
+func NewSS2022ServerConn(conn net.Conn, method, password string, users []string, ivs *IVCache) (net.Conn, error) {
+	if !SS2022Identity(method) {
+		return nil, fmt.Errorf("%s has no identity header for several users", method)
+	}
+	key, err := SS2022Key(method, password)
+	if err != nil {
+		return nil, err
+	}
+	c := &ss2022Conn{Conn: conn, key: key, newAEAD: ciphers[method].NewAEAD, ivs: ivs, user: -1,
+		identity: key, users: make(map[[16]byte]int)}
+	for i, u := range users {
+		uk, err := SS2022Key(method, u)
+		if err != nil {
+			return nil, fmt.Errorf("user %d: %v", i, err)
+		}
+		c.users[identityHash(uk)] = i
+		c.userKeys = append(c.userKeys, uk)
+	}
+	return c, nil
+}
+
+// User returns the index of the user the server told by the identity
+// header, or -1.
+func (c *ss2022Conn) User() int {
+	return c.user
+}
+
+func (c *ss2022Conn) CloseWrite() error { return closeWrite(c.Conn) }
+func (c *ss2022Conn) CloseRead() error  { return closeRead(c.Conn) }
+
+func identityHash(psk []byte) (h [16]byte) {
+	sum := blake3.Sum256(psk)
+	copy(h[:], sum[:16])
+	return
+}
+
+func identitySubkey(psk, salt []byte) (cipher.Block, error) {
+	subkey := make([]byte, len(psk))
+	blake3.DeriveKey(subkey, ss2022IdentityCtx, append(append([]byte{}, psk...), salt...))
+	return aes.NewCipher(subkey)
+}
+
+func (c *ss2022Conn) sessionAEAD(salt []byte) (cipher.AEAD, error) {
+	subkey := make([]byte, len(c.key))
+	blake3.DeriveKey(subkey, ss2022SubkeyCtx, append(append([]byte{}, c.key...), salt...))
+	return c.newAEAD(subkey)
+}
+
+func (c *ss2022Conn) seal(dst, plaintext []byte) []byte {
+	dst = c.enc.Seal(dst, c.encNonce, plaintext, nil)
+	incNonce(c.encNonce)
+	return dst
+}
+
+// readFrame reads and opens one AEAD sealed frame of n plaintext bytes.
+func (c *ss2022Conn) readFrame(n int) ([]byte, error) {
+	if c.buf == nil {
+		c.buf = make([]byte, ss2022MaxPayload+ss2022TagOverhead)
+	}
+	frame := c.buf[:n+c.dec.Overhead()]
+	if _, err := io.ReadFull(c.Conn, frame); err != nil {
+		return nil, err
+	}
+	b, err := c.dec.Open(frame[:0], c.decNonce, frame, nil)
+	incNonce(c.decNonce)
+	if err != nil {
+		return nil, ErrDecrypt
+	}
+	return b, nil
+}
+
+func checkTimestamp(b []byte) error {
+	ts := time.Unix(int64(binary.BigEndian.Uint64(b)), 0)
+	if d := time.Since(ts); d > ss2022TimeWindow || d < -ss2022TimeWindow {
+		return fmt.Errorf("bad timestamp: %v", ts)
+	}
+	return nil
+}
+
+// readHeader reads the salt and the headers of the incoming stream, leaving
+// the initial payload (prefixed with the target address on the server side)
+// in c.pending.
+func (c *ss2022Conn) readHeader() (err error) {
+	salt := make([]byte, len(c.key))
+	if _, err = io.ReadFull(c.Conn, salt); err != nil {
+		return
+	}
+	if !c.ivs.Check(salt) {
+		return ErrReplay
+	}
+	if c.users != nil {
+		// the identity header tells the user, whose PSK keys the session
+		eih := make([]byte, ss2022EIHLen)
+		if _, err = io.ReadFull(c.Conn, eih); err != nil {
+			return
+		}
+		block, err := identitySubkey(c.identity, salt)
+		if err != nil {
+			return err
+		}
+		var h [16]byte
+		block.Decrypt(h[:], eih)
+		i, ok := c.users[h]
+		if !ok {
+			return ErrDecrypt
+		}
+		c.user, c.key = i, c.userKeys[i]
+	}
+	if c.dec, err = c.sessionAEAD(salt); err != nil {
+		return
+	}
+	c.decNonce = make([]byte, c.dec.NonceSize())
+	if c.client {
+		// type + timestamp + request salt + length
+		b, err := c.readFrame(1 + 8 + len(c.key) + 2)
+		if err != nil {
+			return err
+		}
+		if b[0] != ss2022TypeResponse {
+			return fmt.Errorf("unexpected header type: %d", b[0])
+		}
+		if err = checkTimestamp(b[1:9]); err != nil {
+			return err
+		}
+		if !bytes.Equal(b[9:9+len(c.key)], c.salt) {
+			return errors.New("response salt mismatch")
+		}
+		n := int(binary.BigEndian.Uint16(b[9+len(c.key):]))
+		if c.pending, err = c.readFrame(n); err != nil {
+			return err
+		}
+		return nil
+	}
+	c.reqSalt = salt
+	b, err := c.readFrame(1 + 8 + 2)
+	if err != nil {
+		return
+	}
+	if b[0] != ss2022TypeRequest {
+		return fmt.Errorf("unexpected header type: %d", b[0])
+	}
+	if err = checkTimestamp(b[1:9]); err != nil {
+		return
+	}
+	if b, err = c.readFrame(int(binary.BigEndian.Uint16(b[9:]))); err != nil {
+		return
+	}
+	// ATYP, DST.ADDR, DST.PORT, padding length, padding, initial payload
+	l := socks5.AddrLen(b)
+	if l < 0 || len(b) < l+2 {
+		return errors.New("invalid variable header")
+	}
+	padLen := int(binary.BigEndian.Uint16(b[l:]))
+	if len(b) < l+2+padLen {
+		return errors.New("invalid variable header")
+	}
+	c.pending = append(b[:l:l], b[l+2+padLen:]...)
+	return nil
+}
+
+func (c *ss2022Conn) Read(b []byte) (n int, err error) {
+	if c.dec == nil {
+		if err = c.readHeader(); err != nil {
+			return
+		}
+	}
+	for len(c.pending) == 0 {
+		var l []byte
+		if l, err = c.readFrame(2); err != nil {
+			return
+		}
+		if c.pending, err = c.readFrame(int(binary.BigEndian.Uint16(l))); err != nil {
+			return
+		}
+	}
+	n = copy(b, c.pending)
+	c.pending = c.pending[n:]
+	return
+}
+
+// writeHeader sends the salt and the headers. On the local side b is the
+// target address written first by handleLocal, on the server side b is the
+// first chunk of the response payload.
+func (c *ss2022Conn) writeHeader(b []byte) (err error) {
+	c.salt = make([]byte, len(c.key))
+	if _, err = io.ReadFull(rand.Reader, c.salt); err != nil {
+		return
+	}
+	if c.enc, err = c.sessionAEAD(c.salt); err != nil {
+		return
+	}
+	c.encNonce = make([]byte, c.enc.NonceSize())
+	ts := uint64(time.Now().Unix())
+	out := append([]byte{}, c.salt...)
+	if c.client && c.identity != nil {
+		block, err := identitySubkey(c.identity, c.salt)
+		if err != nil {
+			return err
+		}
+		h := identityHash(c.key)
+		eih := make([]byte, ss2022EIHLen)
+		block.Encrypt(eih, h[:])
+		out = append(out, eih...)
+	}
+	if c.client {
+		// no initial payload, so padding is mandatory
+		padLen := 1 + mrand.Intn(ss2022MaxPadding)
+		varHeader := make([]byte, len(b)+2+padLen)
+		copy(varHeader, b)
+		binary.BigEndian.PutUint16(varHeader[len(b):], uint16(padLen))
+		fixed := []byte{ss2022TypeRequest}
+		fixed = binary.BigEndian.AppendUint64(fixed, ts)
+		fixed = binary.BigEndian.AppendUint16(fixed, uint16(len(varHeader)))
+		out = c.seal(out, fixed)
+		out = c.seal(out, varHeader)
+	} else {
+		fixed := []byte{ss2022TypeResponse}
+		fixed = binary.BigEndian.AppendUint64(fixed, ts)
+		fixed = append(fixed, c.reqSalt...)
+		fixed = binary.BigEndian.AppendUint16(fixed, uint16(len(b)))
+		out = c.seal(out, fixed)
+		out = c.seal(out, b)
+	}
+	_, err = c.Conn.Write(out)
+	return
+}
+
+func (c *ss2022Conn) Write(b []byte) (n int, err error) {
+	if c.enc == nil {
+		first := b
+		if len(first) > ss2022MaxPayload {
+			first = first[:ss2022MaxPayload]
+		}
+		if err = c.writeHeader(first); err != nil {
+			return
+		}
+		n = len(first)
+		b = b[n:]
+	}
+	for len(b) > 0 {
+		chunk := b
+		if len(chunk) > ss2022MaxPayload {
+			chunk = chunk[:ss2022MaxPayload]
+		}
+		size := make([]byte, 2)
+		binary.BigEndian.PutUint16(size, uint16(len(chunk)))
+		out := c.seal(nil, size)
+		out = c.seal(out, chunk)
+		if _, err = c.Conn.Write(out); err != nil {
+			return
+		}
+		n += len(chunk)
+		b = b[len(chunk):]
+	}
+	return
+}
@@ -0,0 +1,100 @@
+package cipher
+
+import (
+	"bytes"
+	"crypto/aes"
+	"encoding/base64"
+	"errors"
+	"io"
+	"testing"
+
+	"lukechampine.com/blake3"
+)
+
+const ss2022Method = "2022-blake3-aes-128-gcm"
+
+func psk(b byte) string {
+	return base64.StdEncoding.EncodeToString(bytes.Repeat([]byte{b}, 16))
+}
+
+// TestSS2022EIH checks the identity header of SIP023 against the spec: the
+// salt is followed by AES(identity subkey, BLAKE3(user PSK)[:16]), with the
+// identity subkey derived from the server PSK and the salt.
+func TestSS2022EIH(t *testing.T) {
+	server, users := psk(1), []string{psk(2), psk(3)}
+	target := []byte{1, 127, 0, 0, 1, 0, 80}
+
+	bc := &bufConn{}
+	c, err := NewSS2022Conn(bc, ss2022Method, server+":"+users[1], true, nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if _, err = c.Write(target); err != nil {
+		t.Fatal(err)
+	}
+	if _, err = c.Write([]byte("hello")); err != nil {
+		t.Fatal(err)
+	}
+	req := bc.w.Bytes()
+
+	salt, eih := req[:16], req[16:32]
+	subkey := make([]byte, 16)
+	blake3.DeriveKey(subkey, "shadowsocks 2022 identity subkey", append(bytes.Repeat([]byte{1}, 16), salt...))
+	block, _ := aes.NewCipher(subkey)
+	sum := blake3.Sum256(bytes.Repeat([]byte{3}, 16))
+	want := make([]byte, 16)
+	block.Encrypt(want, sum[:16])
+	if !bytes.Equal(eih, want) {
+		t.Fatalf("identity header %x, want %x", eih, want)
+	}
+
+	s, err := NewSS2022ServerConn(&bufConn{r: bytes.NewReader(req)}, ss2022Method, server, users, nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	got, err := io.ReadAll(s)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !bytes.Equal(got, append(target, "hello"...)) {
+		t.Errorf("server read %q", got)
+	}
+	if u := s.(*ss2022Conn).User(); u != 1 {
+		t.Errorf("user %d, want 1", u)
+	}
+
+	// the response is keyed with the user PSK too
+	sc := s.(*ss2022Conn).Conn.(*bufConn)
+	if _, err = s.Write([]byte("world")); err != nil {
+		t.Fatal(err)
+	}
+	bc.r = bytes.NewReader(sc.w.Bytes())
+	if got, err = io.ReadAll(c); err != nil || string(got) != "world" {
+		t.Errorf("client read %q, %v", got, err)
+	}
+
+	// a user the server doesn't know
+	s, _ = NewSS2022ServerConn(&bufConn{r: bytes.NewReader(req)}, ss2022Method, server, users[:1], nil)
+	if _, err = io.ReadAll(s); !errors.Is(err, ErrDecrypt) {
+		t.Errorf("unknown user: err %v, want ErrDecrypt", err)
+	}
+}
+
+func TestSS2022Key(t *testing.T) {
+	for _, tt := range []struct {
+		method, password string
+		ok               bool
+	}{
+		{ss2022Method, psk(1), true},
+		{ss2022Method, psk(1) + ":" + psk(2), true},
+		{ss2022Method, "cGFzc3dvcmQ=", false}, // 8 bytes
+		{ss2022Method, "not base64!", false},
+		{"2022-blake3-chacha20-poly1305", base64.StdEncoding.EncodeToString(make([]byte, 32)), true},
+		// no identity headers for chacha20
+		{"2022-blake3-chacha20-poly1305", psk(1) + ":" + psk(2), false},
+	} {
+		if _, err := SS2022Key(tt.method, tt.password); (err == nil) != tt.ok {
+			t.Errorf("SS2022Key(%s, %s): err %v", tt.method, tt.password, err)
+		}
+	}
+}
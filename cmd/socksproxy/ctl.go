@@ -0,0 +1,56 @@
+package main
+
+import (
+	"bufio"
+	"flag"
+	"fmt"
+	"io"
+	"net"
+	"os"
+	"strings"
+
+	"github.com/daogan/socksproxy/tunnel"
+)
+
+// ctl sends a single command to the control socket, or runs an interactive
+// console when no command is given.
+func ctl(args []string) error {
+	fs := flag.NewFlagSet("ctl", flag.ExitOnError)
+	path := fs.String("socket", tunnel.DefaultCtlSocket, "control socket path")
+	fs.Parse(args)
+
+	send := func(cmd string) error {
+		conn, err := net.Dial("unix", *path)
+		if err != nil {
+			return err
+		}
+		defer conn.Close()
+		if _, err = fmt.Fprintln(conn, cmd); err != nil {
+			return err
+		}
+		_, err = io.Copy(os.Stdout, conn)
+		return err
+	}
+	if fs.NArg() > 0 {
+		return send(strings.Join(fs.Args(), " "))
+	}
+	scanner := bufio.NewScanner(os.Stdin)
+	for {
+		fmt.Print("> ")
+		if !scanner.Scan() {
+			break
+		}
+		cmd := strings.TrimSpace(scanner.Text())
+		switch cmd {
+		case "":
+			continue
+		case "quit", "exit":
+			return nil
+		}
+		if err := send(cmd); err != nil {
+			return err
+		}
+	}
+	fmt.Println()
+	return scanner.Err()
+}
@@ -0,0 +1,28 @@
+package main
+
+import (
+	"fmt"
+	"os"
+	"strconv"
+	"strings"
+)
+
+// envDaemon is set in the background process, which a restart keeps in the
+// background without daemonizing again.
+const envDaemon = "SOCKSPROXY_DAEMON"
+
+func writePidFile(path string) error {
+	return os.WriteFile(path, []byte(fmt.Sprintf("%d\n", os.Getpid())), 0644)
+}
+
+// removePidFile removes the pid file unless a restarted process wrote its
+// own pid there since.
+func removePidFile(path string) {
+	b, err := os.ReadFile(path)
+	if err != nil {
+		return
+	}
+	if pid, _ := strconv.Atoi(strings.TrimSpace(string(b))); pid == os.Getpid() {
+		os.Remove(path)
+	}
+}
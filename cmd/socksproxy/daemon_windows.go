@@ -0,0 +1,7 @@
+package main
+
+import "errors"
+
+func daemonize() error {
+	return errors.New("not supported on windows, install a service instead")
+}
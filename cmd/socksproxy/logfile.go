@@ -0,0 +1,174 @@
+package main
+
+import (
+	"fmt"
+	"log"
+	"os"
+	"os/signal"
+	"path/filepath"
+	"runtime"
+	"sort"
+	"strings"
+	"sync"
+	"syscall"
+	"time"
+
+	"github.com/daogan/socksproxy/tunnel"
+)
+
+// backupLayout is the suffix of a rotated log file, path.20060102-150405.000
+const backupLayout = "20060102-150405.000"
+
+// rotatingFile is the -log file, rotated by size or age. Rotated files are
+// renamed with the time as suffix and removed once too many or too old. A
+// file that can't be opened leaves the log in the old one, with the error on
+// stderr.
+type rotatingFile struct {
+	sync.Mutex
+	path   string
+	f      *os.File
+	size   int64
+	opened time.Time
+	retry  time.Time // of the next rotation after one failed
+}
+
+// openLog sends the log to path, opening it again on SIGHUP after it was
+// rotated by someone else.
+func openLog(path string) error {
+	f, size, err := openFile(path)
+	if err != nil {
+		return err
+	}
+	l := &rotatingFile{path: path, f: f, size: size, opened: time.Now()}
+	// until Run logs through slog
+	log.SetOutput(l)
+	tunnel.SetLogOutput(l)
+	hup := make(chan os.Signal, 1)
+	signal.Notify(hup, syscall.SIGHUP)
+	go func() {
+		for range hup {
+			f, size, err := openFile(path)
+			if err != nil {
+				fmt.Fprintln(os.Stderr, "log error:", err)
+				continue
+			}
+			l.Lock()
+			old := l.f
+			l.f, l.size, l.opened = f, size, time.Now()
+			l.Unlock()
+			old.Close()
+		}
+	}()
+	return nil
+}
+
+// openFile opens path to append to, with its size.
+func openFile(path string) (*os.File, int64, error) {
+	f, err := os.OpenFile(path, os.O_WRONLY|os.O_APPEND|os.O_CREATE, 0644)
+	if err != nil {
+		return nil, 0, err
+	}
+	fi, err := f.Stat()
+	if err != nil {
+		f.Close()
+		return nil, 0, err
+	}
+	return f, fi.Size(), nil
+}
+
+func (l *rotatingFile) Write(p []byte) (int, error) {
+	l.Lock()
+	defer l.Unlock()
+	if l.size > 0 && l.due(len(p)) {
+		if err := l.rotate(); err != nil {
+			// keep writing to the file we have, trying again in a while
+			fmt.Fprintln(os.Stderr, "log rotation error:", err)
+			l.retry = time.Now().Add(time.Minute)
+		}
+	}
+	n, err := l.f.Write(p)
+	l.size += int64(n)
+	return n, err
+}
+
+func (l *rotatingFile) due(n int) bool {
+	if time.Now().Before(l.retry) {
+		return false
+	}
+	if logMaxSize > 0 && l.size+int64(n) > int64(logMaxSize)<<20 {
+		return true
+	}
+	return logRotateInterval > 0 && time.Since(l.opened) >= time.Duration(logRotateInterval)*time.Second
+}
+
+// rotate renames the file and opens a new one, or leaves l.f as it was.
+func (l *rotatingFile) rotate() error {
+	backup := l.path + "." + time.Now().Format(backupLayout)
+	if runtime.GOOS == "windows" {
+		return l.rotateClosed(backup)
+	}
+	if err := os.Rename(l.path, backup); err != nil {
+		return err
+	}
+	f, size, err := openFile(l.path)
+	if err != nil {
+		// the old file keeps its name and the log
+		os.Rename(backup, l.path)
+		return err
+	}
+	l.f.Close()
+	l.f, l.size, l.opened = f, size, time.Now()
+	go removeBackups(l.path)
+	return nil
+}
+
+// rotateClosed is rotate for windows, which can't rename an open file: the
+// old file is opened again when the rename or the new file fails.
+func (l *rotatingFile) rotateClosed(backup string) error {
+	l.f.Close()
+	renameErr := os.Rename(l.path, backup)
+	f, size, err := openFile(l.path)
+	if err != nil && renameErr == nil {
+		f, size, _ = openFile(backup)
+	}
+	if f != nil {
+		l.f, l.size, l.opened = f, size, time.Now()
+	}
+	if renameErr != nil {
+		return renameErr
+	}
+	if err != nil {
+		return err
+	}
+	go removeBackups(l.path)
+	return nil
+}
+
+// removeBackups removes the rotated files of path beyond -log-max-backups or
+// older than -log-max-age.
+func removeBackups(path string) {
+	if logMaxBackups <= 0 && logMaxAge <= 0 {
+		return
+	}
+	matches, err := filepath.Glob(path + ".*")
+	if err != nil {
+		return
+	}
+	var backups []string
+	for _, m := range matches {
+		if _, err := time.Parse(backupLayout, strings.TrimPrefix(m, path+".")); err == nil {
+			backups = append(backups, m)
+		}
+	}
+	// newest first, the suffix sorts by time
+	sort.Sort(sort.Reverse(sort.StringSlice(backups)))
+	for i, b := range backups {
+		if logMaxBackups > 0 && i >= logMaxBackups {
+			os.Remove(b)
+			continue
+		}
+		if fi, err := os.Stat(b); err == nil && logMaxAge > 0 && time.Since(fi.ModTime()) > time.Duration(logMaxAge)*time.Second {
+			os.Remove(b)
+		}
+	}
+}
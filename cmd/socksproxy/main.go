@@ -0,0 +1,91 @@
+package main
+
+import (
+	"flag"
+	"fmt"
+	"log"
+	"os"
+
+	"github.com/daogan/socksproxy/tunnel"
+)
+
+var (
+	showVersion bool
+	configFile  string
+	daemon      bool
+	pidFile     string
+	logFile     string
+	config      tunnel.Config
+
+	logMaxSize        int
+	logRotateInterval int
+	logMaxAge         int
+	logMaxBackups     int
+)
+
+func init() {
+	flag.BoolVar(&showVersion, "version", false, "print version and exit")
+	flag.StringVar(&configFile, "c", "", "json config file, flags given on the command line override it")
+	flag.BoolVar(&daemon, "daemon", false, "run in the background, logging to -log")
+	flag.StringVar(&pidFile, "pidfile", "", "file to write the pid to")
+	flag.StringVar(&logFile, "log", "", "log to file instead of stderr, reopened on SIGHUP")
+	flag.IntVar(&logMaxSize, "log-max-size", 0, "MiB the -log file grows to before it is rotated, 0 for no limit")
+	flag.IntVar(&logRotateInterval, "log-rotate-interval", 0, "seconds between rotations of the -log file, 0 to disable")
+	flag.IntVar(&logMaxAge, "log-max-age", 0, "seconds rotated log files are kept, 0 to keep them")
+	flag.IntVar(&logMaxBackups, "log-max-backups", 0, "number of rotated log files kept, 0 to keep all")
+	config.RegisterFlags(flag.CommandLine)
+}
+
+func main() {
+	if len(os.Args) > 1 && os.Args[1] == "update" {
+		if err := update(os.Args[2:]); err != nil {
+			log.Fatal("update error: ", err)
+		}
+		return
+	}
+	if len(os.Args) > 1 && os.Args[1] == "ctl" {
+		if err := ctl(os.Args[2:]); err != nil {
+			log.Fatal("ctl error: ", err)
+		}
+		return
+	}
+	if len(os.Args) > 1 && os.Args[1] == "service" {
+		if err := service(os.Args[2:]); err != nil {
+			log.Fatal("service error: ", err)
+		}
+		return
+	}
+
+	flag.Parse()
+	if showVersion {
+		fmt.Println(version)
+		return
+	}
+	if daemon && os.Getenv(envDaemon) == "" {
+		if err := daemonize(); err != nil {
+			log.Fatal("daemon error: ", err)
+		}
+		return
+	}
+	if logFile != "" {
+		if err := openLog(logFile); err != nil {
+			log.Fatal("log error: ", err)
+		}
+	}
+	if pidFile != "" {
+		if err := writePidFile(pidFile); err != nil {
+			log.Fatal("pidfile error: ", err)
+		}
+	}
+	err := tunnel.Run(flag.CommandLine, &config, configFile)
+	if pidFile != "" {
+		removePidFile(pidFile)
+	}
+	if err == tunnel.ErrNothingToRun {
+		flag.Usage()
+		return
+	}
+	if err != nil {
+		log.Fatal(err)
+	}
+}
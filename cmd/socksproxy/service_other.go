@@ -0,0 +1,9 @@
+//go:build !windows
+
+package main
+
+import "errors"
+
+func service(args []string) error {
+	return errors.New("services are for windows, use systemd or -daemon elsewhere")
+}
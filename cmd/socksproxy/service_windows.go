@@ -0,0 +1,157 @@
+package main
+
+import (
+	"context"
+	"errors"
+	"flag"
+	"fmt"
+	"os"
+	"path/filepath"
+
+	"github.com/daogan/socksproxy/tunnel"
+	"golang.org/x/sys/windows/svc"
+	"golang.org/x/sys/windows/svc/eventlog"
+	"golang.org/x/sys/windows/svc/mgr"
+)
+
+// service installs the proxy as a windows service started at boot, removes
+// it, or runs it for the service control manager. The flags after install are
+// the ones the service runs with.
+func service(args []string) error {
+	fs := flag.NewFlagSet("service", flag.ExitOnError)
+	name := fs.String("name", "socksproxy", "service name")
+	fs.Usage = func() {
+		fmt.Fprintln(fs.Output(), "usage: socksproxy service [-name socksproxy] install|uninstall|run [flags]")
+		fs.PrintDefaults()
+	}
+	fs.Parse(args)
+	if fs.NArg() == 0 {
+		fs.Usage()
+		os.Exit(2)
+	}
+	switch fs.Arg(0) {
+	case "install":
+		return installService(*name, fs.Args()[1:])
+	case "uninstall":
+		return uninstallService(*name)
+	case "run":
+		return runService(*name, fs.Args()[1:])
+	}
+	return fmt.Errorf("unknown service command %s", fs.Arg(0))
+}
+
+func installService(name string, flags []string) error {
+	exe, err := os.Executable()
+	if err != nil {
+		return err
+	}
+	if exe, err = filepath.Abs(exe); err != nil {
+		return err
+	}
+	m, err := mgr.Connect()
+	if err != nil {
+		return err
+	}
+	defer m.Disconnect()
+	if s, err := m.OpenService(name); err == nil {
+		s.Close()
+		return fmt.Errorf("service %s already exists", name)
+	}
+	args := append([]string{"service", "-name", name, "run"}, flags...)
+	s, err := m.CreateService(name, exe, mgr.Config{
+		DisplayName: name,
+		Description: "socksproxy " + version,
+		StartType:   mgr.StartAutomatic,
+	}, args...)
+	if err != nil {
+		return err
+	}
+	defer s.Close()
+	if err = eventlog.InstallAsEventCreate(name, eventlog.Error|eventlog.Warning|eventlog.Info); err != nil {
+		s.Delete()
+		return fmt.Errorf("event log: %v", err)
+	}
+	fmt.Printf("installed service %s, start it with: sc start %s\n", name, name)
+	return nil
+}
+
+func uninstallService(name string) error {
+	m, err := mgr.Connect()
+	if err != nil {
+		return err
+	}
+	defer m.Disconnect()
+	s, err := m.OpenService(name)
+	if err != nil {
+		return fmt.Errorf("service %s is not installed", name)
+	}
+	defer s.Close()
+	if err = s.Delete(); err != nil {
+		return err
+	}
+	eventlog.Remove(name)
+	fmt.Printf("removed service %s\n", name)
+	return nil
+}
+
+func runService(name string, flags []string) error {
+	inService, err := svc.IsWindowsService()
+	if err != nil {
+		return err
+	}
+	if !inService {
+		return errors.New("service run is for the service control manager, run socksproxy with the flags alone instead")
+	}
+	elog, err := eventlog.Open(name)
+	if err != nil {
+		return err
+	}
+	defer elog.Close()
+	if err = flag.CommandLine.Parse(flags); err != nil {
+		return err
+	}
+	elog.Info(1, fmt.Sprintf("starting %s %s", name, version))
+	if err = svc.Run(name, &proxyService{elog: elog}); err != nil {
+		elog.Error(1, fmt.Sprintf("%s failed: %v", name, err))
+		return err
+	}
+	elog.Info(1, fmt.Sprintf("stopped %s", name))
+	return nil
+}
+
+type proxyService struct {
+	elog *eventlog.Log
+}
+
+func (p *proxyService) Execute(args []string, r <-chan svc.ChangeRequest, s chan<- svc.Status) (bool, uint32) {
+	s <- svc.Status{State: svc.StartPending}
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+	done := make(chan error, 1)
+	go func() {
+		done <- tunnel.RunContext(ctx, flag.CommandLine, &config, configFile)
+	}()
+	s <- svc.Status{State: svc.Running, Accepts: svc.AcceptStop | svc.AcceptShutdown}
+	for {
+		select {
+		case err := <-done:
+			if err == tunnel.ErrNothingToRun {
+				err = errors.New("no local or server address given")
+			}
+			if err != nil {
+				p.elog.Error(1, err.Error())
+				return true, 1
+			}
+			return false, 0
+		case c := <-r:
+			switch c.Cmd {
+			case svc.Interrogate:
+				s <- c.CurrentStatus
+			case svc.Stop, svc.Shutdown:
+				// the connections drain for up to -drain-timeout
+				s <- svc.Status{State: svc.StopPending, WaitHint: uint32(config.DrainTimeout+5) * 1000}
+				cancel()
+			}
+		}
+	}
+}
@@ -0,0 +1,190 @@
+package main
+
+import (
+	"bytes"
+	"crypto/ed25519"
+	"encoding/base64"
+	"encoding/json"
+	"errors"
+	"flag"
+	"fmt"
+	"io"
+	"log"
+	"net/http"
+	"os"
+	"os/exec"
+	"path/filepath"
+	"runtime"
+	"strconv"
+	"strings"
+	"time"
+)
+
+// version is set at build time with -ldflags "-X main.version=..."
+var version = "dev"
+
+// updateKey is the base64 ed25519 public key releases are signed with, set
+// at build time with -ldflags "-X main.updateKey=..."
+var updateKey = ""
+
+const updateURL = "https://github.com/daogan/socksproxy/releases/latest/download/release.json"
+
+// release is the manifest served at the update url, signed by the base64
+// signature at the url with .sig appended. Binaries are keyed by GOOS-GOARCH
+// and signed over their full content.
+type release struct {
+	Version  string `json:"version"`
+	Binaries map[string]struct {
+		URL       string `json:"url"`
+		Signature string `json:"signature"`
+	} `json:"binaries"`
+}
+
+var updateClient = &http.Client{Timeout: 5 * time.Minute}
+
+func fetch(url string) ([]byte, error) {
+	resp, err := updateClient.Get(url)
+	if err != nil {
+		return nil, err
+	}
+	defer resp.Body.Close()
+	if resp.StatusCode != http.StatusOK {
+		return nil, fmt.Errorf("fail to fetch %s: %s", url, resp.Status)
+	}
+	return io.ReadAll(resp.Body)
+}
+
+func update(args []string) error {
+	fs := flag.NewFlagSet("update", flag.ExitOnError)
+	url := fs.String("url", updateURL, "release manifest url")
+	key := fs.String("pubkey", updateKey, "base64 ed25519 public key releases are signed with")
+	force := fs.Bool("f", false, "update even if already at the latest version")
+	fs.Parse(args)
+
+	pub, err := base64.StdEncoding.DecodeString(*key)
+	if err != nil || len(pub) != ed25519.PublicKeySize {
+		return errors.New("invalid or missing release public key")
+	}
+	data, err := fetch(*url)
+	if err != nil {
+		return err
+	}
+	sigData, err := fetch(*url + ".sig")
+	if err != nil {
+		return err
+	}
+	sig, err := base64.StdEncoding.DecodeString(strings.TrimSpace(string(sigData)))
+	if err != nil || !ed25519.Verify(pub, data, sig) {
+		return errors.New("bad release manifest signature, refusing to update")
+	}
+	var rel release
+	if err = json.Unmarshal(data, &rel); err != nil {
+		return fmt.Errorf("invalid release manifest: %v", err)
+	}
+	if rel.Version == version && !*force {
+		log.Printf("already at the latest version %s\n", version)
+		return nil
+	}
+	// an old manifest, still validly signed, mustn't bring back old bugs
+	if older(rel.Version, version) {
+		return fmt.Errorf("release %s is older than %s, refusing to downgrade", rel.Version, version)
+	}
+	platform := runtime.GOOS + "-" + runtime.GOARCH
+	bin, ok := rel.Binaries[platform]
+	if !ok {
+		return fmt.Errorf("no release binary for %s", platform)
+	}
+	sig, err = base64.StdEncoding.DecodeString(bin.Signature)
+	if err != nil {
+		return fmt.Errorf("invalid signature: %v", err)
+	}
+	log.Printf("downloading %s %s\n", rel.Version, bin.URL)
+	data, err = fetch(bin.URL)
+	if err != nil {
+		return err
+	}
+	if !ed25519.Verify(pub, data, sig) {
+		return errors.New("bad signature, refusing to update")
+	}
+
+	exe, err := os.Executable()
+	if err != nil {
+		return err
+	}
+	if exe, err = filepath.EvalSymlinks(exe); err != nil {
+		return err
+	}
+	// write next to the executable so the renames below stay atomic
+	tmp, err := os.CreateTemp(filepath.Dir(exe), ".socksproxy-update-")
+	if err != nil {
+		return err
+	}
+	defer os.Remove(tmp.Name())
+	if _, err = tmp.Write(data); err == nil {
+		err = tmp.Chmod(0755)
+	}
+	if cerr := tmp.Close(); err == nil {
+		err = cerr
+	}
+	if err != nil {
+		return err
+	}
+	old := exe + ".old"
+	if err = os.Rename(exe, old); err != nil {
+		return err
+	}
+	if err = os.Rename(tmp.Name(), exe); err != nil {
+		os.Rename(old, exe)
+		return err
+	}
+	// make sure the new binary starts, roll back otherwise
+	out, err := exec.Command(exe, "-version").Output()
+	if err != nil || strings.TrimSpace(string(out)) != rel.Version {
+		os.Rename(old, exe)
+		if err == nil {
+			err = fmt.Errorf("unexpected version %q", bytes.TrimSpace(out))
+		}
+		return fmt.Errorf("new binary fails to start, rolled back: %v", err)
+	}
+	log.Printf("updated %s -> %s, restart to use the new version\n", version, rel.Version)
+	return nil
+}
+
+// older reports whether the release version a, like v1.2.3, is before the
+// running one b. Any release updates a build off the tags, like dev or a
+// commit hash, while a release not named like a tag is taken for older.
+func older(a, b string) bool {
+	va, okA := parseVersion(a)
+	vb, okB := parseVersion(b)
+	if !okB {
+		return false
+	}
+	if !okA {
+		return true
+	}
+	for i := range va {
+		if va[i] != vb[i] {
+			return va[i] < vb[i]
+		}
+	}
+	return false
+}
+
+// parseVersion parses the v1.2.3 of a tag, or of git describe like
+// v1.2.3-4-gabcdef.
+func parseVersion(v string) ([3]int, bool) {
+	var n [3]int
+	v, _, _ = strings.Cut(strings.TrimPrefix(v, "v"), "-")
+	parts := strings.Split(v, ".")
+	if len(parts) != 3 {
+		return n, false
+	}
+	for i, p := range parts {
+		x, err := strconv.Atoi(p)
+		if err != nil || x < 0 {
+			return n, false
+		}
+		n[i] = x
+	}
+	return n, true
+}
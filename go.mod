@@ -0,0 +1,25 @@
+module github.com/daogan/socksproxy
+
+go 1.26.3
+
+require (
+	github.com/hashicorp/yamux v0.1.2
+	github.com/oschwald/maxminddb-golang v1.13.1
+	github.com/quic-go/quic-go v0.63.0
+	github.com/xtaci/kcp-go/v5 v5.6.72
+	golang.org/x/crypto v0.57.0
+	golang.org/x/net v0.59.0
+	golang.org/x/sys v0.48.0
+	gvisor.dev/gvisor v0.0.0-20260527191743-a81fd9dd382e
+	lukechampine.com/blake3 v1.4.1
+)
+
+require (
+	github.com/google/btree v1.1.2 // indirect
+	github.com/klauspost/cpuid/v2 v2.2.6 // indirect
+	github.com/klauspost/reedsolomon v1.12.0 // indirect
+	github.com/pkg/errors v0.9.1 // indirect
+	github.com/tjfoc/gmsm v1.4.1 // indirect
+	golang.org/x/exp v0.0.0-20250711185948-6ae5c78190dc // indirect
+	golang.org/x/time v0.15.0 // indirect
+)
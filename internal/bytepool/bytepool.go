@@ -0,0 +1,79 @@
+// Package bytepool keeps buffers of a few size classes for reuse, so relaying
+// doesn't allocate for every read.
+package bytepool
+
+import (
+	"sync"
+	"sync/atomic"
+)
+
+// BufSize is the size of the buffers Get returns.
+const BufSize = 4 * 1024
+
+// Sizes are the size classes of the buffers, smallest first.
+var Sizes = []int{BufSize, 16 * 1024, 64 * 1024}
+
+type Pool struct {
+	classes []class
+}
+
+type class struct {
+	size   int
+	pool   sync.Pool // of *[]byte
+	allocs atomic.Uint64
+}
+
+// Default is the pool the relay and the ciphers share.
+var Default = New(Sizes...)
+
+// New returns a pool of buffers of the sizes, given smallest first.
+func New(sizes ...int) *Pool {
+	bp := &Pool{classes: make([]class, len(sizes))}
+	for i, size := range sizes {
+		c := &bp.classes[i]
+		c.size = size
+		c.pool.New = func() any {
+			c.allocs.Add(1)
+			b := make([]byte, size)
+			return &b
+		}
+	}
+	return bp
+}
+
+// GetAtLeast returns a buffer of the smallest class holding size bytes, its
+// length that of the class. Bigger ones are allocated and not kept.
+func (bp *Pool) GetAtLeast(size int) []byte {
+	for i := range bp.classes {
+		if c := &bp.classes[i]; size <= c.size {
+			return *c.pool.Get().(*[]byte)
+		}
+	}
+	return make([]byte, size)
+}
+
+// Get returns a buffer of the smallest class.
+func (bp *Pool) Get() []byte {
+	return bp.GetAtLeast(0)
+}
+
+// Put gives back a buffer of Get or GetAtLeast, others are dropped.
+func (bp *Pool) Put(b []byte) {
+	b = b[:cap(b)]
+	for i := range bp.classes {
+		if c := &bp.classes[i]; len(b) == c.size {
+			c.pool.Put(&b)
+			return
+		}
+	}
+}
+
+// Allocs returns the number of buffers made for each class because none was
+// free.
+func (bp *Pool) Allocs() map[int]uint64 {
+	m := make(map[int]uint64, len(bp.classes))
+	for i := range bp.classes {
+		m[bp.classes[i].size] = bp.classes[i].allocs.Load()
+	}
+	return m
+}
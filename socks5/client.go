@@ -0,0 +1,115 @@
+package socks5
+
+import (
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"io"
+	"net"
+	"strconv"
+)
+
+// EncodeAddr converts host:port into the {ATYP, ADDR, PORT} form used in
+// socks requests and in the tunnel header.
+func EncodeAddr(hostport string) ([]byte, error) {
+	host, portStr, err := net.SplitHostPort(hostport)
+	if err != nil {
+		return nil, err
+	}
+	port, err := strconv.ParseUint(portStr, 10, 16)
+	if err != nil {
+		return nil, fmt.Errorf("invalid port: %s", portStr)
+	}
+	var addr []byte
+	if ip := net.ParseIP(host); ip == nil {
+		if len(host) > 255 {
+			return nil, errors.New("domain name too long")
+		}
+		addr = append([]byte{TypeDomain, byte(len(host))}, host...)
+	} else if ip4 := ip.To4(); ip4 != nil {
+		addr = append([]byte{TypeIPv4}, ip4...)
+	} else {
+		addr = append([]byte{TypeIPv6}, ip...)
+	}
+	return binary.BigEndian.AppendUint16(addr, uint16(port)), nil
+}
+
+// Dial connects to target through the socks5 proxy at proxyAddr,
+// authenticating with user/pass (RFC 1929) when user is not empty.
+func Dial(proxyAddr, user, pass, target string) (net.Conn, error) {
+	tgtAddr, err := EncodeAddr(target)
+	if err != nil {
+		return nil, err
+	}
+	conn, err := net.Dial("tcp", proxyAddr)
+	if err != nil {
+		return nil, err
+	}
+	if err = Connect(conn, user, pass, tgtAddr); err != nil {
+		conn.Close()
+		return nil, err
+	}
+	return conn, nil
+}
+
+// Connect sends a CONNECT request for tgtAddr on conn, authenticating first
+// with user/pass when user is not empty.
+func Connect(conn net.Conn, user, pass string, tgtAddr []byte) error {
+	method := byte(MethodNoAuth)
+	if user != "" {
+		method = MethodUserPass
+	}
+	if _, err := conn.Write([]byte{Version5, 1, method}); err != nil {
+		return err
+	}
+	buf := make([]byte, 262)
+	if _, err := io.ReadFull(conn, buf[:2]); err != nil {
+		return err
+	}
+	if buf[0] != Version5 || buf[1] != method {
+		return errors.New("socks proxy refused authentication method")
+	}
+	if method == MethodUserPass {
+		if len(user) > 255 || len(pass) > 255 {
+			return errors.New("socks username or password too long")
+		}
+		req := append([]byte{0x01, byte(len(user))}, user...)
+		req = append(append(req, byte(len(pass))), pass...)
+		if _, err := conn.Write(req); err != nil {
+			return err
+		}
+		if _, err := io.ReadFull(conn, buf[:2]); err != nil {
+			return err
+		}
+		if buf[1] != 0x00 {
+			return errors.New("socks proxy authentication failed")
+		}
+	}
+	req := append([]byte{Version5, CmdConnect, 0x00}, tgtAddr...)
+	if _, err := conn.Write(req); err != nil {
+		return err
+	}
+	// VER REP RSV ATYP, then BND.ADDR and BND.PORT
+	if _, err := io.ReadFull(conn, buf[:4]); err != nil {
+		return err
+	}
+	if buf[1] != 0x00 {
+		return fmt.Errorf("socks connect failed, reply: %d", buf[1])
+	}
+	var bndLen int
+	switch buf[3] {
+	case TypeIPv4:
+		bndLen = net.IPv4len + 2
+	case TypeIPv6:
+		bndLen = net.IPv6len + 2
+	case TypeDomain:
+		if _, err := io.ReadFull(conn, buf[:1]); err != nil {
+			return err
+		}
+		bndLen = int(buf[0]) + 2
+	default:
+		return errors.New("not supported address type")
+	}
+	_, err := io.ReadFull(conn, buf[:bndLen])
+	return err
+}
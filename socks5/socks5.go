@@ -0,0 +1,253 @@
+// Package socks5 implements the parts of SOCKS5 (RFC 1928) shared by the
+// proxy and the tunnel: the handshake, requests and replies, the address
+// encoding also used in the tunnel header, and a client.
+package socks5
+
+import (
+	"bytes"
+	"crypto/subtle"
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"io"
+	"net"
+	"strconv"
+)
+
+const (
+	Version5        = 0x05
+	CmdConnect      = 0x01
+	CmdBind         = 0x02
+	CmdUDPAssociate = 0x03
+
+	MethodNoAuth       = 0x00
+	MethodUserPass     = 0x02
+	MethodNoAcceptable = 0xff
+
+	TypeIPv4   = 1
+	TypeDomain = 3
+	TypeIPv6   = 4
+
+	// the REP field of a reply
+	RepSucceeded            = 0x00
+	RepGeneralFailure       = 0x01
+	RepNotAllowed           = 0x02
+	RepNetworkUnreachable   = 0x03
+	RepHostUnreachable      = 0x04
+	RepConnectionRefused    = 0x05
+	RepTTLExpired           = 0x06
+	RepCommandNotSupported  = 0x07
+	RepAddrTypeNotSupported = 0x08
+)
+
+var (
+	// ErrCommandNotSupported and ErrAddrTypeNotSupported are the errors of
+	// requests to answer with RepCommandNotSupported and
+	// RepAddrTypeNotSupported.
+	ErrCommandNotSupported  = errors.New("not supported socks command")
+	ErrAddrTypeNotSupported = errors.New("not supported address type")
+)
+
+// Handshake negotiates the authentication method with a client, requiring
+// the user:pass in auth unless it is empty. Each message is read at the
+// lengths it declares, however the client splits or joins its writes.
+// https://tools.ietf.org/rfc/rfc1928.txt
+func Handshake(conn net.Conn, auth string) error {
+	buf := make([]byte, 2+255)
+	// 1.
+	// The client connects to the server, and sends a version
+	//    identifier/method selection message:
+	//
+	//    +----+----------+----------+
+	//    |VER | NMETHODS | METHODS  |
+	//    +----+----------+----------+
+	//    | 1  |    1     | 1 to 255 |
+	//    +----+----------+----------+
+	if _, err := io.ReadFull(conn, buf[:2]); err != nil {
+		return err
+	}
+	if buf[0] != Version5 {
+		return fmt.Errorf("expect version 5, got: %d", buf[0])
+	}
+	n := 2 + int(buf[1])
+	if _, err := io.ReadFull(conn, buf[2:n]); err != nil {
+		return err
+	}
+	// 2.
+	// The server selects from one of the methods given in METHODS, and
+	//    sends a METHOD selection message:
+	//
+	//    +----+--------+
+	//    |VER | METHOD |
+	//    +----+--------+
+	//    | 1  |   1    |
+	//    +----+--------+
+	// METHOD: X'00' NO AUTHENTICATION REQUIRED
+	//         X'02' USERNAME/PASSWORD
+	//         X'FF' NO ACCEPTABLE METHODS
+	method := byte(MethodNoAuth)
+	if auth != "" {
+		method = MethodUserPass
+		if bytes.IndexByte(buf[2:n], method) < 0 {
+			conn.Write([]byte{Version5, MethodNoAcceptable})
+			return errors.New("client doesn't support username/password authentication")
+		}
+	}
+	if _, err := conn.Write([]byte{Version5, method}); err != nil {
+		return err
+	}
+	if method == MethodUserPass {
+		return authenticate(conn, auth)
+	}
+	return nil
+}
+
+// https://tools.ietf.org/rfc/rfc1929.txt
+func authenticate(conn net.Conn, auth string) error {
+	buf := make([]byte, 256)
+	//    +----+------+----------+------+----------+
+	//    |VER | ULEN |  UNAME   | PLEN |  PASSWD  |
+	//    +----+------+----------+------+----------+
+	//    | 1  |  1   | 1 to 255 |  1   | 1 to 255 |
+	//    +----+------+----------+------+----------+
+	if _, err := io.ReadFull(conn, buf[:2]); err != nil {
+		return err
+	}
+	if buf[0] != 0x01 {
+		return fmt.Errorf("expect auth version 1, got: %d", buf[0])
+	}
+	user := make([]byte, buf[1])
+	if _, err := io.ReadFull(conn, user); err != nil {
+		return err
+	}
+	if _, err := io.ReadFull(conn, buf[:1]); err != nil {
+		return err
+	}
+	pass := make([]byte, buf[0])
+	if _, err := io.ReadFull(conn, pass); err != nil {
+		return err
+	}
+	//    +----+--------+
+	//    |VER | STATUS |
+	//    +----+--------+
+	//    | 1  |   1    |
+	//    +----+--------+
+	// STATUS: X'00' success, anything else closes the connection
+	cred := string(user) + ":" + string(pass)
+	if subtle.ConstantTimeCompare([]byte(cred), []byte(auth)) != 1 {
+		conn.Write([]byte{0x01, 0x01})
+		return fmt.Errorf("authentication failed for user %q", user)
+	}
+	_, err := conn.Write([]byte{0x01, 0x00})
+	return err
+}
+
+// ReadRequest reads the command and the target address of a request, each
+// part at the length it declares.
+func ReadRequest(conn net.Conn) (cmd byte, addr []byte, err error) {
+	buf := make([]byte, 3)
+	// 3.
+	// The SOCKS request is formed as follows:
+	//
+	//    +----+-----+-------+------+----------+----------+
+	//    |VER | CMD |  RSV  | ATYP | DST.ADDR | DST.PORT |
+	//    +----+-----+-------+------+----------+----------+
+	//    | 1  |  1  | X'00' |  1   | Variable |    2     |
+	//    +----+-----+-------+------+----------+----------+
+	if _, err = io.ReadFull(conn, buf); err != nil {
+		return
+	}
+	if buf[0] != Version5 {
+		err = fmt.Errorf("expect version 5, got: %d", buf[0])
+		return
+	}
+	if buf[1] != CmdConnect && buf[1] != CmdBind && buf[1] != CmdUDPAssociate {
+		err = ErrCommandNotSupported
+		return
+	}
+	if addr, err = ReadAddr(conn); err != nil {
+		return
+	}
+	return buf[1], addr, nil
+}
+
+// WriteReply sends a socks reply, bnd is the bound socks address or nil.
+func WriteReply(conn net.Conn, rep byte, bnd []byte) error {
+	// 4.
+	// The server evaluates the request, and
+	//    returns a reply formed as follows:
+	//
+	//    +----+-----+-------+------+----------+----------+
+	//    |VER | REP |  RSV  | ATYP | BND.ADDR | BND.PORT |
+	//    +----+-----+-------+------+----------+----------+
+	//    | 1  |  1  | X'00' |  1   | Variable |    2     |
+	//    +----+-----+-------+------+----------+----------+
+	if bnd == nil {
+		bnd = []byte{TypeIPv4, 0x00, 0x00, 0x00, 0x00, 0x00, 0x00}
+	}
+	_, err := conn.Write(append([]byte{Version5, rep, 0x00}, bnd...))
+	return err
+}
+
+// ReadAddr reads a socks address {ATYP, DST.ADDR, DST.PORT} from r.
+func ReadAddr(r io.Reader) (addr []byte, err error) {
+	buf := make([]byte, 1+1+255+2)
+	// read ATYP from client
+	if _, err = io.ReadFull(r, buf[:1]); err != nil {
+		return
+	}
+	var reqStart, reqEnd int
+	switch buf[0] {
+	case TypeIPv4:
+		reqStart, reqEnd = 1, 1+net.IPv4len+2 // 2 ports
+	case TypeIPv6:
+		reqStart, reqEnd = 1, 1+net.IPv6len+2
+	case TypeDomain:
+		if _, err = io.ReadFull(r, buf[1:2]); err != nil {
+			return
+		}
+		reqStart, reqEnd = 2, 2+int(buf[1])+2
+	default:
+		err = ErrAddrTypeNotSupported
+		return
+	}
+	if _, err = io.ReadFull(r, buf[reqStart:reqEnd]); err != nil {
+		return
+	}
+	return buf[:reqEnd], nil
+}
+
+// AddrLen returns the length of the socks address at the start of b, or -1
+// if b doesn't start with a complete one.
+func AddrLen(b []byte) int {
+	l := -1
+	if len(b) < 2 {
+		return -1
+	}
+	switch b[0] {
+	case TypeIPv4:
+		l = 1 + net.IPv4len + 2
+	case TypeIPv6:
+		l = 1 + net.IPv6len + 2
+	case TypeDomain:
+		l = 1 + 1 + int(b[1]) + 2
+	}
+	if l > len(b) {
+		return -1
+	}
+	return l
+}
+
+// AddrString formats a socks address as host:port.
+func AddrString(addr []byte) string {
+	var host string
+	l := len(addr)
+	switch addr[0] {
+	case TypeIPv4, TypeIPv6:
+		host = net.IP(addr[1 : l-2]).String()
+	case TypeDomain:
+		host = string(addr[2 : l-2])
+	}
+	port := binary.BigEndian.Uint16(addr[l-2 : l])
+	return net.JoinHostPort(host, strconv.Itoa(int(port)))
+}
@@ -0,0 +1,101 @@
+package tunnel
+
+import (
+	"fmt"
+	"net"
+	"strings"
+	"sync/atomic"
+)
+
+// acl holds the client ips every listener accepts, checked before anything
+// is read from them: none of deny and, unless allow is empty, one of allow.
+type acl struct {
+	allow, deny []*net.IPNet
+}
+
+var activeACL atomic.Pointer[acl]
+
+// newACL parses the comma separated cidrs or ips of allow and deny, it
+// returns nil when both are empty.
+func newACL(allow, deny string) (*acl, error) {
+	a := &acl{}
+	var err error
+	if a.allow, err = parseNets(allow); err != nil {
+		return nil, fmt.Errorf("allow error: %v", err)
+	}
+	if a.deny, err = parseNets(deny); err != nil {
+		return nil, fmt.Errorf("deny error: %v", err)
+	}
+	if a.allow == nil && a.deny == nil {
+		return nil, nil
+	}
+	return a, nil
+}
+
+func parseNets(list string) ([]*net.IPNet, error) {
+	var nets []*net.IPNet
+	for _, s := range strings.Split(list, ",") {
+		if s = strings.TrimSpace(s); s == "" {
+			continue
+		}
+		if !strings.Contains(s, "/") {
+			ip := net.ParseIP(s)
+			if ip == nil {
+				return nil, fmt.Errorf("invalid ip %q", s)
+			}
+			bits := 8 * net.IPv6len
+			if ip.To4() != nil {
+				ip, bits = ip.To4(), 8*net.IPv4len
+			}
+			nets = append(nets, &net.IPNet{IP: ip, Mask: net.CIDRMask(bits, bits)})
+			continue
+		}
+		_, ipnet, err := net.ParseCIDR(s)
+		if err != nil {
+			return nil, err
+		}
+		nets = append(nets, ipnet)
+	}
+	return nets, nil
+}
+
+// permits reports whether a, which may be nil, accepts the client at addr.
+// Clients without an ip, like those of unix sockets, are accepted.
+func (a *acl) permits(addr net.Addr) bool {
+	if a == nil {
+		return true
+	}
+	ip := net.ParseIP(hostOf(addr.String()))
+	if ip == nil {
+		return true
+	}
+	for _, n := range a.deny {
+		if n.Contains(ip) {
+			return false
+		}
+	}
+	if a.allow == nil {
+		return true
+	}
+	for _, n := range a.allow {
+		if n.Contains(ip) {
+			return true
+		}
+	}
+	return false
+}
+
+// aclPacketConn drops the packets of the sources the acl doesn't permit, for
+// the udp listeners, which have no accept to check at.
+type aclPacketConn struct {
+	net.PacketConn
+}
+
+func (c aclPacketConn) ReadFrom(b []byte) (int, net.Addr, error) {
+	for {
+		n, addr, err := c.PacketConn.ReadFrom(b)
+		if err != nil || activeACL.Load().permits(addr) {
+			return n, addr, err
+		}
+	}
+}
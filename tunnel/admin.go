@@ -0,0 +1,171 @@
+package tunnel
+
+import (
+	"crypto/subtle"
+	"encoding/json"
+	"log/slog"
+	"net/http"
+	"strconv"
+	"strings"
+	"sync/atomic"
+	"time"
+)
+
+// adminReloads takes the reloads asked for by the admin api to the loop of
+// RunContext, which answers with the result.
+var adminReloads = make(chan chan error)
+
+// secretKeys are the config entries the admin api doesn't show, the urls
+// too as they may carry credentials or tokens.
+var secretKeys = []string{"password", "uri", "auth", "hop_secret", "admin_token",
+	"outbound", "subscribe", "obfs4_bridge", "plugin_opts"}
+
+type adminSession struct {
+	ID     uint64  `json:"id"`
+	Client string  `json:"client"`
+	Target string  `json:"target"`
+	Age    float64 `json:"age"` // seconds
+	Up     int64   `json:"up"`
+	Down   int64   `json:"down"`
+}
+
+type adminLimits struct {
+	Up   int `json:"up"`
+	Down int `json:"down"`
+}
+
+// serveAdmin serves the admin api at addr:
+//
+//	GET    /sessions       the active sessions
+//	DELETE /sessions/{id}  closes a session
+//	GET    /config         the config, without the secrets
+//	POST   /reload         reloads like SIGHUP
+//	GET    /limits         the total rate limits, in KiB/s
+//	PUT    /limits         changes them, 0 for unlimited
+func serveAdmin(addr, token string) {
+	ln, err := listenTCP(addr)
+	if err != nil {
+		slog.Error("admin server error", "err", err)
+		return
+	}
+	mux := http.NewServeMux()
+	mux.HandleFunc("/sessions", func(w http.ResponseWriter, r *http.Request) {
+		if !allowMethod(w, r, http.MethodGet) {
+			return
+		}
+		list := []adminSession{}
+		for _, s := range sessions.list() {
+			list = append(list, adminSession{
+				ID:     s.id,
+				Client: s.client,
+				Target: s.target,
+				Age:    time.Since(s.start).Seconds(),
+				Up:     atomic.LoadInt64(&s.up),
+				Down:   atomic.LoadInt64(&s.down),
+			})
+		}
+		writeJSON(w, http.StatusOK, list)
+	})
+	mux.HandleFunc("/sessions/", func(w http.ResponseWriter, r *http.Request) {
+		if !allowMethod(w, r, http.MethodDelete) {
+			return
+		}
+		id, err := strconv.ParseUint(strings.TrimPrefix(r.URL.Path, "/sessions/"), 10, 64)
+		if err != nil || !sessions.kill(id) {
+			writeJSON(w, http.StatusNotFound, map[string]string{"error": "no such session"})
+			return
+		}
+		w.WriteHeader(http.StatusNoContent)
+	})
+	mux.HandleFunc("/config", func(w http.ResponseWriter, r *http.Request) {
+		if !allowMethod(w, r, http.MethodGet) {
+			return
+		}
+		b, _ := json.Marshal(config)
+		var m map[string]any
+		json.Unmarshal(b, &m)
+		for _, k := range secretKeys {
+			if v, ok := m[k].(string); ok && v != "" {
+				m[k] = "******"
+			}
+		}
+		for _, list := range []string{"port_password", "users"} {
+			if keys, ok := m[list].(map[string]any); ok {
+				for _, v := range keys {
+					if pk, ok := v.(map[string]any); ok {
+						pk["password"] = "******"
+					}
+				}
+			}
+		}
+		writeJSON(w, http.StatusOK, m)
+	})
+	mux.HandleFunc("/reload", func(w http.ResponseWriter, r *http.Request) {
+		if !allowMethod(w, r, http.MethodPost) {
+			return
+		}
+		done := make(chan error, 1)
+		select {
+		case adminReloads <- done:
+		case <-r.Context().Done():
+			return
+		}
+		if err := <-done; err != nil {
+			writeJSON(w, http.StatusInternalServerError, map[string]string{"error": err.Error()})
+			return
+		}
+		w.WriteHeader(http.StatusNoContent)
+	})
+	mux.HandleFunc("/limits", func(w http.ResponseWriter, r *http.Request) {
+		switch r.Method {
+		case http.MethodGet:
+		case http.MethodPut:
+			// a missing direction keeps its limit
+			l := adminLimits{Up: upLimiter.Rate() / 1024, Down: downLimiter.Rate() / 1024}
+			if err := json.NewDecoder(r.Body).Decode(&l); err != nil || l.Up < 0 || l.Down < 0 {
+				writeJSON(w, http.StatusBadRequest, map[string]string{"error": "expect {\"up\": KiB/s, \"down\": KiB/s}"})
+				return
+			}
+			upLimiter.SetRate(l.Up * 1024)
+			downLimiter.SetRate(l.Down * 1024)
+			slog.Info("changed rate limits", "up", l.Up, "down", l.Down)
+		default:
+			allowMethod(w, r, http.MethodGet+", "+http.MethodPut)
+			return
+		}
+		writeJSON(w, http.StatusOK, adminLimits{Up: upLimiter.Rate() / 1024, Down: downLimiter.Rate() / 1024})
+	})
+
+	var h http.Handler = mux
+	if token != "" {
+		h = http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+			got := []byte(r.Header.Get("Authorization"))
+			if subtle.ConstantTimeCompare(got, []byte("Bearer "+token)) != 1 {
+				writeJSON(w, http.StatusUnauthorized, map[string]string{"error": "unauthorized"})
+				return
+			}
+			mux.ServeHTTP(w, r)
+		})
+	}
+	slog.Info("serving admin api", "url", "http://"+addr+"/")
+	go func() {
+		if err := http.Serve(ln, h); err != nil {
+			slog.Error("admin server error", "err", err)
+		}
+	}()
+}
+
+func allowMethod(w http.ResponseWriter, r *http.Request, method string) bool {
+	if r.Method == method {
+		return true
+	}
+	w.Header().Set("Allow", method)
+	writeJSON(w, http.StatusMethodNotAllowed, map[string]string{"error": "method not allowed"})
+	return false
+}
+
+func writeJSON(w http.ResponseWriter, code int, v any) {
+	w.Header().Set("Content-Type", "application/json")
+	w.WriteHeader(code)
+	json.NewEncoder(w).Encode(v)
+}
@@ -0,0 +1,108 @@
+package tunnel
+
+import (
+	"log/slog"
+	"net"
+
+	"github.com/daogan/socksproxy/socks5"
+)
+
+// A bind request is sent to the server through a tunnel connection to the
+// magic target bindHost, followed by the DST.ADDR of the request. The server
+// replies with the socks address it listens at, then with the address of the
+// peer once it connects, after which the tunnel relays the peer connection.
+const bindHost = "sp.bind.arpa:0"
+
+func handleBind(conn net.Conn, dstAddr []byte) {
+	tgtAddr, _ := socks5.EncodeAddr(bindHost)
+	remote, server, err := dialTunnel(tgtAddr)
+	if err != nil {
+		slog.Warn("fail to dial server", "server", server, "err", err)
+		socks5.WriteReply(conn, replyCode(err), nil)
+		return
+	}
+	defer remote.Close()
+	if _, err = remote.Write(dstAddr); err != nil {
+		socks5.WriteReply(conn, socks5.RepGeneralFailure, nil)
+		return
+	}
+	// first reply: the address the server listens at
+	bnd, err := socks5.ReadAddr(remote)
+	if err != nil {
+		slog.Warn("fail to bind on server", "err", err)
+		socks5.WriteReply(conn, socks5.RepGeneralFailure, nil)
+		return
+	}
+	if err = socks5.WriteReply(conn, socks5.RepSucceeded, bnd); err != nil {
+		return
+	}
+	// second reply: the address of the connecting peer
+	peer, err := socks5.ReadAddr(remote)
+	if err != nil {
+		slog.Warn("fail to accept bind connection", "err", err)
+		socks5.WriteReply(conn, socks5.RepGeneralFailure, nil)
+		return
+	}
+	if err = socks5.WriteReply(conn, socks5.RepSucceeded, peer); err != nil {
+		return
+	}
+	slog.Debug("bind", "client", conn.RemoteAddr().String(), "server", server, "peer", socks5.AddrString(peer))
+	relay(conn, remote, socks5.AddrString(peer))
+}
+
+func handleBindServer(conn net.Conn) {
+	dstAddr, err := socks5.ReadAddr(conn)
+	if err != nil {
+		return
+	}
+	// listen on -bind-address, or the address the client reached us at, so
+	// BND.ADDR is usable
+	host := config.BindAddr
+	if host == "" {
+		if host, _, err = net.SplitHostPort(conn.LocalAddr().String()); err != nil {
+			return
+		}
+	}
+	ln, err := net.Listen("tcp", net.JoinHostPort(host, "0"))
+	if err != nil {
+		slog.Warn("fail to listen for bind", "err", err)
+		return
+	}
+	defer ln.Close()
+	bnd, err := socks5.EncodeAddr(ln.Addr().String())
+	if err != nil {
+		return
+	}
+	if _, err = conn.Write(bnd); err != nil {
+		return
+	}
+	slog.Debug("bind", "client", conn.RemoteAddr().String(), "addr", ln.Addr().String())
+
+	// only accept the peer named in the request, unless it is 0.0.0.0
+	dstHost, _, _ := net.SplitHostPort(socks5.AddrString(dstAddr))
+	if ip := net.ParseIP(dstHost); ip != nil && ip.IsUnspecified() {
+		dstHost = ""
+	}
+	ln.(*net.TCPListener).SetDeadline(idleDeadline())
+	var peer net.Conn
+	for {
+		if peer, err = ln.Accept(); err != nil {
+			slog.Warn("fail to accept bind connection", "err", err)
+			return
+		}
+		peerHost, _, _ := net.SplitHostPort(peer.RemoteAddr().String())
+		if dstHost == "" || dstAddr[0] == socks5.TypeDomain || peerHost == dstHost {
+			break
+		}
+		peer.Close()
+	}
+	defer peer.Close()
+	peerAddr, err := socks5.EncodeAddr(peer.RemoteAddr().String())
+	if err != nil {
+		return
+	}
+	if _, err = conn.Write(peerAddr); err != nil {
+		return
+	}
+	relay(conn, peer, peer.RemoteAddr().String())
+}
@@ -0,0 +1,266 @@
+package tunnel
+
+import (
+	"bytes"
+	"encoding/json"
+	"errors"
+	"flag"
+	"fmt"
+	"net"
+	"os"
+	"sort"
+	"strings"
+	"sync/atomic"
+
+	"github.com/daogan/socksproxy/cipher"
+)
+
+// loadConfig reads the json config file at path into c. Fields missing from
+// the file keep their values, unknown fields are an error.
+func loadConfig(path string, c *Config) error {
+	data, err := os.ReadFile(path)
+	if err != nil {
+		return err
+	}
+	dec := json.NewDecoder(bytes.NewReader(data))
+	dec.DisallowUnknownFields()
+	if err = dec.Decode(c); err != nil {
+		var syntaxErr *json.SyntaxError
+		var typeErr *json.UnmarshalTypeError
+		switch {
+		case errors.As(err, &syntaxErr):
+			return fmt.Errorf("%s:%d: %v", path, lineOf(data, syntaxErr.Offset), err)
+		case errors.As(err, &typeErr):
+			return fmt.Errorf("%s:%d: %s should be %v", path, lineOf(data, typeErr.Offset), typeErr.Field, typeErr.Type)
+		}
+		return fmt.Errorf("%s: %v", path, err)
+	}
+	return nil
+}
+
+func lineOf(data []byte, offset int64) int {
+	if offset > int64(len(data)) {
+		offset = int64(len(data))
+	}
+	return 1 + bytes.Count(data[:offset], []byte("\n"))
+}
+
+// envFlags are the environment variables read as config, and the flag each
+// one stands for.
+var envFlags = map[string]string{
+	"SOCKSPROXY_LOCAL":    "l",
+	"SOCKSPROXY_SERVER":   "s",
+	"SOCKSPROXY_METHOD":   "m",
+	"SOCKSPROXY_PASSWORD": "p",
+}
+
+// fixedFlags are the flags set on the command line or by the environment,
+// with their values. The config file can't change them, on reload either.
+var fixedFlags = make(map[string]string)
+
+// readConfig fills c from its sources, from lowest to highest precedence:
+// flag defaults, the config file at path if any, environment variables and
+// flags given on the command line, the flags of c in fs.
+func readConfig(fs *flag.FlagSet, c *Config, path string) error {
+	for env, name := range envFlags {
+		if value, ok := os.LookupEnv(env); ok {
+			fixedFlags[name] = value
+		}
+	}
+	fs.Visit(func(f *flag.Flag) {
+		fixedFlags[f.Name] = f.Value.String()
+	})
+	if path != "" {
+		if err := loadConfig(path, c); err != nil {
+			return err
+		}
+	}
+	for name, value := range fixedFlags {
+		if err := fs.Set(name, value); err != nil {
+			return fmt.Errorf("-%s: %v", name, err)
+		}
+	}
+	return nil
+}
+
+// applyURI sets the server, method and password of c from c.URI, except the
+// ones given with -s, -m and -p.
+func applyURI(c *Config) error {
+	if c.URI == "" {
+		return nil
+	}
+	server, method, password, err := parseURI(c.URI)
+	if err != nil {
+		return err
+	}
+	if _, ok := fixedFlags["s"]; !ok {
+		c.ServerAddr = server
+	}
+	if _, ok := fixedFlags["m"]; !ok {
+		c.Method = method
+	}
+	if _, ok := fixedFlags["p"]; !ok {
+		c.Password = password
+	}
+	return nil
+}
+
+// keys are the credentials new connections are checked against. A reload
+// swaps them as a whole, running connections keep the ones they started with.
+type keys struct {
+	server   string
+	method   string
+	password string
+	auth     string
+
+	// the targets the server dials, parsed by check
+	allowPorts, blockPorts string
+	allowPrivate           bool
+	egress                 *egress
+
+	// the users of the server on one port, ordered by name
+	users      []string
+	userKeys   []PortKey
+	passwords  []string
+	userEgress []*egress
+}
+
+var activeKeys atomic.Pointer[keys]
+
+func newKeys(c *Config) *keys {
+	k := &keys{method: c.Method, password: c.Password, auth: c.Auth,
+		allowPorts: c.AllowPorts, blockPorts: c.BlockPorts, allowPrivate: c.AllowPrivate}
+	for name := range c.Users {
+		k.users = append(k.users, name)
+	}
+	sort.Strings(k.users)
+	for _, name := range k.users {
+		k.userKeys = append(k.userKeys, c.Users[name])
+		k.passwords = append(k.passwords, c.Users[name].Password)
+	}
+	return k
+}
+
+// user returns the index in k.users of the user conn was opened by, or -1.
+func (k *keys) user(conn net.Conn) int {
+	if p, ok := conn.(*paddingConn); ok {
+		conn = p.Conn
+	}
+	u, ok := conn.(interface{ User() int })
+	if !ok {
+		return -1
+	}
+	if i := u.User(); i < len(k.users) {
+		return i
+	}
+	return -1
+}
+
+// egressOf returns the policy of the target ports of the user i of k.users,
+// or of the server for -1.
+func (k *keys) egressOf(i int) *egress {
+	if i >= 0 && i < len(k.userEgress) {
+		return k.userEgress[i]
+	}
+	return k.egress
+}
+
+func (k *keys) check() error {
+	if _, err := cipher.Lookup(k.method); err != nil {
+		return err
+	}
+	if cipher.IsSS2022(k.method) {
+		if _, err := cipher.SS2022Key(k.method, k.password); err != nil {
+			return fmt.Errorf("password error: %v", err)
+		}
+	}
+	if len(k.users) > 0 {
+		// stream ciphers don't authenticate, the users can't be told apart
+		if cipher.IsSS2022(k.method) && !cipher.SS2022Identity(k.method) || !cipher.IsSS2022(k.method) && !cipher.IsAEAD(k.method) {
+			return fmt.Errorf("users error: %s can't tell users apart", k.method)
+		}
+		for i, p := range k.passwords {
+			if _, err := cipher.SS2022Key(k.method, p); cipher.IsSS2022(k.method) && err != nil {
+				return fmt.Errorf("users error: %s: %v", k.users[i], err)
+			}
+		}
+	}
+	var err error
+	if k.egress, err = parseEgress(k.allowPorts, k.blockPorts, !k.allowPrivate); err != nil {
+		return err
+	}
+	k.userEgress = nil
+	for i, uk := range k.userKeys {
+		if uk.Method != "" && uk.Method != k.method {
+			return fmt.Errorf("users error: %s: the users share the method of the server", k.users[i])
+		}
+		allow, block := uk.ports(k.allowPorts, k.blockPorts)
+		e, err := parseEgress(allow, block, !k.allowPrivate)
+		if err != nil {
+			return fmt.Errorf("users error: %s: %v", k.users[i], err)
+		}
+		k.userEgress = append(k.userEgress, e)
+	}
+	if k.auth != "" && !strings.Contains(k.auth, ":") {
+		return errors.New("auth error: expect user:pass")
+	}
+	return nil
+}
+
+// reloadConfig re-reads the config file on SIGHUP. Only the method, the
+// password, auth, the users, the target ports and allow and deny are
+// reloaded, other changes need a restart. Flags given on the command line or
+// by the environment still override the file.
+func reloadConfig(path string) error {
+	c := config
+	if err := loadConfig(path, &c); err != nil {
+		return err
+	}
+	if err := applyURI(&c); err != nil {
+		return err
+	}
+	k := newKeys(&c)
+	cur := activeKeys.Load()
+	if _, ok := fixedFlags["m"]; ok {
+		k.method = cur.method
+	}
+	if _, ok := fixedFlags["p"]; ok {
+		k.password = cur.password
+	}
+	if _, ok := fixedFlags["auth"]; ok {
+		k.auth = cur.auth
+	}
+	if _, ok := fixedFlags["allow-ports"]; ok {
+		k.allowPorts = cur.allowPorts
+	}
+	if _, ok := fixedFlags["block-ports"]; ok {
+		k.blockPorts = cur.blockPorts
+	}
+	if _, ok := fixedFlags["allow-private"]; ok {
+		k.allowPrivate = cur.allowPrivate
+	}
+	if err := k.check(); err != nil {
+		return err
+	}
+	if _, ok := fixedFlags["allow"]; ok {
+		c.Allow = config.Allow
+	}
+	if _, ok := fixedFlags["deny"]; ok {
+		c.Deny = config.Deny
+	}
+	a, err := newACL(c.Allow, c.Deny)
+	if err != nil {
+		return err
+	}
+	activeKeys.Store(k)
+	activeACL.Store(a)
+	if localSide && config.Subscribe == "" {
+		// same servers, new credentials
+		var addrs []string
+		for _, s := range activePool.Load().servers {
+			addrs = append(addrs, s.server)
+		}
+		activePool.Store(newPool(addrs, k.method, k.password))
+	}
+	return nil
+}
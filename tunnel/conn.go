@@ -0,0 +1,392 @@
+package tunnel
+
+import (
+	"bufio"
+	"errors"
+	"io"
+	"log/slog"
+	"math/rand"
+	"net"
+	"sync/atomic"
+	"syscall"
+	"time"
+
+	"github.com/daogan/socksproxy/cipher"
+	"github.com/daogan/socksproxy/internal/bytepool"
+)
+
+// timeout is how long a connection may go idle, 0 for no limit.
+var timeout = 120 * time.Second
+
+// idleDeadline returns the deadline of an idle wait starting now, none when
+// timeout is 0.
+func idleDeadline() time.Time {
+	if timeout <= 0 {
+		return time.Time{}
+	}
+	return time.Now().Add(timeout)
+}
+
+// idleWatch ends a relay once neither direction made progress for timeout,
+// so a session only waiting on one side, like IMAP IDLE, stays up as long as
+// the other keeps sending.
+type idleWatch struct {
+	last  atomic.Int64 // unix nanoseconds of the last progress
+	timer *time.Timer
+}
+
+// watchIdle starts watching the relay over conns, it returns nil when
+// timeout is 0.
+func watchIdle(conns ...net.Conn) *idleWatch {
+	if timeout <= 0 {
+		return nil
+	}
+	w := &idleWatch{}
+	w.last.Store(time.Now().UnixNano())
+	w.timer = time.AfterFunc(timeout, func() {
+		idle := time.Since(time.Unix(0, w.last.Load()))
+		if idle < timeout {
+			w.timer.Reset(timeout - idle)
+			return
+		}
+		// the reads return a timeout error, ending the relay as idle
+		for _, c := range conns {
+			c.SetReadDeadline(time.Now())
+		}
+	})
+	return w
+}
+
+func (w *idleWatch) progress() {
+	if w != nil {
+		w.last.Store(time.Now().UnixNano())
+	}
+}
+
+func (w *idleWatch) stop() {
+	if w != nil {
+		w.timer.Stop()
+	}
+}
+
+// dialTimeout bounds each dial of a server or a target, 0 for none.
+var dialTimeout = 10 * time.Second
+
+// dialTCP connects to addr within dialTimeout.
+func dialTCP(addr string) (net.Conn, error) {
+	conn, err := net.DialTimeout("tcp", addr, dialTimeout)
+	if err == nil {
+		setSockOpts(conn)
+	}
+	return conn, err
+}
+
+// retryBackoff is the wait before the first retry of a failed dial, doubled
+// for each next one up to maxRetryBackoff.
+const (
+	retryBackoff    = 200 * time.Millisecond
+	maxRetryBackoff = 5 * time.Second
+)
+
+// withRetry calls dial until it succeeds, fails for good, or has been retried
+// -dial-retries times, waiting with exponential backoff and jitter in
+// between. It returns the result of the last call.
+func withRetry(dial func() (net.Conn, error)) (net.Conn, error) {
+	backoff := retryBackoff
+	for i := 0; ; i++ {
+		conn, err := dial()
+		if err == nil || i >= config.DialRetries || !transient(err) {
+			return conn, err
+		}
+		// 0.5 to 1.5 times the backoff, so clients failing together don't
+		// retry together
+		wait := backoff/2 + time.Duration(rand.Int63n(int64(backoff)))
+		slog.Debug("retrying dial", "err", err, "wait", wait)
+		time.Sleep(wait)
+		backoff = min(2*backoff, maxRetryBackoff)
+	}
+}
+
+// transient reports whether a dial failing with err may succeed if retried:
+// after a timeout or a connection lost midway, not a refused one, which
+// would most likely be refused again.
+func transient(err error) bool {
+	if errors.Is(err, errRejected) || errors.Is(err, errLoop) || errors.Is(err, errPrivate) ||
+		errors.Is(err, errEgress) || errors.Is(err, errServersDown) {
+		return false
+	}
+	var dnsErr *net.DNSError
+	if errors.As(err, &dnsErr) {
+		return dnsErr.IsTemporary || dnsErr.IsTimeout
+	}
+	var netErr net.Error
+	if errors.As(err, &netErr) && netErr.Timeout() {
+		return true
+	}
+	return errors.Is(err, syscall.ECONNRESET) || errors.Is(err, syscall.ECONNABORTED) ||
+		errors.Is(err, syscall.ETIMEDOUT) || errors.Is(err, syscall.EPIPE)
+}
+
+// setDeadline gives the current phase of conn secs seconds, or clears the
+// deadline for 0.
+func setDeadline(conn net.Conn, secs int) {
+	if secs <= 0 {
+		conn.SetDeadline(time.Time{})
+		return
+	}
+	conn.SetDeadline(time.Now().Add(time.Duration(secs) * time.Second))
+}
+
+const bufSize = bytepool.BufSize
+
+var bytePool = bytepool.Default
+
+// replayCache remembers the IVs seen by the server, nil when -replay-window
+// is 0.
+var replayCache *cipher.IVCache
+
+// newTunnelConn wraps c in the tunnel protocol of k.method. The first Write
+// on the local side carries the target address, which is also the first thing
+// Read returns on the server side.
+func newTunnelConn(c net.Conn, k *keys, client bool) (net.Conn, error) {
+	conn, err := newCipherConn(c, k, client)
+	if err != nil || padding == nil {
+		return conn, err
+	}
+	return newPaddingConn(conn, padding), nil
+}
+
+func newCipherConn(c net.Conn, k *keys, client bool) (net.Conn, error) {
+	// only the server checks for replayed sessions
+	var ivs *cipher.IVCache
+	if !client {
+		ivs = replayCache
+	}
+	switch {
+	case k.method == cipher.MethodNone:
+		return c, nil
+	case cipher.IsSS2022(k.method) && !client && len(k.users) > 0:
+		return cipher.NewSS2022ServerConn(c, k.method, k.password, k.passwords, ivs)
+	case cipher.IsSS2022(k.method):
+		return cipher.NewSS2022Conn(c, k.method, k.password, client, ivs)
+	case cipher.IsAEAD(k.method) && !client && len(k.users) > 0:
+		// the password is the one of a user without name
+		passwords := k.passwords
+		if k.password != "" {
+			passwords = append(passwords[:len(passwords):len(passwords)], k.password)
+		}
+		return cipher.NewAEADServerConn(c, k.method, passwords, config.Compat, ivs)
+	case cipher.IsAEAD(k.method):
+		return cipher.NewAEADConn(c, k.method, k.password, config.Compat, ivs)
+	}
+	stream, err := cipher.NewCipher(k.method, k.password, config.Compat, config.StreamSubkeys)
+	if err != nil {
+		return nil, err
+	}
+	return cipher.NewConn(c, stream, ivs), nil
+}
+
+// dialTunnel connects to the server and sends it tgtAddr, it returns the
+// tunnel and the address of the server. With -mux the tunnel is a stream of a
+// mux session, with -reverse-listen a stream of a reverse session.
+func dialTunnel(tgtAddr []byte) (net.Conn, string, error) {
+	if config.ReverseListen != "" {
+		return reverseSessions.dial(tgtAddr)
+	}
+	if config.Mux > 0 {
+		return muxSessions.dial(tgtAddr)
+	}
+	return dialServer(tgtAddr)
+}
+
+// dialServer opens a new tunnel connection to a server of the pool.
+func dialServer(tgtAddr []byte) (net.Conn, string, error) {
+	k := activePool.Load().pick(tgtAddr)
+	if k == nil {
+		return nil, "", errServersDown
+	}
+	remote, err := transport.Dial(k.server)
+	if err != nil {
+		serverHealth.failure(k.server)
+		return nil, k.server, err
+	}
+	conn, err := newTunnelConn(remote, k, true)
+	if err != nil {
+		remote.Close()
+		return nil, k.server, err
+	}
+	// write {ATYP, BND.ADDR, BND.PORT} to server
+	if _, err = conn.Write(tgtAddr); err == nil && config.FastOpen {
+		err = fastOpenConnected(remote)
+	}
+	if err != nil {
+		serverHealth.failure(k.server)
+		conn.Close()
+		return nil, k.server, err
+	}
+	serverHealth.success(k.server)
+	return conn, k.server, nil
+}
+
+// prefixConn replays bytes already consumed from the underlying conn.
+type prefixConn struct {
+	net.Conn
+	r io.Reader
+}
+
+func (c *prefixConn) Read(b []byte) (int, error) {
+	return c.r.Read(b)
+}
+
+func (c *prefixConn) CloseWrite() error { return closeWrite(c.Conn) }
+func (c *prefixConn) CloseRead() error  { return closeRead(c.Conn) }
+
+// closeWrite and closeRead half-close conn, or return errors.ErrUnsupported
+// if it can't, like the streams of a mux session.
+func closeWrite(conn net.Conn) error {
+	if c, ok := conn.(interface{ CloseWrite() error }); ok {
+		return c.CloseWrite()
+	}
+	return errors.ErrUnsupported
+}
+
+func closeRead(conn net.Conn) error {
+	if c, ok := conn.(interface{ CloseRead() error }); ok {
+		return c.CloseRead()
+	}
+	return errors.ErrUnsupported
+}
+
+// halfClose passes on the end of the transfer from src to dst, which ended
+// with err: a clean one as a half-close of dst, so the peer may still answer,
+// else or if dst can't half-close by closing both to end the other direction
+// too.
+func halfClose(dst, src net.Conn, err error) {
+	if err == nil && closeWrite(dst) == nil {
+		closeRead(src)
+		return
+	}
+	dst.Close()
+	src.Close()
+}
+
+// transfer copies src to dst, counting the bytes written and reporting the
+// progress to idle. It returns nil when src is done, or the error that ended
+// it. A tunnel conn as src writes what it opens straight to dst, with its
+// WriteTo, and two tcp conns are spliced on linux.
+func transfer(dst, src net.Conn, count *int64, idle *idleWatch, lims ...*Limiter) error {
+	m := &meter{w: dst, count: count, idle: idle, lims: lims}
+	if td, _ := plainTCP(dst, nil); td != nil {
+		ts, err := plainTCP(src, m)
+		if err != nil {
+			return err
+		}
+		if ts != nil {
+			if handled, err := splice(td, ts, m); handled {
+				return err
+			}
+		}
+	}
+	var r io.Reader = src
+	if _, ok := src.(*net.TCPConn); ok {
+		// its WriteTo would copy through a buffer of its own, not the pool
+		r = struct{ io.Reader }{src}
+	}
+	var w io.Writer = m
+	if _, ok := dst.(io.ReaderFrom); ok && !isTCP(dst) {
+		// a tunnel conn as dst seals what it reads in its own buffer
+		w = meterFrom{m}
+	}
+	buf := bytePool.Get()
+	defer bytePool.Put(buf)
+	_, err := io.CopyBuffer(w, r, buf)
+	return err
+}
+
+// isTCP reports whether c is a tcp conn, whose ReadFrom would copy through a
+// buffer of its own when it can't splice.
+func isTCP(c net.Conn) bool {
+	_, ok := c.(*net.TCPConn)
+	return ok
+}
+
+// plainTCP returns the tcp conn under c, past the conns only replaying what
+// was read of it first, or nil. With m, what they buffered is written to m,
+// so nothing is lost reading the tcp conn instead.
+func plainTCP(c net.Conn, m *meter) (*net.TCPConn, error) {
+	switch c := c.(type) {
+	case *net.TCPConn:
+		return c, nil
+	case *recordConn:
+		if c.stopped {
+			return plainTCP(c.Conn, m)
+		}
+	case *prefixConn:
+		br, ok := c.r.(*bufio.Reader)
+		if !ok {
+			return nil, nil
+		}
+		if m != nil && br.Buffered() > 0 {
+			b, _ := br.Peek(br.Buffered())
+			if _, err := m.Write(b); err != nil {
+				return nil, err
+			}
+			br.Discard(len(b))
+		}
+		return plainTCP(c.Conn, m)
+	}
+	return nil, nil
+}
+
+// meter counts, rate limits and reports as progress the bytes written to w.
+type meter struct {
+	w     io.Writer
+	count *int64
+	idle  *idleWatch
+	lims  []*Limiter
+}
+
+func (m *meter) Write(b []byte) (int, error) {
+	m.wait(len(b))
+	n, err := m.w.Write(b)
+	m.done(n)
+	return n, err
+}
+
+// meterFrom is a meter passing the reader to the ReadFrom of its writer,
+// metering each read instead of each write.
+type meterFrom struct{ *meter }
+
+func (m meterFrom) ReadFrom(r io.Reader) (int64, error) {
+	return m.w.(io.ReaderFrom).ReadFrom(meterReader{r: r, m: m.meter})
+}
+
+// meterReader is the reader of a meterFrom. The bytes are counted once read,
+// a chunk the writer then fails to write is counted too.
+type meterReader struct {
+	r io.Reader
+	m *meter
+}
+
+func (mr meterReader) Read(b []byte) (int, error) {
+	n, err := mr.r.Read(b)
+	if n > 0 {
+		mr.m.wait(n)
+		mr.m.done(n)
+	}
+	return n, err
+}
+
+// wait reports n bytes read and waits for the limiters to let them through.
+func (m *meter) wait(n int) {
+	m.idle.progress()
+	for _, lim := range m.lims {
+		lim.Wait(n)
+	}
+}
+
+// done counts n bytes written.
+func (m *meter) done(n int) {
+	atomic.AddInt64(m.count, int64(n))
+	m.idle.progress()
+}
@@ -0,0 +1,113 @@
+package tunnel
+
+import (
+	"bufio"
+	"fmt"
+	"io"
+	"log/slog"
+	"net"
+	"os"
+	"strconv"
+	"strings"
+	"sync/atomic"
+	"time"
+)
+
+// DefaultCtlSocket is the usual path of the control socket.
+const DefaultCtlSocket = "/tmp/socksproxy.sock"
+
+// The control socket takes one command line per connection and writes the
+// response back before closing it.
+func serveCtl(path string) {
+	os.Remove(path)
+	ln, err := net.Listen("unix", path)
+	if err != nil {
+		slog.Error("control socket error", "err", err)
+		return
+	}
+	slog.Info("control socket", "path", path)
+	for {
+		conn, err := ln.Accept()
+		if err != nil {
+			slog.Warn("accept error", "err", err)
+			continue
+		}
+		go handleCtl(conn)
+	}
+}
+
+func handleCtl(conn net.Conn) {
+	defer conn.Close()
+	line, err := bufio.NewReader(conn).ReadString('\n')
+	if err != nil && line == "" {
+		return
+	}
+	ctlCommand(conn, strings.Fields(line))
+}
+
+func ctlCommand(w io.Writer, args []string) {
+	if len(args) == 0 {
+		return
+	}
+	switch args[0] {
+	case "list-conns":
+		fmt.Fprintf(w, "%-6s %-22s %-30s %-10s %-12s %s\n", "ID", "CLIENT", "TARGET", "AGE", "UP", "DOWN")
+		for _, s := range sessions.list() {
+			fmt.Fprintf(w, "%-6d %-22s %-30s %-10s %-12d %d\n", s.id, s.client, s.target,
+				time.Since(s.start).Truncate(time.Second), atomic.LoadInt64(&s.up), atomic.LoadInt64(&s.down))
+		}
+	case "kill":
+		if len(args) != 2 {
+			fmt.Fprintln(w, "usage: kill <id>")
+			return
+		}
+		id, err := strconv.ParseUint(args[1], 10, 64)
+		if err != nil || !sessions.kill(id) {
+			fmt.Fprintf(w, "no such connection: %s\n", args[1])
+			return
+		}
+		fmt.Fprintf(w, "killed %d\n", id)
+	case "stats":
+		active, total, up, down := sessions.stats()
+		fmt.Fprintf(w, "active: %d\ntotal: %d\nup: %d\ndown: %d\nreplays: %d\n",
+			active, total, up, down, replayCache.Rejected())
+		ports, bytes := portBytes()
+		for i, port := range ports {
+			fmt.Fprintf(w, "port %d: %d\n", port, bytes[i])
+		}
+	case "uri":
+		if p := activePool.Load(); p != nil {
+			for _, k := range p.servers {
+				fmt.Fprintln(w, formatURI(k.server, k.method, k.password))
+			}
+			return
+		}
+		k := activeKeys.Load()
+		fmt.Fprintln(w, formatURI(firstAddr(config.ServerAddr), k.method, k.password))
+	case "reload-rules":
+		if config.Rules == "" {
+			fmt.Fprintln(w, "no rules file given with -rules")
+			return
+		}
+		if err := loadRules(config.Rules); err != nil {
+			fmt.Fprintf(w, "reload error: %v\n", err)
+			return
+		}
+		slog.Info("reloaded", "path", config.Rules)
+		fmt.Fprintf(w, "reloaded %s\n", config.Rules)
+	case "set-loglevel":
+		if len(args) != 2 {
+			fmt.Fprintln(w, "usage: set-loglevel debug|info|warn|error")
+			return
+		}
+		if err := setLogLevel(args[1]); err != nil {
+			fmt.Fprintln(w, err)
+			return
+		}
+		fmt.Fprintf(w, "log level %s\n", logLevel.Level())
+	case "help":
+		fmt.Fprintln(w, "commands: list-conns, kill <id>, stats, uri, reload-rules, set-loglevel <level>, help")
+	default:
+		fmt.Fprintf(w, "unknown command: %s, try help\n", args[0])
+	}
+}
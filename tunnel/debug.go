@@ -0,0 +1,140 @@
+package tunnel
+
+import (
+	"fmt"
+	"html"
+	"log/slog"
+	"net/http"
+	"runtime"
+	"runtime/pprof"
+	rtrace "runtime/trace"
+	"sort"
+	"strconv"
+	"strings"
+	"time"
+)
+
+// The debug server doesn't use net/http/pprof and expvar, whose init
+// registers their handlers on http.DefaultServeMux of every program
+// importing the package. Its handlers answer like theirs, so go tool pprof
+// and expvar readers work against it.
+
+// debugVars returns the variables of /debug/vars, named like expvar's. The
+// command line isn't among them, nor at /debug/pprof/cmdline, as it may
+// carry the password and tokens.
+func debugVars() map[string]any {
+	var mem runtime.MemStats
+	runtime.ReadMemStats(&mem)
+	active, total, up, down := sessions.stats()
+	return map[string]any{
+		"memstats":            mem,
+		"socksproxy.bytepool": map[string]any{"allocs": bytePool.Allocs()},
+		"socksproxy.sessions": map[string]any{"active": active, "total": total, "up": up, "down": down},
+		"socksproxy.errors": map[string]any{
+			"handshake": handshakeFailures.Load(),
+			"dial":      dialErrors.Load(),
+			"cipher":    cipherErrors.Load(),
+		},
+	}
+}
+
+// serveDebug serves pprof at /debug/pprof/ and the expvar like variables at
+// /debug/vars, at a loopback address or unix socket.
+func serveDebug(addr string) {
+	ln, err := listenTCP(addr)
+	if err != nil {
+		slog.Error("debug server error", "err", err)
+		return
+	}
+	mux := http.NewServeMux()
+	mux.HandleFunc("/debug/pprof/", pprofIndex)
+	mux.HandleFunc("/debug/pprof/profile", pprofCPU)
+	mux.HandleFunc("/debug/pprof/trace", pprofTrace)
+	mux.HandleFunc("/debug/vars", func(w http.ResponseWriter, r *http.Request) {
+		writeJSON(w, http.StatusOK, debugVars())
+	})
+	slog.Info("serving debug", "url", "http://"+addr+"/debug/pprof/")
+	go func() {
+		if err := http.Serve(ln, mux); err != nil {
+			slog.Error("debug server error", "err", err)
+		}
+	}()
+}
+
+// pprofIndex lists the profiles, or writes /debug/pprof/{name}, in text with
+// ?debug=1.
+func pprofIndex(w http.ResponseWriter, r *http.Request) {
+	if name := strings.TrimPrefix(r.URL.Path, "/debug/pprof/"); name != "" {
+		p := pprof.Lookup(name)
+		if p == nil {
+			http.Error(w, "unknown profile", http.StatusNotFound)
+			return
+		}
+		debug, _ := strconv.Atoi(r.FormValue("debug"))
+		if debug > 0 {
+			w.Header().Set("Content-Type", "text/plain; charset=utf-8")
+		} else {
+			w.Header().Set("Content-Type", "application/octet-stream")
+			w.Header().Set("Content-Disposition", fmt.Sprintf("attachment; filename=%q", name))
+		}
+		if name == "heap" && r.FormValue("gc") != "" {
+			runtime.GC()
+		}
+		p.WriteTo(w, debug)
+		return
+	}
+	profiles := pprof.Profiles()
+	sort.Slice(profiles, func(i, j int) bool { return profiles[i].Name() < profiles[j].Name() })
+	w.Header().Set("Content-Type", "text/html; charset=utf-8")
+	fmt.Fprint(w, "<html><body><p>profiles:</p><table>\n")
+	for _, p := range profiles {
+		name := html.EscapeString(p.Name())
+		fmt.Fprintf(w, "<tr><td>%d</td><td><a href=\"%s?debug=1\">%s</a></td></tr>\n", p.Count(), name, name)
+	}
+	fmt.Fprint(w, "<tr><td></td><td><a href=\"profile\">profile</a> (30s of cpu)</td></tr>\n")
+	fmt.Fprint(w, "<tr><td></td><td><a href=\"trace?seconds=1\">trace</a></td></tr>\n")
+	fmt.Fprint(w, "</table></body></html>\n")
+}
+
+// profileSeconds returns ?seconds=, or def.
+func profileSeconds(r *http.Request, def int) time.Duration {
+	sec, err := strconv.Atoi(r.FormValue("seconds"))
+	if err != nil || sec <= 0 {
+		sec = def
+	}
+	return time.Duration(sec) * time.Second
+}
+
+// pprofCPU writes a cpu profile of ?seconds=, 30 by default.
+func pprofCPU(w http.ResponseWriter, r *http.Request) {
+	w.Header().Set("Content-Type", "application/octet-stream")
+	w.Header().Set("Content-Disposition", `attachment; filename="profile"`)
+	if err := pprof.StartCPUProfile(w); err != nil {
+		w.Header().Del("Content-Disposition")
+		http.Error(w, "could not enable cpu profiling: "+err.Error(), http.StatusInternalServerError)
+		return
+	}
+	waitProfile(r, profileSeconds(r, 30))
+	pprof.StopCPUProfile()
+}
+
+// pprofTrace writes an execution trace of ?seconds=, 1 by default.
+func pprofTrace(w http.ResponseWriter, r *http.Request) {
+	w.Header().Set("Content-Type", "application/octet-stream")
+	w.Header().Set("Content-Disposition", `attachment; filename="trace"`)
+	if err := rtrace.Start(w); err != nil {
+		w.Header().Del("Content-Disposition")
+		http.Error(w, "could not enable tracing: "+err.Error(), http.StatusInternalServerError)
+		return
+	}
+	waitProfile(r, profileSeconds(r, 1))
+	rtrace.Stop()
+}
+
+// waitProfile waits d, or until the client of r is gone.
+func waitProfile(r *http.Request, d time.Duration) {
+	select {
+	case <-time.After(d):
+	case <-r.Context().Done():
+	}
+}
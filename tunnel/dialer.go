@@ -0,0 +1,76 @@
+package tunnel
+
+import (
+	"context"
+	"errors"
+	"net"
+
+	"github.com/daogan/socksproxy/socks5"
+	"golang.org/x/net/proxy"
+)
+
+var (
+	_ proxy.Dialer        = (*Dialer)(nil)
+	_ proxy.ContextDialer = (*Dialer)(nil)
+)
+
+var errNetwork = errors.New("only tcp can be dialed through the tunnel")
+
+// Dialer opens connections through the tunnel itself, without a local socks
+// proxy in between. Targets are routed by the rules like the requests of the
+// local proxy.
+type Dialer struct{}
+
+// NewDialer sets the package up with c, like NewClient, and returns a Dialer
+// using its servers.
+func NewDialer(c *Config) (*Dialer, error) {
+	if err := setup(c, true); err != nil {
+		return nil, err
+	}
+	return &Dialer{}, nil
+}
+
+// Dial connects to addr through the tunnel. network must be tcp, tcp4 or
+// tcp6.
+func (d *Dialer) Dial(network, addr string) (net.Conn, error) {
+	return d.DialContext(context.Background(), network, addr)
+}
+
+// DialContext is Dial, giving up when ctx is done before the connection is
+// made.
+func (d *Dialer) DialContext(ctx context.Context, network, addr string) (net.Conn, error) {
+	switch network {
+	case "tcp", "tcp4", "tcp6":
+	default:
+		return nil, &net.OpError{Op: "dial", Net: network, Err: errNetwork}
+	}
+	tgtAddr, err := socks5.EncodeAddr(addr)
+	if err != nil {
+		return nil, err
+	}
+	if err := ctx.Err(); err != nil {
+		return nil, err
+	}
+
+	type result struct {
+		conn net.Conn
+		err  error
+	}
+	done := make(chan result, 1)
+	go func() {
+		conn, _, err := dialTarget(tgtAddr)
+		done <- result{conn, err}
+	}()
+	select {
+	case r := <-done:
+		return r.conn, r.err
+	case <-ctx.Done():
+		// the dial is left to finish on its own
+		go func() {
+			if r := <-done; r.conn != nil {
+				r.conn.Close()
+			}
+		}()
+		return nil, ctx.Err()
+	}
+}
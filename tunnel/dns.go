@@ -0,0 +1,210 @@
+package tunnel
+
+import (
+	"context"
+	"encoding/binary"
+	"log/slog"
+	"net"
+	"sync"
+	"time"
+
+	"github.com/daogan/socksproxy/socks5"
+)
+
+const dnsTimeout = 10 * time.Second
+
+// dnsForwarder answers local dns queries from the -dns-server resolver,
+// reached from the server, so names never resolve on the local network. With
+// https:// or tls:// upstreams a stub resolver answers them instead. udp
+// queries share one udp tunnel and get new ids, so the answers find their
+// client, tcp connections are tunneled as they are.
+type dnsForwarder struct {
+	sync.Mutex
+	upstream []byte // socks address of the resolver
+	pc       net.PacketConn
+	tun      net.Conn
+	nextID   uint16
+	pending  map[uint16]dnsQuery // by rewritten id
+}
+
+type dnsQuery struct {
+	client net.Addr
+	id     uint16
+	sent   time.Time
+}
+
+func serveDNS(ctx context.Context, addr, upstream string) {
+	if isEncryptedDNS(upstream) {
+		r, err := newDNSResolver(upstream)
+		if err != nil {
+			fatal("invalid dns server", "err", err)
+		}
+		serveStubDNS(ctx, addr, r)
+		return
+	}
+	upstreamAddr, err := socks5.EncodeAddr(upstream)
+	if err != nil {
+		fatal("invalid dns server", "err", err)
+	}
+	pc, err := listenUDP(addr)
+	if err != nil {
+		fatal("listen error", "addr", addr, "err", err)
+	}
+	d := &dnsForwarder{upstream: upstreamAddr, pc: pc, pending: make(map[uint16]dnsQuery)}
+	go d.serve()
+	run(ctx, addr, tcpTransport{}.Listen, func(conn net.Conn) {
+		defer conn.Close()
+		tunnel(conn, upstreamAddr, nil, nil)
+	})
+}
+
+func (d *dnsForwarder) serve() {
+	buf := make([]byte, maxUDPSize)
+	for {
+		n, client, err := d.pc.ReadFrom(buf)
+		if err != nil {
+			slog.Error("dns read error", "err", err)
+			return
+		}
+		// shorter than a dns header
+		if n < 12 {
+			continue
+		}
+		if resp := fakeIPs.answer(buf[:n]); resp != nil {
+			d.pc.WriteTo(resp, client)
+			continue
+		}
+		tun, err := d.query(client, buf[:n])
+		if err != nil {
+			slog.Warn("fail to open dns tunnel", "err", err)
+			continue
+		}
+		tun.SetDeadline(time.Now().Add(udpTimeout()))
+		if err = writePacket(tun, d.upstream, buf[:n]); err != nil {
+			tun.Close()
+		}
+	}
+}
+
+// query records the query of client and rewrites its id, it returns the
+// tunnel to send it on. The tunnel is dialed without the lock, which the
+// answers of the pending queries need meanwhile.
+func (d *dnsForwarder) query(client net.Addr, msg []byte) (net.Conn, error) {
+	d.Lock()
+	if d.tun == nil {
+		d.Unlock()
+		tgtAddr, _ := socks5.EncodeAddr(udpOverTCPHost)
+		tun, _, err := dialTunnel(tgtAddr)
+		if err != nil {
+			return nil, err
+		}
+		d.Lock()
+		if d.tun == nil {
+			d.tun = tun
+			go d.readTunnel(tun)
+		} else {
+			tun.Close()
+		}
+	}
+	defer d.Unlock()
+	now := time.Now()
+	if len(d.pending) > 256 {
+		for id, q := range d.pending {
+			if now.Sub(q.sent) > dnsTimeout {
+				delete(d.pending, id)
+			}
+		}
+	}
+	d.nextID++
+	d.pending[d.nextID] = dnsQuery{client: client, id: binary.BigEndian.Uint16(msg), sent: now}
+	binary.BigEndian.PutUint16(msg, d.nextID)
+	return d.tun, nil
+}
+
+func (d *dnsForwarder) readTunnel(tun net.Conn) {
+	defer func() {
+		d.Lock()
+		if d.tun == tun {
+			d.tun = nil
+		}
+		d.Unlock()
+		tun.Close()
+	}()
+	buf := make([]byte, maxUDPSize)
+	for {
+		_, msg, err := readPacket(tun, buf)
+		if err != nil {
+			return
+		}
+		if len(msg) < 12 {
+			continue
+		}
+		d.Lock()
+		q, ok := d.pending[binary.BigEndian.Uint16(msg)]
+		delete(d.pending, binary.BigEndian.Uint16(msg))
+		d.Unlock()
+		if !ok {
+			continue
+		}
+		binary.BigEndian.PutUint16(msg, q.id)
+		d.pc.WriteTo(msg, q.client)
+	}
+}
+
+// targetAddr is the socks address the local side sends to the server for
+// addr: fake ips turn back into their domain, which with -resolve local is
+// resolved here rather than on the server, e.g. for split horizon dns, until
+// -dns-check takes the local dns for hijacked.
+func targetAddr(addr []byte) ([]byte, error) {
+	addr = fakeIPs.resolve(addr)
+	if config.Resolve != "local" || addr[0] != socks5.TypeDomain {
+		return addr, nil
+	}
+	host, port, _ := net.SplitHostPort(socks5.AddrString(addr))
+	if resolveRemote(host) {
+		return addr, nil
+	}
+	ip, err := lookupHost(host)
+	if err != nil {
+		return addr, err
+	}
+	checkAnswer(host, ip)
+	return socks5.EncodeAddr(net.JoinHostPort(ip.String(), port))
+}
+
+// nameCache keeps the target addresses of an udp association, so names are
+// resolved by its first packet only, not by every one.
+type nameCache map[string][]byte
+
+// target is targetAddr, cached.
+func (c nameCache) target(addr []byte) ([]byte, error) {
+	if tgt, ok := c[string(addr)]; ok {
+		return tgt, nil
+	}
+	tgt, err := targetAddr(addr)
+	if err != nil {
+		return nil, err
+	}
+	if len(c) > 1024 {
+		clear(c)
+	}
+	c[string(addr)] = tgt
+	return tgt, nil
+}
+
+// lookupHost resolves host with the system resolver, preferring ipv4 like
+// most resolvers, and giving up after dnsTimeout.
+func lookupHost(host string) (net.IP, error) {
+	ctx, cancel := context.WithTimeout(context.Background(), dnsTimeout)
+	defer cancel()
+	ips, err := net.DefaultResolver.LookupIP(ctx, "ip", host)
+	if err != nil {
+		return nil, err
+	}
+	for _, ip := range ips {
+		if ip.To4() != nil {
+			return ip, nil
+		}
+	}
+	return ips[0], nil
+}
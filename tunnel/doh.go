@@ -0,0 +1,250 @@
+package tunnel
+
+import (
+	"bytes"
+	"context"
+	"crypto/tls"
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"io"
+	"log/slog"
+	"net"
+	"net/http"
+	"strings"
+	"sync"
+	"time"
+
+	"golang.org/x/net/dns/dnsmessage"
+)
+
+// dnsResolver is a stub resolver asking DNS over HTTPS (https://) or DNS over
+// TLS (tls://) upstreams directly, tried in order, so lookups are encrypted
+// even for traffic that isn't proxied. Answers are cached for their ttl.
+type dnsResolver struct {
+	upstreams []string
+	client    *http.Client
+
+	sync.Mutex
+	cache map[string]dnsCacheEntry // by question
+}
+
+type dnsCacheEntry struct {
+	msg     []byte
+	stored  time.Time
+	expires time.Time
+}
+
+const maxDNSCache = 4096
+
+func newDNSResolver(upstreams string) (*dnsResolver, error) {
+	r := &dnsResolver{
+		client: &http.Client{Timeout: dnsTimeout},
+		cache:  make(map[string]dnsCacheEntry),
+	}
+	for _, u := range strings.Split(upstreams, ",") {
+		u = strings.TrimSpace(u)
+		if !strings.HasPrefix(u, "https://") && !strings.HasPrefix(u, "tls://") {
+			return nil, fmt.Errorf("dns upstream should be https:// or tls://, got %s", u)
+		}
+		r.upstreams = append(r.upstreams, u)
+	}
+	return r, nil
+}
+
+func isEncryptedDNS(upstream string) bool {
+	return strings.Contains(upstream, "://")
+}
+
+func serveStubDNS(ctx context.Context, addr string, r *dnsResolver) {
+	pc, err := listenUDP(addr)
+	if err != nil {
+		fatal("listen error", "addr", addr, "err", err)
+	}
+	go func() {
+		for {
+			buf := make([]byte, maxUDPSize)
+			n, client, err := pc.ReadFrom(buf)
+			if err != nil {
+				slog.Error("dns read error", "err", err)
+				return
+			}
+			go func() {
+				if resp, err := r.exchange(buf[:n]); err == nil {
+					pc.WriteTo(resp, client)
+				} else {
+					slog.Warn("dns error", "err", err)
+				}
+			}()
+		}
+	}()
+	run(ctx, addr, tcpTransport{}.Listen, func(conn net.Conn) {
+		defer conn.Close()
+		for {
+			conn.SetReadDeadline(idleDeadline())
+			msg, err := readDNSMessage(conn)
+			if err != nil {
+				return
+			}
+			resp, err := r.exchange(msg)
+			if err != nil {
+				slog.Warn("dns error", "err", err)
+				return
+			}
+			if err = writeDNSMessage(conn, resp); err != nil {
+				return
+			}
+		}
+	})
+}
+
+// readDNSMessage reads a length prefixed message of dns over tcp.
+func readDNSMessage(r io.Reader) ([]byte, error) {
+	var l [2]byte
+	if _, err := io.ReadFull(r, l[:]); err != nil {
+		return nil, err
+	}
+	msg := make([]byte, binary.BigEndian.Uint16(l[:]))
+	_, err := io.ReadFull(r, msg)
+	return msg, err
+}
+
+func writeDNSMessage(w io.Writer, msg []byte) error {
+	_, err := w.Write(append(binary.BigEndian.AppendUint16(nil, uint16(len(msg))), msg...))
+	return err
+}
+
+func (r *dnsResolver) exchange(query []byte) ([]byte, error) {
+	if resp := fakeIPs.answer(query); resp != nil {
+		return resp, nil
+	}
+	return r.resolve(query)
+}
+
+// resolve answers query from the cache or the upstreams, never with fake ips.
+func (r *dnsResolver) resolve(query []byte) ([]byte, error) {
+	var p dnsmessage.Parser
+	h, err := p.Start(query)
+	if err != nil {
+		return nil, err
+	}
+	q, err := p.Question()
+	if err != nil {
+		return nil, err
+	}
+	key := strings.ToLower(q.Name.String()) + " " + q.Type.String() + " " + q.Class.String()
+	if resp := r.cached(key, h.ID); resp != nil {
+		return resp, nil
+	}
+	// id 0 makes DoH answers cacheable by http caches, RFC 8484 4.1
+	msg := append([]byte{}, query...)
+	binary.BigEndian.PutUint16(msg, 0)
+	for _, u := range r.upstreams {
+		var resp []byte
+		if strings.HasPrefix(u, "https://") {
+			resp, err = r.doh(u, msg)
+		} else {
+			resp, err = r.dot(strings.TrimPrefix(u, "tls://"), msg)
+		}
+		if err != nil {
+			slog.Warn("fail to query dns server", "server", u, "err", err)
+			continue
+		}
+		r.store(key, resp)
+		binary.BigEndian.PutUint16(resp, h.ID)
+		return resp, nil
+	}
+	return nil, errors.New("no dns upstream answered")
+}
+
+func (r *dnsResolver) doh(url string, msg []byte) ([]byte, error) {
+	req, err := http.NewRequest(http.MethodPost, url, bytes.NewReader(msg))
+	if err != nil {
+		return nil, err
+	}
+	req.Header.Set("Content-Type", "application/dns-message")
+	req.Header.Set("Accept", "application/dns-message")
+	resp, err := r.client.Do(req)
+	if err != nil {
+		return nil, err
+	}
+	defer resp.Body.Close()
+	if resp.StatusCode != http.StatusOK {
+		return nil, fmt.Errorf("unexpected http status: %s", resp.Status)
+	}
+	return io.ReadAll(io.LimitReader(resp.Body, maxUDPSize))
+}
+
+func (r *dnsResolver) dot(addr string, msg []byte) ([]byte, error) {
+	if _, _, err := net.SplitHostPort(addr); err != nil {
+		addr = net.JoinHostPort(addr, "853")
+	}
+	host, _, _ := net.SplitHostPort(addr)
+	dialer := &net.Dialer{Timeout: dnsTimeout}
+	conn, err := tls.DialWithDialer(dialer, "tcp", addr, &tls.Config{ServerName: host})
+	if err != nil {
+		return nil, err
+	}
+	defer conn.Close()
+	conn.SetDeadline(time.Now().Add(dnsTimeout))
+	if err = writeDNSMessage(conn, msg); err != nil {
+		return nil, err
+	}
+	return readDNSMessage(conn)
+}
+
+// cached returns the cached answer for key with the given id and the ttls
+// counted down, or nil.
+func (r *dnsResolver) cached(key string, id uint16) []byte {
+	r.Lock()
+	e, ok := r.cache[key]
+	r.Unlock()
+	if !ok || time.Now().After(e.expires) {
+		return nil
+	}
+	var m dnsmessage.Message
+	if err := m.Unpack(e.msg); err != nil {
+		return nil
+	}
+	elapsed := uint32(time.Since(e.stored) / time.Second)
+	for _, rrs := range [][]dnsmessage.Resource{m.Answers, m.Authorities, m.Additionals} {
+		for i := range rrs {
+			if rrs[i].Header.Type != dnsmessage.TypeOPT {
+				rrs[i].Header.TTL -= min(elapsed, rrs[i].Header.TTL)
+			}
+		}
+	}
+	m.ID = id
+	resp, err := m.Pack()
+	if err != nil {
+		return nil
+	}
+	return resp
+}
+
+// store caches resp for the smallest ttl of its records.
+func (r *dnsResolver) store(key string, resp []byte) {
+	var m dnsmessage.Message
+	if err := m.Unpack(resp); err != nil || m.RCode != dnsmessage.RCodeSuccess && m.RCode != dnsmessage.RCodeNameError {
+		return
+	}
+	ttl := uint32(0)
+	first := true
+	for _, rrs := range [][]dnsmessage.Resource{m.Answers, m.Authorities} {
+		for _, rr := range rrs {
+			if first || rr.Header.TTL < ttl {
+				ttl, first = rr.Header.TTL, false
+			}
+		}
+	}
+	if ttl == 0 {
+		return
+	}
+	now := time.Now()
+	r.Lock()
+	defer r.Unlock()
+	if len(r.cache) >= maxDNSCache {
+		r.cache = make(map[string]dnsCacheEntry)
+	}
+	r.cache[key] = dnsCacheEntry{msg: append([]byte{}, resp...), stored: now, expires: now.Add(time.Duration(ttl) * time.Second)}
+}
@@ -0,0 +1,160 @@
+package tunnel
+
+import (
+	"errors"
+	"fmt"
+	"net"
+	"strconv"
+	"strings"
+	"sync/atomic"
+	"syscall"
+)
+
+var (
+	// errEgress is the dial error of a target port the server blocks.
+	errEgress = errors.New("target port not allowed")
+	// errPrivate is the dial error of a target address of the server's own
+	// networks, which the clients shouldn't reach through it.
+	errPrivate = errors.New("private target not allowed")
+)
+
+// blockedPorts and blockedPrivate count the targets the server didn't dial
+// for errEgress and errPrivate.
+var blockedPorts, blockedPrivate atomic.Uint64
+
+// egress is the policy of the targets the server dials for a user: ports of
+// none of block and, unless allow is empty, one of allow, and with private
+// set no loopback, private or link local addresses. A nil egress allows
+// everything.
+type egress struct {
+	allow, block []portRange
+	private      bool
+}
+
+// portRange is the ports lo to hi of network, or of tcp and udp both when
+// network is empty.
+type portRange struct {
+	lo, hi  int
+	network string
+}
+
+// parseEgress parses the comma separated ports of allow and block, each a
+// port or a range like 8000-9000, optionally followed by /tcp or /udp as in
+// 53/udp, private blocking the private addresses. It returns nil when there
+// is nothing to block.
+func parseEgress(allow, block string, private bool) (*egress, error) {
+	e := &egress{private: private}
+	var err error
+	if e.allow, err = parsePorts(allow); err != nil {
+		return nil, fmt.Errorf("allow_ports error: %v", err)
+	}
+	if e.block, err = parsePorts(block); err != nil {
+		return nil, fmt.Errorf("block_ports error: %v", err)
+	}
+	if e.allow == nil && e.block == nil && !private {
+		return nil, nil
+	}
+	return e, nil
+}
+
+func parsePorts(list string) ([]portRange, error) {
+	var ranges []portRange
+	for _, s := range strings.Split(list, ",") {
+		if s = strings.TrimSpace(s); s == "" {
+			continue
+		}
+		var r portRange
+		ports, network, ok := strings.Cut(s, "/")
+		if ok {
+			if network != "tcp" && network != "udp" {
+				return nil, fmt.Errorf("invalid network %q, expect tcp or udp", network)
+			}
+			r.network = network
+		}
+		lo, hi, isRange := strings.Cut(ports, "-")
+		var err1, err2 error
+		r.lo, err1 = strconv.Atoi(lo)
+		r.hi = r.lo
+		if isRange {
+			r.hi, err2 = strconv.Atoi(hi)
+		}
+		if err1 != nil || err2 != nil || r.lo < 1 || r.hi > 65535 || r.lo > r.hi {
+			return nil, fmt.Errorf("invalid ports %q", s)
+		}
+		ranges = append(ranges, r)
+	}
+	return ranges, nil
+}
+
+func matchPorts(ranges []portRange, network string, port int) bool {
+	for _, r := range ranges {
+		if (r.network == "" || r.network == network) && port >= r.lo && port <= r.hi {
+			return true
+		}
+	}
+	return false
+}
+
+// check returns errEgress or errPrivate, counted, if e blocks target, a
+// host:port, over network. A host name is only checked once resolved, by
+// checkIP or control.
+func (e *egress) check(network, target string) error {
+	if e == nil {
+		return nil
+	}
+	host, p, err := net.SplitHostPort(target)
+	if err != nil {
+		return err
+	}
+	port, _ := strconv.Atoi(p)
+	if matchPorts(e.block, network, port) || e.allow != nil && !matchPorts(e.allow, network, port) {
+		blockedPorts.Add(1)
+		return errEgress
+	}
+	if ip := net.ParseIP(host); ip != nil {
+		return e.checkIP(ip)
+	}
+	return nil
+}
+
+// checkIP returns errPrivate, counted, if e blocks the address ip.
+func (e *egress) checkIP(ip net.IP) error {
+	if e == nil || !e.private {
+		return nil
+	}
+	if privateIP(ip) {
+		blockedPrivate.Add(1)
+		return errPrivate
+	}
+	return nil
+}
+
+// sharedNet and thisNet are the shared address space of carrier grade nat,
+// RFC 6598, often internal networks of clouds, and 0.0.0.0/8, which linux
+// connects to the host itself.
+var sharedNet, thisNet = mustCIDR("100.64.0.0/10"), mustCIDR("0.0.0.0/8")
+
+func mustCIDR(s string) *net.IPNet {
+	_, n, err := net.ParseCIDR(s)
+	if err != nil {
+		panic(err)
+	}
+	return n
+}
+
+// privateIP reports whether ip is of the host or a local network: loopback,
+// private, link local, shared or unspecified.
+func privateIP(ip net.IP) bool {
+	return ip.IsLoopback() || ip.IsPrivate() || ip.IsUnspecified() || ip.IsLinkLocalUnicast() ||
+		ip.IsLinkLocalMulticast() || ip.IsInterfaceLocalMulticast() || sharedNet.Contains(ip) || thisNet.Contains(ip)
+}
+
+// control is the net.Dialer Control of the targets, it checks the addresses
+// the names resolved to, so a name can't lead the server to its own networks.
+func (e *egress) control(network, address string, c syscall.RawConn) error {
+	host, _, err := net.SplitHostPort(address)
+	if err != nil {
+		return err
+	}
+	return e.checkIP(net.ParseIP(host))
+}
@@ -0,0 +1,112 @@
+package tunnel
+
+import (
+	"context"
+	"net"
+	"time"
+)
+
+// attemptDelay is the wait before the next address is dialed while the last
+// attempt is still connecting, the Connection Attempt Delay of RFC 8305.
+const attemptDelay = 250 * time.Millisecond
+
+// dialHappy dials target with d like Happy Eyeballs (RFC 8305): the
+// addresses of a host name are tried in turn alternating the families,
+// starting with -prefer-ip or else the family the resolver lists first. Each
+// attempt starts attemptDelay after the last or once it failed, the first to
+// connect is kept and the others are given up.
+func dialHappy(d *net.Dialer, target string) (net.Conn, error) {
+	host, port, err := net.SplitHostPort(target)
+	if err != nil {
+		return nil, err
+	}
+	if net.ParseIP(host) != nil {
+		return d.Dial("tcp", target)
+	}
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+	if dialTimeout > 0 {
+		ctx, cancel = context.WithTimeout(ctx, dialTimeout)
+		defer cancel()
+	}
+	ips, err := net.DefaultResolver.LookupIPAddr(ctx, host)
+	if err != nil {
+		return nil, err
+	}
+	addrs := interleave(ips, config.PreferIP)
+
+	type result struct {
+		conn net.Conn
+		err  error
+	}
+	results := make(chan result, len(addrs))
+	var next, pending int
+	start := func() {
+		addr := net.JoinHostPort(addrs[next].String(), port)
+		next++
+		pending++
+		go func() {
+			conn, err := d.DialContext(ctx, "tcp", addr)
+			results <- result{conn, err}
+		}()
+	}
+	start()
+	var firstErr error
+	for pending > 0 {
+		var delay <-chan time.Time
+		if next < len(addrs) {
+			delay = time.After(attemptDelay)
+		}
+		select {
+		case r := <-results:
+			pending--
+			if r.err == nil {
+				// the attempts left fail as ctx is done, or connected too late
+				go func(n int) {
+					for ; n > 0; n-- {
+						if r := <-results; r.conn != nil {
+							r.conn.Close()
+						}
+					}
+				}(pending)
+				return r.conn, nil
+			}
+			if firstErr == nil {
+				firstErr = r.err
+			}
+			if next < len(addrs) {
+				start()
+			}
+		case <-delay:
+			start()
+		}
+	}
+	return nil, firstErr
+}
+
+// interleave orders ips alternating ipv6 and ipv4, starting with prefer, "4"
+// or "6", or else the family of the first.
+func interleave(ips []net.IPAddr, prefer string) []net.IP {
+	var v4, v6 []net.IP
+	for _, ip := range ips {
+		if ip.IP.To4() != nil {
+			v4 = append(v4, ip.IP)
+		} else {
+			v6 = append(v6, ip.IP)
+		}
+	}
+	first, second := v6, v4
+	if prefer == "4" || prefer == "" && len(ips) > 0 && ips[0].IP.To4() != nil {
+		first, second = v4, v6
+	}
+	addrs := make([]net.IP, 0, len(ips))
+	for i := 0; i < len(first) || i < len(second); i++ {
+		if i < len(first) {
+			addrs = append(addrs, first[i])
+		}
+		if i < len(second) {
+			addrs = append(addrs, second[i])
+		}
+	}
+	return addrs
+}
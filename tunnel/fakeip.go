@@ -0,0 +1,126 @@
+package tunnel
+
+import (
+	"encoding/binary"
+	"errors"
+	"net"
+	"sync"
+
+	"github.com/daogan/socksproxy/socks5"
+	"golang.org/x/net/dns/dnsmessage"
+)
+
+// With -fakeip the local dns answers A queries with addresses of a reserved
+// range, each standing for one domain, and AAAA queries with nothing so
+// clients stay on ipv4. Connections to a fake address, from redir, tproxy,
+// tun or socks with a locally resolved name, are tunneled to its domain, so
+// the server resolves the name and domain rules apply.
+type fakeIPPool struct {
+	sync.Mutex
+	base    uint32
+	size    uint32
+	next    uint32
+	domains map[uint32]string
+	ips     map[string]uint32
+}
+
+var fakeIPs *fakeIPPool
+
+// fakeIPTTL is short, a domain keeps its address as long as it is in use.
+const fakeIPTTL = 1
+
+func newFakeIPPool(cidr string) (*fakeIPPool, error) {
+	_, ipnet, err := net.ParseCIDR(cidr)
+	if err != nil {
+		return nil, err
+	}
+	ones, bits := ipnet.Mask.Size()
+	if ipnet.IP.To4() == nil || bits != 32 || ones > 30 {
+		return nil, errors.New("fakeip range should be ipv4, /30 or larger")
+	}
+	return &fakeIPPool{
+		base:    binary.BigEndian.Uint32(ipnet.IP.To4()),
+		size:    1 << (32 - ones),
+		domains: make(map[uint32]string),
+		ips:     make(map[string]uint32),
+	}, nil
+}
+
+// ip returns the fake address of domain. Addresses are handed out in turn,
+// once the range is used up the oldest domains lose theirs.
+func (p *fakeIPPool) ip(domain string) net.IP {
+	p.Lock()
+	defer p.Unlock()
+	ip, ok := p.ips[domain]
+	if !ok {
+		// skip the network and broadcast addresses
+		ip = p.base + 1 + p.next%(p.size-2)
+		p.next++
+		if old, ok := p.domains[ip]; ok {
+			delete(p.ips, old)
+		}
+		p.domains[ip] = domain
+		p.ips[domain] = ip
+	}
+	return binary.BigEndian.AppendUint32(nil, ip)
+}
+
+func (p *fakeIPPool) domain(ip net.IP) (string, bool) {
+	ip4 := ip.To4()
+	if p == nil || ip4 == nil {
+		return "", false
+	}
+	p.Lock()
+	defer p.Unlock()
+	d, ok := p.domains[binary.BigEndian.Uint32(ip4)]
+	return d, ok
+}
+
+// resolve turns a socks address of a fake ip back into its domain.
+func (p *fakeIPPool) resolve(addr []byte) []byte {
+	if p == nil || len(addr) != 1+net.IPv4len+2 || addr[0] != socks5.TypeIPv4 {
+		return addr
+	}
+	d, ok := p.domain(net.IP(addr[1 : 1+net.IPv4len]))
+	if !ok || len(d) > 255 {
+		return addr
+	}
+	out := append([]byte{socks5.TypeDomain, byte(len(d))}, d...)
+	return append(out, addr[1+net.IPv4len:]...)
+}
+
+// answer returns the fake answer of an A or AAAA query, or nil for the other
+// queries.
+func (p *fakeIPPool) answer(query []byte) []byte {
+	if p == nil {
+		return nil
+	}
+	var parser dnsmessage.Parser
+	h, err := parser.Start(query)
+	if err != nil {
+		return nil
+	}
+	qs, err := parser.AllQuestions()
+	if err != nil || len(qs) != 1 || qs[0].Class != dnsmessage.ClassINET {
+		return nil
+	}
+	q := qs[0]
+	if q.Type != dnsmessage.TypeA && q.Type != dnsmessage.TypeAAAA {
+		return nil
+	}
+	b := dnsmessage.NewBuilder(nil, dnsmessage.Header{ID: h.ID, Response: true, RecursionDesired: h.RecursionDesired, RecursionAvailable: true})
+	b.StartQuestions()
+	b.Question(q)
+	b.StartAnswers()
+	if q.Type == dnsmessage.TypeA {
+		var a dnsmessage.AResource
+		name := q.Name.String()
+		copy(a.A[:], p.ip(name[:len(name)-1]))
+		b.AResource(dnsmessage.ResourceHeader{Name: q.Name, Class: dnsmessage.ClassINET, TTL: fakeIPTTL}, a)
+	}
+	resp, err := b.Finish()
+	if err != nil {
+		return nil
+	}
+	return resp
+}
@@ -0,0 +1,86 @@
+package tunnel
+
+import (
+	"log/slog"
+	"net"
+	"net/http"
+	"os"
+)
+
+// Probes sending garbage to the server are relayed to the -fallback site
+// instead of being dropped, so the server looks like an ordinary web host.
+// The fallback is a decoy address, or a directory served as a static site.
+var fallbackAddr string
+
+func startFallback() error {
+	fallbackAddr = config.Fallback
+	if fallbackAddr == "" {
+		return nil
+	}
+	if fi, err := os.Stat(fallbackAddr); err != nil || !fi.IsDir() {
+		return nil
+	}
+	ln, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		return err
+	}
+	slog.Info("serving fallback site", "dir", config.Fallback)
+	go http.Serve(ln, http.FileServer(http.Dir(config.Fallback)))
+	fallbackAddr = ln.Addr().String()
+	return nil
+}
+
+// fallback relays a connection that failed authentication to the decoy site,
+// replaying the bytes already read from it.
+func fallback(c net.Conn, head []byte) {
+	if fallbackAddr == "" {
+		return
+	}
+	remote, err := dialTCP(fallbackAddr)
+	if err != nil {
+		slog.Warn("fail to dial fallback", "addr", fallbackAddr, "err", err)
+		return
+	}
+	defer remote.Close()
+	if _, err = remote.Write(head); err != nil {
+		return
+	}
+	relay(c, remote, config.Fallback)
+}
+
+// maxRecord bounds what recordConn keeps, a client sending more before
+// authenticating is not replayed.
+const maxRecord = 64 * 1024
+
+// recordConn keeps the bytes read from the connection until stop is called.
+type recordConn struct {
+	net.Conn
+	buf      []byte
+	stopped  bool
+	overflow bool
+}
+
+func (c *recordConn) Read(b []byte) (int, error) {
+	n, err := c.Conn.Read(b)
+	if !c.stopped && n > 0 {
+		if len(c.buf)+n > maxRecord {
+			c.overflow = true
+			c.stopped = true
+			c.buf = nil
+		} else {
+			c.buf = append(c.buf, b[:n]...)
+		}
+	}
+	return n, err
+}
+
+func (c *recordConn) CloseWrite() error { return closeWrite(c.Conn) }
+func (c *recordConn) CloseRead() error  { return closeRead(c.Conn) }
+
+// stop ends the recording and returns the bytes read so far, ok is false if
+// they didn't fit.
+func (c *recordConn) stop() (head []byte, ok bool) {
+	c.stopped = true
+	head, c.buf = c.buf, nil
+	return head, !c.overflow
+}
@@ -0,0 +1,45 @@
+package tunnel
+
+import (
+	"net"
+	"os"
+	"strings"
+	"sync/atomic"
+
+	"github.com/oschwald/maxminddb-golang"
+)
+
+// geoDB is the MaxMind (GeoLite2 or GeoIP2) country database of the GEOIP
+// rules, read into memory so a reload never unmaps it under a lookup.
+var geoDB atomic.Pointer[maxminddb.Reader]
+
+func loadGeoIP(path string) error {
+	b, err := os.ReadFile(path)
+	if err != nil {
+		return err
+	}
+	db, err := maxminddb.FromBytes(b)
+	if err != nil {
+		return err
+	}
+	geoDB.Store(db)
+	return nil
+}
+
+// geoCountry returns the lower case ISO country code of ip, or "" if the
+// database doesn't know it.
+func geoCountry(ip net.IP) string {
+	db := geoDB.Load()
+	if db == nil {
+		return ""
+	}
+	var record struct {
+		Country struct {
+			ISOCode string `maxminddb:"iso_code"`
+		} `maxminddb:"country"`
+	}
+	if err := db.Lookup(ip, &record); err != nil {
+		return ""
+	}
+	return strings.ToLower(record.Country.ISOCode)
+}
@@ -0,0 +1,199 @@
+package tunnel
+
+import (
+	"log/slog"
+	"net"
+	"strings"
+	"sync"
+	"sync/atomic"
+	"time"
+
+	"golang.org/x/net/dns/dnsmessage"
+)
+
+// With -resolve local, -dns-check asks encrypted upstreams for the names the
+// system resolver answered, once each. A public local address which the
+// check doesn't give, nor any of its network, suggests the local dns is
+// hijacked or poisoned: the name is logged, and once most of the last
+// checks diverge the local side resolves remotely for hijackHold, then
+// checks again. The names of the local networks, as their suffix or a
+// private answer tells, the check can't know and are left alone.
+const (
+	hijackWindow = 16 // last checks the ratio is taken over
+	hijackLimit  = 3  // divergent names at least, and half of the window
+	hijackHold   = 10 * time.Minute
+)
+
+// localSuffixes are the names only the local dns knows.
+var localSuffixes = []string{".local", ".lan", ".home", ".home.arpa", ".internal", ".intranet", ".corp", ".localdomain"}
+
+var dnsCheck struct {
+	r *dnsResolver // nil without -dns-check
+
+	sync.Mutex
+	checked map[string]bool
+	results [hijackWindow]bool // divergent or not, a ring
+	n, next int
+}
+
+var (
+	// remoteUntil is the unix nano time until which the local dns is taken
+	// for hijacked.
+	remoteUntil atomic.Int64
+	dnsHijacks  atomic.Uint64
+)
+
+// setupDNSCheck checks the local answers against r, nil for no -dns-check.
+func setupDNSCheck(r *dnsResolver) {
+	remoteUntil.Store(0)
+	dnsCheck.Lock()
+	dnsCheck.r, dnsCheck.checked = r, make(map[string]bool)
+	dnsCheck.n, dnsCheck.next = 0, 0
+	dnsCheck.Unlock()
+}
+
+// resolveRemote reports whether host is resolved on the server, the local dns
+// being taken for hijacked. Local names never are.
+func resolveRemote(host string) bool {
+	until := remoteUntil.Load()
+	if until == 0 || localName(host) {
+		return false
+	}
+	if time.Now().UnixNano() < until {
+		return true
+	}
+	if remoteUntil.CompareAndSwap(until, 0) {
+		// check the names again
+		dnsCheck.Lock()
+		clear(dnsCheck.checked)
+		dnsCheck.Unlock()
+		slog.Info("resolving locally again and checking the local dns")
+	}
+	return false
+}
+
+// localName reports whether host is a name of the local networks, a single
+// label or under one of localSuffixes.
+func localName(host string) bool {
+	host = strings.ToLower(strings.TrimSuffix(host, "."))
+	if !strings.Contains(host, ".") {
+		return true
+	}
+	for _, suffix := range localSuffixes {
+		if strings.HasSuffix(host, suffix) {
+			return true
+		}
+	}
+	return false
+}
+
+// checkAnswer compares in the background ip, the local answer for host, with
+// that of the check upstreams, the first time host is resolved.
+func checkAnswer(host string, ip net.IP) {
+	r := dnsCheck.r
+	if r == nil || localName(host) || privateIP(ip) {
+		return
+	}
+	dnsCheck.Lock()
+	if dnsCheck.checked[host] {
+		dnsCheck.Unlock()
+		return
+	}
+	if len(dnsCheck.checked) > maxDNSCache {
+		clear(dnsCheck.checked)
+	}
+	dnsCheck.checked[host] = true
+	dnsCheck.Unlock()
+	go func() {
+		ips, err := checkLookup(r, host, ip.To4() == nil)
+		if err != nil || len(ips) == 0 {
+			// nothing to compare with, e.g. a name the upstreams don't know
+			slog.Debug("dns check without answer", "host", host, "err", err)
+			return
+		}
+		bad := divergent(ip, ips)
+		if bad {
+			dnsHijacks.Add(1)
+			slog.Warn("local dns answer differs from the check, it may be hijacked", "host", host, "local", ip.String(), "check", ips)
+		}
+		if n, total := recordCheck(bad); n >= hijackLimit && 2*n >= total {
+			remoteUntil.Store(time.Now().Add(hijackHold).UnixNano())
+			slog.Warn("local dns seems hijacked, resolving on the server for a while", "divergent", n, "checks", total, "for", hijackHold)
+		}
+	}()
+}
+
+// recordCheck adds the result of a check to the window, it returns the
+// divergent ones in there and the checks it holds. A switch to remote starts
+// the window anew.
+func recordCheck(bad bool) (n, total int) {
+	dnsCheck.Lock()
+	defer dnsCheck.Unlock()
+	dnsCheck.results[dnsCheck.next] = bad
+	dnsCheck.next = (dnsCheck.next + 1) % hijackWindow
+	dnsCheck.n = min(dnsCheck.n+1, hijackWindow)
+	for _, b := range dnsCheck.results[:dnsCheck.n] {
+		if b {
+			n++
+		}
+	}
+	total = dnsCheck.n
+	if n >= hijackLimit && 2*n >= total {
+		dnsCheck.n, dnsCheck.next = 0, 0
+	}
+	return n, total
+}
+
+// checkLookup returns the addresses r answers for host, ipv6 or ipv4 ones.
+func checkLookup(r *dnsResolver, host string, v6 bool) ([]net.IP, error) {
+	name, err := dnsmessage.NewName(strings.TrimSuffix(host, ".") + ".")
+	if err != nil {
+		return nil, err
+	}
+	typ := dnsmessage.TypeA
+	if v6 {
+		typ = dnsmessage.TypeAAAA
+	}
+	b := dnsmessage.NewBuilder(nil, dnsmessage.Header{RecursionDesired: true})
+	b.StartQuestions()
+	b.Question(dnsmessage.Question{Name: name, Type: typ, Class: dnsmessage.ClassINET})
+	query, err := b.Finish()
+	if err != nil {
+		return nil, err
+	}
+	resp, err := r.resolve(query)
+	if err != nil {
+		return nil, err
+	}
+	var m dnsmessage.Message
+	if err := m.Unpack(resp); err != nil {
+		return nil, err
+	}
+	var ips []net.IP
+	for _, a := range m.Answers {
+		switch body := a.Body.(type) {
+		case *dnsmessage.AResource:
+			ips = append(ips, net.IP(body.A[:]))
+		case *dnsmessage.AAAAResource:
+			ips = append(ips, net.IP(body.AAAA[:]))
+		}
+	}
+	return ips, nil
+}
+
+// divergent reports whether the local answer ip has nothing in common with
+// the checked ones, not even its /24 or /48, which the addresses of a cdn
+// usually share.
+func divergent(ip net.IP, checked []net.IP) bool {
+	bits := 48
+	if v4 := ip.To4(); v4 != nil {
+		ip, bits = v4, 24
+	}
+	network := &net.IPNet{IP: ip.Mask(net.CIDRMask(bits, 8*len(ip))), Mask: net.CIDRMask(bits, 8*len(ip))}
+	for _, c := range checked {
+		if network.Contains(c) {
+			return false
+		}
+	}
+	return true
+}
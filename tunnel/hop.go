@@ -0,0 +1,143 @@
+package tunnel
+
+import (
+	"crypto/hmac"
+	"crypto/sha256"
+	"encoding/binary"
+	"errors"
+	"log/slog"
+	"net"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+)
+
+// With a port range as server address, e.g. 1.2.3.4:20000-21000, the server
+// listens on every port of the range and the local side hops to another port
+// every hop interval. The port is picked from a secret and the time, so both
+// ends agree without talking and blocking one port only lasts until the next
+// hop.
+type hopTransport struct {
+	Transport
+	interval time.Duration
+	secret   []byte
+}
+
+func newHopTransport(t Transport, interval time.Duration, secret string) *hopTransport {
+	return &hopTransport{Transport: t, interval: interval, secret: []byte(secret)}
+}
+
+// parsePortRange splits host:lo-hi, ok is false for a single port.
+func parsePortRange(addr string) (host string, lo, hi int, ok bool) {
+	host, port, err := net.SplitHostPort(addr)
+	if err != nil {
+		return
+	}
+	from, to, found := strings.Cut(port, "-")
+	if !found {
+		return
+	}
+	lo, err1 := strconv.Atoi(from)
+	hi, err2 := strconv.Atoi(to)
+	if err1 != nil || err2 != nil || lo < 1 || hi > 65535 || lo > hi {
+		return
+	}
+	return host, lo, hi, true
+}
+
+// port is the port of the range to use at time now.
+func (t *hopTransport) port(lo, hi int, now time.Time) int {
+	mac := hmac.New(sha256.New, t.secret)
+	binary.Write(mac, binary.BigEndian, now.Unix()/int64(t.interval/time.Second))
+	sum := mac.Sum(nil)
+	return lo + int(binary.BigEndian.Uint64(sum)%uint64(hi-lo+1))
+}
+
+func (t *hopTransport) Dial(addr string) (net.Conn, error) {
+	host, lo, hi, ok := parsePortRange(addr)
+	if !ok {
+		return t.Transport.Dial(addr)
+	}
+	port := t.port(lo, hi, time.Now())
+	return t.Transport.Dial(net.JoinHostPort(host, strconv.Itoa(port)))
+}
+
+func (t *hopTransport) Listen(addr string) (net.Listener, error) {
+	host, lo, hi, ok := parsePortRange(addr)
+	if !ok {
+		return t.Transport.Listen(addr)
+	}
+	var lns []net.Listener
+	for port := lo; port <= hi; port++ {
+		ln, err := t.Transport.Listen(net.JoinHostPort(host, strconv.Itoa(port)))
+		if err != nil {
+			slog.Warn("fail to listen port", "port", port, "err", err)
+			continue
+		}
+		lns = append(lns, ln)
+	}
+	if len(lns) == 0 {
+		return nil, errors.New("no port of the range to listen on")
+	}
+	return newMultiListener(lns), nil
+}
+
+// multiListener accepts the connections of several listeners.
+type multiListener struct {
+	lns       []net.Listener
+	conns     chan net.Conn
+	done      chan struct{}
+	closeOnce sync.Once
+}
+
+func newMultiListener(lns []net.Listener) *multiListener {
+	l := &multiListener{lns: lns, conns: make(chan net.Conn), done: make(chan struct{})}
+	for _, ln := range lns {
+		go l.serve(ln)
+	}
+	return l
+}
+
+func (l *multiListener) serve(ln net.Listener) {
+	for {
+		c, err := ln.Accept()
+		if err != nil {
+			select {
+			case <-l.done:
+				return
+			default:
+			}
+			slog.Warn("accept error", "err", err)
+			time.Sleep(time.Second)
+			continue
+		}
+		select {
+		case l.conns <- c:
+		case <-l.done:
+			c.Close()
+			return
+		}
+	}
+}
+
+func (l *multiListener) Accept() (net.Conn, error) {
+	select {
+	case c := <-l.conns:
+		return c, nil
+	case <-l.done:
+		return nil, net.ErrClosed
+	}
+}
+
+func (l *multiListener) Close() error {
+	l.closeOnce.Do(func() { close(l.done) })
+	for _, ln := range l.lns {
+		ln.Close()
+	}
+	return nil
+}
+
+func (l *multiListener) Addr() net.Addr {
+	return l.lns[0].Addr()
+}
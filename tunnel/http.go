@@ -0,0 +1,133 @@
+package tunnel
+
+import (
+	"bufio"
+	"crypto/subtle"
+	"encoding/base64"
+	"errors"
+	"log/slog"
+	"net"
+	"net/http"
+	"strings"
+
+	"github.com/daogan/socksproxy/socks5"
+)
+
+// handleHTTP serves an http proxy request: CONNECT, e.g. from a browser
+// configured with a secure (https) proxy, or a plain request with an absolute
+// URI, which is forwarded with one request per connection.
+func handleHTTP(conn net.Conn) {
+	defer conn.Close()
+	br := bufio.NewReader(conn)
+	setDeadline(conn, config.RequestTimeout)
+	req, err := http.ReadRequest(br)
+	setDeadline(conn, 0)
+	if err != nil {
+		slog.Debug("fail to read http request", "client", conn.RemoteAddr().String(), "err", err)
+		return
+	}
+	if !proxyAuthorized(req, activeKeys.Load().auth) {
+		slog.Warn("http proxy authentication failed", "client", conn.RemoteAddr().String())
+		handshakeFailures.Add(1)
+		conn.Write([]byte("HTTP/1.1 407 Proxy Authentication Required\r\nProxy-Authenticate: Basic realm=\"socksproxy\"\r\nContent-Length: 0\r\n\r\n"))
+		return
+	}
+	if req.Method != http.MethodConnect {
+		forwardHTTP(conn, br, req)
+		return
+	}
+	tgtAddr, err := socks5.EncodeAddr(req.Host)
+	if err != nil {
+		slog.Warn("invalid http CONNECT host", "host", req.Host, "err", err)
+		conn.Write([]byte("HTTP/1.1 400 Bad Request\r\n\r\n"))
+		return
+	}
+	if err = checkRequest(conn, tgtAddr); err != nil {
+		conn.Write([]byte(httpStatus(err)))
+		return
+	}
+	tr := startTrace("http", conn)
+	defer tr.finish(nil)
+	established := func(remote net.Conn, err error) error {
+		if err != nil {
+			_, err = conn.Write([]byte(httpStatus(err)))
+			return err
+		}
+		_, err = conn.Write([]byte("HTTP/1.1 200 Connection established\r\n\r\n"))
+		return err
+	}
+	if config.FastReply {
+		if err = established(nil, nil); err != nil {
+			return
+		}
+		established = nil
+	}
+	tunnel(&prefixConn{Conn: conn, r: br}, tgtAddr, tr, established)
+}
+
+// httpStatus returns the response telling an http client of err: 403 for a
+// target it may not reach, 502 Bad Gateway for one that failed.
+func httpStatus(err error) string {
+	if errors.Is(err, errRejected) || errors.Is(err, errLoop) {
+		return "HTTP/1.1 403 Forbidden\r\n\r\n"
+	}
+	return "HTTP/1.1 502 Bad Gateway\r\n\r\n"
+}
+
+// proxyAuthorized reports whether req carries the user:pass auth as basic
+// Proxy-Authorization, or auth is empty.
+func proxyAuthorized(req *http.Request, auth string) bool {
+	if auth == "" {
+		return true
+	}
+	scheme, cred, ok := strings.Cut(req.Header.Get("Proxy-Authorization"), " ")
+	if !ok || !strings.EqualFold(scheme, "Basic") {
+		return false
+	}
+	b, err := base64.StdEncoding.DecodeString(strings.TrimSpace(cred))
+	if err != nil {
+		return false
+	}
+	return subtle.ConstantTimeCompare(b, []byte(auth)) == 1
+}
+
+// forwardHTTP sends a plain proxy request such as GET http://host/path to its
+// host through the tunnel.
+func forwardHTTP(conn net.Conn, br *bufio.Reader, req *http.Request) {
+	if req.URL.Scheme != "http" || req.URL.Host == "" {
+		conn.Write([]byte("HTTP/1.1 400 Bad Request\r\n\r\n"))
+		return
+	}
+	host := req.URL.Host
+	if _, _, err := net.SplitHostPort(host); err != nil {
+		host = net.JoinHostPort(strings.Trim(host, "[]"), "80")
+	}
+	tgtAddr, err := socks5.EncodeAddr(host)
+	if err != nil {
+		slog.Warn("invalid http host", "host", host, "err", err)
+		conn.Write([]byte("HTTP/1.1 400 Bad Request\r\n\r\n"))
+		return
+	}
+	if err = checkRequest(conn, tgtAddr); err != nil {
+		conn.Write([]byte(httpStatus(err)))
+		return
+	}
+	remote, server, err := dialTarget(tgtAddr)
+	if err != nil {
+		slog.Warn("fail to connect", "target", host, "err", err)
+		countDialError(err)
+		conn.Write([]byte(httpStatus(err)))
+		return
+	}
+	defer remote.Close()
+	slog.Debug("connecting", "client", conn.RemoteAddr().String(), "server", server, "target", host)
+	// the connection ends with the response, further requests may be for
+	// other hosts
+	req.Header.Del("Proxy-Connection")
+	req.Header.Del("Proxy-Authorization")
+	req.Close = true
+	if err = req.Write(remote); err != nil {
+		return
+	}
+	relay(&prefixConn{Conn: conn, r: br}, remote, host)
+}
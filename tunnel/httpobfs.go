@@ -0,0 +1,153 @@
+package tunnel
+
+import (
+	"bufio"
+	"fmt"
+	"io"
+	"net"
+	"net/http"
+	"strconv"
+	"sync"
+	"time"
+)
+
+// httpObfsTransport disguises the tunnel as a plain HTTP exchange, in the
+// spirit of simple-obfs: the local side sends a GET request and the server
+// answers 200, both with a chunked body carrying the encrypted stream. host is
+// the Host header sent by the local side, the server address by default.
+type httpObfsTransport struct {
+	host string
+}
+
+func NewHTTPObfsTransport(host string) *httpObfsTransport {
+	return &httpObfsTransport{host: host}
+}
+
+func (t *httpObfsTransport) Dial(addr string) (net.Conn, error) {
+	c, err := dialTCP(addr)
+	if err != nil {
+		return nil, err
+	}
+	host := t.host
+	if host == "" {
+		host = addr
+	}
+	return &httpObfsConn{Conn: c, br: bufio.NewReader(c), client: true, host: host}, nil
+}
+
+func (t *httpObfsTransport) Listen(addr string) (net.Listener, error) {
+	ln, err := listenTCP(addr)
+	if err != nil {
+		return nil, err
+	}
+	return httpObfsListener{ln}, nil
+}
+
+type httpObfsListener struct {
+	net.Listener
+}
+
+func (l httpObfsListener) Accept() (net.Conn, error) {
+	c, err := l.Listener.Accept()
+	if err != nil {
+		return nil, err
+	}
+	return &httpObfsConn{Conn: c, br: bufio.NewReader(c)}, nil
+}
+
+// httpObfsConn sends the HTTP header with the first write and reads the peer
+// one on the first read.
+type httpObfsConn struct {
+	net.Conn
+	br     *bufio.Reader
+	client bool
+	host   string
+
+	body io.ReadCloser // nil until the header is read
+
+	wmu     sync.Mutex
+	started bool // header sent
+	closed  bool
+}
+
+func (c *httpObfsConn) readHeader() error {
+	if c.client {
+		resp, err := http.ReadResponse(c.br, nil)
+		if err != nil {
+			return err
+		}
+		if resp.StatusCode != http.StatusOK {
+			resp.Body.Close()
+			return fmt.Errorf("unexpected http status: %s", resp.Status)
+		}
+		c.body = resp.Body
+		return nil
+	}
+	req, err := http.ReadRequest(c.br)
+	if err != nil {
+		return err
+	}
+	if req.Method != http.MethodGet {
+		req.Body.Close()
+		return fmt.Errorf("unexpected http method: %s", req.Method)
+	}
+	c.body = req.Body
+	return nil
+}
+
+func (c *httpObfsConn) Read(b []byte) (int, error) {
+	if c.body == nil {
+		if err := c.readHeader(); err != nil {
+			return 0, err
+		}
+	}
+	return c.body.Read(b)
+}
+
+func (c *httpObfsConn) header() []byte {
+	if c.client {
+		return fmt.Appendf(nil, "GET / HTTP/1.1\r\nHost: %s\r\n"+
+			"User-Agent: Mozilla/5.0 (Windows NT 10.0; Win64; x64) AppleWebKit/537.36 (KHTML, like Gecko) Chrome/120.0 Safari/537.36\r\n"+
+			"Accept: */*\r\nTransfer-Encoding: chunked\r\n\r\n", c.host)
+	}
+	return fmt.Appendf(nil, "HTTP/1.1 200 OK\r\nServer: nginx\r\nDate: %s\r\n"+
+		"Content-Type: application/octet-stream\r\nTransfer-Encoding: chunked\r\nConnection: keep-alive\r\n\r\n",
+		time.Now().UTC().Format(http.TimeFormat))
+}
+
+// Write sends b as a single chunk.
+func (c *httpObfsConn) Write(b []byte) (int, error) {
+	if len(b) == 0 {
+		return 0, nil
+	}
+	c.wmu.Lock()
+	defer c.wmu.Unlock()
+	if c.closed {
+		return 0, net.ErrClosed
+	}
+	var out []byte
+	if !c.started {
+		out = c.header()
+		c.started = true
+	}
+	out = strconv.AppendInt(out, int64(len(b)), 16)
+	out = append(out, "\r\n"...)
+	out = append(out, b...)
+	out = append(out, "\r\n"...)
+	if _, err := c.Conn.Write(out); err != nil {
+		return 0, err
+	}
+	return len(b), nil
+}
+
+// Close ends the chunked body, so the peer reads io.EOF.
+func (c *httpObfsConn) Close() error {
+	c.wmu.Lock()
+	if c.started && !c.closed {
+		c.Conn.SetWriteDeadline(time.Now().Add(time.Second))
+		c.Conn.Write([]byte("0\r\n\r\n"))
+	}
+	c.closed = true
+	c.wmu.Unlock()
+	return c.Conn.Close()
+}
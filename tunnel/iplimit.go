@@ -0,0 +1,155 @@
+package tunnel
+
+import (
+	"log/slog"
+	"net"
+	"sync"
+	"time"
+)
+
+// ipLimits caps the connections of each client ip on the server, at once with
+// -ip-max-conns and new ones per minute with -ip-conn-rate, so one abusive
+// client can't take the server from the others.
+var ipLimits = struct {
+	sync.Mutex
+	m     map[string]*ipState
+	swept time.Time
+}{m: make(map[string]*ipState)}
+
+type ipState struct {
+	conns  int
+	tokens float64 // new connections allowed, refilled at -ip-conn-rate
+	last   time.Time
+}
+
+// bans holds the client ips failing the handshake -ban-failures times within
+// -ban-time, which are refused for -ban-time, like fail2ban would.
+var bans = struct {
+	sync.Mutex
+	m     map[string]*banState
+	swept time.Time
+}{m: make(map[string]*banState)}
+
+type banState struct {
+	failures int
+	since    time.Time // of the first failure counted
+	until    time.Time // of the ban
+}
+
+// limitIP wraps handler of server connections in the limits and bans of
+// their client ip, or returns it as is without either.
+func limitIP(handler func(conn net.Conn)) func(conn net.Conn) {
+	if config.IPMaxConns <= 0 && config.IPConnRate <= 0 && config.BanFailures <= 0 {
+		return handler
+	}
+	return func(conn net.Conn) {
+		ip := hostOf(conn.RemoteAddr().String())
+		if banned(ip) {
+			refusedConns.Add(1)
+			conn.Close()
+			return
+		}
+		if !admitIP(ip) {
+			slog.Debug("too many connections from client", "client", conn.RemoteAddr().String())
+			refusedConns.Add(1)
+			conn.Close()
+			return
+		}
+		defer releaseIP(ip)
+		handler(conn)
+	}
+}
+
+func admitIP(ip string) bool {
+	now := time.Now()
+	rate := float64(config.IPConnRate) / 60
+	burst := float64(config.IPConnRate)
+	ipLimits.Lock()
+	defer ipLimits.Unlock()
+	if now.Sub(ipLimits.swept) > time.Minute {
+		sweepIPs(now, rate, burst)
+	}
+	s := ipLimits.m[ip]
+	if s == nil {
+		s = &ipState{tokens: burst, last: now}
+		ipLimits.m[ip] = s
+	}
+	if config.IPMaxConns > 0 && s.conns >= config.IPMaxConns {
+		return false
+	}
+	if config.IPConnRate > 0 {
+		s.tokens = min(burst, s.tokens+now.Sub(s.last).Seconds()*rate)
+		s.last = now
+		if s.tokens < 1 {
+			return false
+		}
+		s.tokens--
+	}
+	s.conns++
+	return true
+}
+
+func releaseIP(ip string) {
+	ipLimits.Lock()
+	if s := ipLimits.m[ip]; s != nil {
+		s.conns--
+	}
+	ipLimits.Unlock()
+}
+
+// sweepIPs forgets the ips without connections whose rate has recovered.
+// ipLimits is locked.
+func sweepIPs(now time.Time, rate, burst float64) {
+	ipLimits.swept = now
+	for ip, s := range ipLimits.m {
+		if s.conns == 0 && (rate == 0 || s.tokens+now.Sub(s.last).Seconds()*rate >= burst) {
+			delete(ipLimits.m, ip)
+		}
+	}
+}
+
+// failIP counts a failed handshake of the client at addr, banning it at
+// -ban-failures.
+func failIP(addr net.Addr) {
+	if config.BanFailures <= 0 {
+		return
+	}
+	ip := hostOf(addr.String())
+	banTime := time.Duration(config.BanTime) * time.Second
+	now := time.Now()
+	bans.Lock()
+	defer bans.Unlock()
+	if now.Sub(bans.swept) > time.Minute {
+		bans.swept = now
+		for ip, b := range bans.m {
+			if now.After(b.until) && now.Sub(b.since) > banTime {
+				delete(bans.m, ip)
+			}
+		}
+	}
+	b := bans.m[ip]
+	if b == nil || now.Sub(b.since) > banTime {
+		b = &banState{since: now}
+		bans.m[ip] = b
+	}
+	if b.failures++; b.failures >= config.BanFailures && now.After(b.until) {
+		b.until = now.Add(banTime)
+		slog.Warn("banned client", "client", ip, "failures", b.failures, "until", b.until.Format(time.RFC3339))
+		b.failures, b.since = 0, now
+	}
+}
+
+func banned(ip string) bool {
+	bans.Lock()
+	defer bans.Unlock()
+	b := bans.m[ip]
+	return b != nil && time.Now().Before(b.until)
+}
+
+// hostOf returns the host of addr, or addr when it has no port.
+func hostOf(addr string) string {
+	if host, _, err := net.SplitHostPort(addr); err == nil {
+		return host
+	}
+	return addr
+}
@@ -0,0 +1,145 @@
+package tunnel
+
+import (
+	"errors"
+	"fmt"
+	"io"
+	"net"
+	"sync"
+	"time"
+
+	"github.com/xtaci/kcp-go/v5"
+)
+
+// kcpTransport carries the tunnel over KCP, an ARQ protocol on udp that keeps
+// its throughput on lossy links where tcp collapses. Forward error correction
+// adds parity packets, so some losses are recovered without retransmission.
+// Both sides need the same shards settings.
+//
+// KCP has no handshake, a dial "succeeds" whether or not a server answers:
+// the client sends kcpHello first and waits for the server to echo it, so a
+// dead server fails the dial instead of the first read of the tunnel.
+type kcpTransport struct {
+	window       int
+	dataShards   int
+	parityShards int
+}
+
+func NewKCPTransport(window, dataShards, parityShards int) *kcpTransport {
+	return &kcpTransport{window: window, dataShards: dataShards, parityShards: parityShards}
+}
+
+// tune sets the "fast" mode of kcptun: no delay, 10ms interval, fast resend
+// and no congestion control.
+func (t *kcpTransport) tune(s *kcp.UDPSession) {
+	s.SetStreamMode(true)
+	s.SetWriteDelay(false)
+	s.SetNoDelay(1, 10, 2, 1)
+	s.SetWindowSize(t.window, t.window)
+	s.SetMtu(1350)
+	s.SetACKNoDelay(true)
+}
+
+const kcpHello = 'k'
+
+// kcpHandshakeTimeout bounds the hello without -dial-timeout, udp has no
+// limit of the system.
+const kcpHandshakeTimeout = 10 * time.Second
+
+func (t *kcpTransport) Dial(addr string) (net.Conn, error) {
+	s, err := kcp.DialWithOptions(addr, nil, t.dataShards, t.parityShards)
+	if err != nil {
+		return nil, err
+	}
+	t.tune(s)
+	timeout := dialTimeout
+	if timeout <= 0 {
+		timeout = kcpHandshakeTimeout
+	}
+	s.SetDeadline(time.Now().Add(timeout))
+	hello := []byte{kcpHello}
+	if _, err = s.Write(hello); err == nil {
+		_, err = io.ReadFull(s, hello)
+	}
+	if err == nil && hello[0] != kcpHello {
+		err = errors.New("bad hello")
+	}
+	if err != nil {
+		s.Close()
+		return nil, fmt.Errorf("kcp handshake with %s: %v", addr, err)
+	}
+	s.SetDeadline(time.Time{})
+	return s, nil
+}
+
+func (t *kcpTransport) Listen(addr string) (net.Listener, error) {
+	pc, err := listenUDP(addr)
+	if err != nil {
+		return nil, err
+	}
+	ln, err := kcp.ServeConn(nil, t.dataShards, t.parityShards, pc)
+	if err != nil {
+		pc.Close()
+		return nil, err
+	}
+	return &kcpListener{Listener: ln, pc: pc, t: t}, nil
+}
+
+type kcpListener struct {
+	*kcp.Listener
+	pc net.PacketConn
+	t  *kcpTransport
+}
+
+// Close closes the socket too, which kcp leaves open when given one.
+func (l *kcpListener) Close() error {
+	err := l.Listener.Close()
+	l.pc.Close()
+	return err
+}
+
+func (l *kcpListener) Accept() (net.Conn, error) {
+	s, err := l.AcceptKCP()
+	if err != nil {
+		return nil, err
+	}
+	l.t.tune(s)
+	return &kcpServerConn{UDPSession: s}, nil
+}
+
+// kcpServerConn echoes the hello of the client before its first read or
+// write, which run under the deadlines of the request.
+type kcpServerConn struct {
+	*kcp.UDPSession
+	once sync.Once
+	err  error
+}
+
+func (c *kcpServerConn) greet() error {
+	c.once.Do(func() {
+		hello := []byte{0}
+		if _, c.err = io.ReadFull(c.UDPSession, hello); c.err != nil {
+			return
+		}
+		if hello[0] != kcpHello {
+			c.err = errors.New("kcp: bad hello")
+			return
+		}
+		_, c.err = c.UDPSession.Write(hello)
+	})
+	return c.err
+}
+
+func (c *kcpServerConn) Read(b []byte) (int, error) {
+	if err := c.greet(); err != nil {
+		return 0, err
+	}
+	return c.UDPSession.Read(b)
+}
+
+func (c *kcpServerConn) Write(b []byte) (int, error) {
+	if err := c.greet(); err != nil {
+		return 0, err
+	}
+	return c.UDPSession.Write(b)
+}
@@ -0,0 +1,77 @@
+package tunnel
+
+import (
+	"sync"
+	"time"
+)
+
+// Limiter is a token bucket capping throughput at rate bytes per second. It
+// is shared by all relays, or kept by one for the per connection limits. A
+// nil Limiter, or one with rate 0, doesn't limit anything.
+type Limiter struct {
+	sync.Mutex
+	rate   float64
+	burst  float64
+	tokens float64
+	last   time.Time
+}
+
+// upLimiter and downLimiter cap the whole process, their rates can be changed
+// at runtime by the admin api.
+var upLimiter, downLimiter = &Limiter{}, &Limiter{}
+
+func NewLimiter(rate int) *Limiter {
+	if rate <= 0 {
+		return nil
+	}
+	l := &Limiter{}
+	l.SetRate(rate)
+	return l
+}
+
+// SetRate changes the rate to rate bytes per second, 0 for unlimited.
+func (l *Limiter) SetRate(rate int) {
+	if rate < 0 {
+		rate = 0
+	}
+	burst := float64(rate)
+	if burst < bufSize {
+		burst = bufSize
+	}
+	l.Lock()
+	l.rate, l.burst, l.tokens, l.last = float64(rate), burst, burst, time.Now()
+	l.Unlock()
+}
+
+// Rate returns the rate in bytes per second, 0 for unlimited.
+func (l *Limiter) Rate() int {
+	l.Lock()
+	defer l.Unlock()
+	return int(l.rate)
+}
+
+// Wait blocks until n more bytes may be relayed.
+func (l *Limiter) Wait(n int) {
+	if l == nil {
+		return
+	}
+	l.Lock()
+	if l.rate == 0 {
+		l.Unlock()
+		return
+	}
+	now := time.Now()
+	l.tokens += now.Sub(l.last).Seconds() * l.rate
+	if l.tokens > l.burst {
+		l.tokens = l.burst
+	}
+	l.last = now
+	// go into debt, later callers wait for it to be paid off first
+	l.tokens -= float64(n)
+	var d time.Duration
+	if l.tokens < 0 {
+		d = time.Duration(-l.tokens / l.rate * float64(time.Second))
+	}
+	l.Unlock()
+	time.Sleep(d)
+}
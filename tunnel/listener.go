@@ -0,0 +1,136 @@
+package tunnel
+
+import (
+	"fmt"
+	"log/slog"
+	"net"
+	"strings"
+	"sync"
+)
+
+// A tunnel listener takes the tunnel connections whose target is its address
+// instead of the server dialing it, so a service embedding the server can be
+// reached only through the tunnel.
+type tunnelListener struct {
+	addr   tunnelAddr
+	conns  chan net.Conn
+	closed chan struct{}
+	once   sync.Once
+}
+
+type tunnelAddr struct {
+	network string
+	addr    string
+}
+
+func (a tunnelAddr) Network() string { return a.network }
+func (a tunnelAddr) String() string  { return a.addr }
+
+var tunnelListeners = struct {
+	sync.Mutex
+	m map[string]*tunnelListener
+}{m: make(map[string]*tunnelListener)}
+
+// listenerKey makes addr comparable with the target hosts, whose domains may
+// come in any case.
+func listenerKey(addr string) (string, error) {
+	host, port, err := net.SplitHostPort(addr)
+	if err != nil {
+		return "", err
+	}
+	return net.JoinHostPort(strings.ToLower(host), port), nil
+}
+
+// Listen returns a listener for the tunnel connections to addr, which the
+// server then never dials. addr is matched against the targets the clients
+// ask for, it needn't resolve or be a local address. network must be tcp,
+// tcp4 or tcp6.
+func (s *Server) Listen(network, addr string) (net.Listener, error) {
+	switch network {
+	case "tcp", "tcp4", "tcp6":
+	default:
+		return nil, &net.OpError{Op: "listen", Net: network, Err: errNetwork}
+	}
+	key, err := listenerKey(addr)
+	if err != nil {
+		return nil, err
+	}
+	tunnelListeners.Lock()
+	defer tunnelListeners.Unlock()
+	if _, ok := tunnelListeners.m[key]; ok {
+		return nil, fmt.Errorf("tunnel listener at %s already exists", addr)
+	}
+	l := &tunnelListener{
+		addr:   tunnelAddr{network, key},
+		conns:  make(chan net.Conn),
+		closed: make(chan struct{}),
+	}
+	tunnelListeners.m[key] = l
+	return l, nil
+}
+
+// lookupListener returns the tunnel listener for tgtHost, or nil.
+func lookupListener(tgtHost string) *tunnelListener {
+	key, err := listenerKey(tgtHost)
+	if err != nil {
+		return nil
+	}
+	tunnelListeners.Lock()
+	defer tunnelListeners.Unlock()
+	return tunnelListeners.m[key]
+}
+
+func (l *tunnelListener) Accept() (net.Conn, error) {
+	select {
+	case conn := <-l.conns:
+		return conn, nil
+	case <-l.closed:
+		return nil, &net.OpError{Op: "accept", Net: l.addr.network, Addr: l.addr, Err: net.ErrClosed}
+	}
+}
+
+func (l *tunnelListener) Close() error {
+	l.once.Do(func() {
+		tunnelListeners.Lock()
+		delete(tunnelListeners.m, l.addr.addr)
+		tunnelListeners.Unlock()
+		close(l.closed)
+	})
+	return nil
+}
+
+func (l *tunnelListener) Addr() net.Addr {
+	return l.addr
+}
+
+// serve hands conn to Accept and waits until it is closed there, the caller
+// closes the tunnel connection after.
+func (l *tunnelListener) serve(conn net.Conn) {
+	ac := &acceptedConn{Conn: conn, addr: l.addr, done: make(chan struct{})}
+	select {
+	case l.conns <- ac:
+	case <-l.closed:
+		return
+	}
+	slog.Debug("accepted", "client", conn.RemoteAddr().String(), "listener", l.addr.addr)
+	<-ac.done
+}
+
+type acceptedConn struct {
+	net.Conn
+	addr tunnelAddr
+	once sync.Once
+	done chan struct{}
+}
+
+func (c *acceptedConn) Close() error {
+	c.once.Do(func() { close(c.done) })
+	return c.Conn.Close()
+}
+
+func (c *acceptedConn) CloseWrite() error { return closeWrite(c.Conn) }
+func (c *acceptedConn) CloseRead() error  { return closeRead(c.Conn) }
+
+func (c *acceptedConn) LocalAddr() net.Addr {
+	return c.addr
+}
@@ -0,0 +1,118 @@
+package tunnel
+
+import (
+	"context"
+	"fmt"
+	"io"
+	"log/slog"
+	"os"
+	"strings"
+	"sync"
+)
+
+// logOutput is where the handler of Run writes, it can be swapped while
+// running as the log file is reopened.
+var logOutput = &swapWriter{w: os.Stderr}
+
+type swapWriter struct {
+	sync.Mutex
+	w io.Writer
+}
+
+func (s *swapWriter) Write(p []byte) (int, error) {
+	s.Lock()
+	defer s.Unlock()
+	return s.w.Write(p)
+}
+
+// SetLogOutput sends the log of Run to w, os.Stderr by default.
+func SetLogOutput(w io.Writer) {
+	logOutput.Lock()
+	logOutput.w = w
+	logOutput.Unlock()
+}
+
+// logLevel is the level of the log, changed at runtime by the control socket.
+var logLevel slog.LevelVar
+
+// setLogLevel sets the level of the log to debug, info, warn or error.
+func setLogLevel(level string) error {
+	var l slog.Level
+	if err := l.UnmarshalText([]byte(level)); err != nil {
+		return fmt.Errorf("invalid log level %q", level)
+	}
+	logLevel.Set(l)
+	return nil
+}
+
+// initLog makes slog log at level in format text or json to target, stderr
+// or syslog, the log package goes through it as well. Debug adds the
+// handshakes, info has a summary of each connection.
+func initLog(level, format, target string) error {
+	if err := setLogLevel(level); err != nil {
+		return err
+	}
+	opts := &slog.HandlerOptions{Level: &logLevel}
+	var w io.Writer = logOutput
+	var sw *syslogWriter
+	switch {
+	case target == "" || target == "stderr":
+	case target == "syslog" || strings.HasPrefix(target, "syslog://") || strings.HasPrefix(target, "syslog+tcp://"):
+		var err error
+		if sw, err = dialSyslog(target); err != nil {
+			return fmt.Errorf("syslog: %v", err)
+		}
+		w = sw
+		// syslog stamps the time itself
+		opts.ReplaceAttr = func(groups []string, a slog.Attr) slog.Attr {
+			if a.Key == slog.TimeKey && len(groups) == 0 {
+				return slog.Attr{}
+			}
+			return a
+		}
+	default:
+		return fmt.Errorf("invalid log target %q", target)
+	}
+	var h slog.Handler
+	switch strings.ToLower(format) {
+	case "", "text":
+		h = slog.NewTextHandler(w, opts)
+	case "json":
+		h = slog.NewJSONHandler(w, opts)
+	default:
+		return fmt.Errorf("invalid log format %q", format)
+	}
+	if sw != nil {
+		h = &syslogHandler{Handler: h, w: sw}
+	}
+	slog.SetDefault(slog.New(h))
+	return nil
+}
+
+// syslogHandler passes the level of each record to the syslog writer its
+// handler formats into, for the severity.
+type syslogHandler struct {
+	slog.Handler
+	w *syslogWriter
+}
+
+func (h *syslogHandler) Handle(ctx context.Context, r slog.Record) error {
+	h.w.Lock()
+	defer h.w.Unlock()
+	h.w.level = r.Level
+	return h.Handler.Handle(ctx, r)
+}
+
+func (h *syslogHandler) WithAttrs(attrs []slog.Attr) slog.Handler {
+	return &syslogHandler{Handler: h.Handler.WithAttrs(attrs), w: h.w}
+}
+
+func (h *syslogHandler) WithGroup(name string) slog.Handler {
+	return &syslogHandler{Handler: h.Handler.WithGroup(name), w: h.w}
+}
+
+// fatal logs an error and exits, like log.Fatal.
+func fatal(msg string, args ...any) {
+	slog.Error(msg, args...)
+	os.Exit(1)
+}
@@ -0,0 +1,106 @@
+package tunnel
+
+import (
+	"errors"
+	"net"
+	"strconv"
+	"sync"
+	"sync/atomic"
+	"syscall"
+)
+
+// errLoop is the dial error of a target that is one of the listeners of the
+// process, each connection to which would dial it again.
+var errLoop = errors.New("target is the proxy itself")
+
+var loops atomic.Uint64
+
+// listenAddrs are the tcp addresses being served.
+var listenAddrs = struct {
+	sync.Mutex
+	m map[*net.TCPAddr]struct{}
+}{m: make(map[*net.TCPAddr]struct{})}
+
+// addListenAddr adds addr to the addresses being served, until remove.
+func addListenAddr(addr net.Addr) (remove func()) {
+	a, ok := addr.(*net.TCPAddr)
+	if !ok {
+		return func() {}
+	}
+	listenAddrs.Lock()
+	listenAddrs.m[a] = struct{}{}
+	listenAddrs.Unlock()
+	return func() {
+		listenAddrs.Lock()
+		delete(listenAddrs.m, a)
+		listenAddrs.Unlock()
+	}
+}
+
+// isListenAddr reports whether ip:port reaches an address being served.
+func isListenAddr(ip net.IP, port int) bool {
+	var wildcard bool
+	listenAddrs.Lock()
+	for a := range listenAddrs.m {
+		if a.Port != port {
+			continue
+		}
+		if a.IP.Equal(ip) {
+			listenAddrs.Unlock()
+			return true
+		}
+		wildcard = wildcard || a.IP == nil || a.IP.IsUnspecified()
+	}
+	listenAddrs.Unlock()
+	if !wildcard {
+		return false
+	}
+	if ip.IsLoopback() || ip.IsUnspecified() {
+		return true
+	}
+	addrs, err := net.InterfaceAddrs()
+	if err != nil {
+		return false
+	}
+	for _, a := range addrs {
+		if n, ok := a.(*net.IPNet); ok && n.IP.Equal(ip) {
+			return true
+		}
+	}
+	return false
+}
+
+// checkLoop returns errLoop, counted, if the host:port target reaches an
+// address being served. Host names are left to loopControl once resolved,
+// but for localhost.
+func checkLoop(target string) error {
+	host, p, err := net.SplitHostPort(target)
+	if err != nil {
+		return nil
+	}
+	port, _ := strconv.Atoi(p)
+	ip := net.ParseIP(host)
+	if host == "localhost" {
+		ip = net.IPv4(127, 0, 0, 1)
+	}
+	if ip != nil && isListenAddr(ip, port) {
+		loops.Add(1)
+		return errLoop
+	}
+	return nil
+}
+
+// loopControl is the net.Dialer Control of the targets, checking the
+// addresses they resolved to.
+func loopControl(network, address string, c syscall.RawConn) error {
+	host, p, err := net.SplitHostPort(address)
+	if err != nil {
+		return err
+	}
+	port, _ := strconv.Atoi(p)
+	if isListenAddr(net.ParseIP(host), port) {
+		loops.Add(1)
+		return errLoop
+	}
+	return nil
+}
@@ -0,0 +1,269 @@
+package tunnel
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"log/slog"
+	"net"
+	"os"
+	"sort"
+	"strconv"
+	"strings"
+	"sync"
+	"sync/atomic"
+	"time"
+)
+
+// The manager speaks the protocol of shadowsocks' ss-manager on a udp or unix
+// datagram socket, so panels can add and remove the ports of users:
+//
+//	add: {"server_port": 8001, "password": "7cd308cc059", "method": "aes-256-gcm"}
+//	remove: {"server_port": 8001}
+//	list
+//	ping
+//
+// add and remove answer ok, ping pong, and from then on the manager sends the
+// pinging client the bytes of each port since the last time, every 10s:
+//
+//	stat: {"8001": 11370}
+const managerStatInterval = 10 * time.Second
+
+type managedPort struct {
+	port  int
+	keys  atomic.Pointer[keys]
+	ln    net.Listener
+	bytes atomic.Int64 // read and written on the port
+
+	reported int64 // bytes at the last stat
+
+	sync.Mutex
+	conns map[net.Conn]struct{}
+}
+
+var managedPorts = struct {
+	sync.Mutex
+	m map[int]*managedPort
+}{m: make(map[int]*managedPort)}
+
+type managerRequest struct {
+	Port     int    `json:"server_port"`
+	Password string `json:"password"`
+	Method   string `json:"method"`
+}
+
+// serveManager serves the manager at addr, host:port for udp or the path of a
+// unix socket.
+func serveManager(ctx context.Context, addr string) {
+	var pc net.PacketConn
+	var err error
+	if path, ok := unixPath(addr); ok {
+		os.Remove(path)
+		pc, err = net.ListenPacket("unixgram", path)
+	} else {
+		pc, err = listenUDP(addr)
+	}
+	if err != nil {
+		slog.Error("manager error", "err", err)
+		return
+	}
+	context.AfterFunc(ctx, func() { pc.Close() })
+	slog.Info("manager listening", "addr", addr)
+
+	var client atomic.Pointer[net.Addr]
+	go func() {
+		tick := time.NewTicker(managerStatInterval)
+		defer tick.Stop()
+		for {
+			select {
+			case <-tick.C:
+			case <-ctx.Done():
+				return
+			}
+			if a := client.Load(); a != nil {
+				sendStats(pc, *a)
+			}
+		}
+	}()
+
+	buf := make([]byte, 1506)
+	for {
+		n, from, err := pc.ReadFrom(buf)
+		if err != nil {
+			if ctx.Err() == nil {
+				slog.Error("manager read error", "err", err)
+			}
+			return
+		}
+		cmd, arg, _ := strings.Cut(string(buf[:n]), ":")
+		reply, err := managerCommand(ctx, strings.TrimSpace(cmd), []byte(arg))
+		if err != nil {
+			slog.Warn("manager command error", "cmd", cmd, "err", err)
+			reply = "err"
+		}
+		if strings.TrimSpace(cmd) == "ping" {
+			client.Store(&from)
+		}
+		pc.WriteTo([]byte(reply), from)
+	}
+}
+
+func managerCommand(ctx context.Context, cmd string, arg []byte) (string, error) {
+	switch cmd {
+	case "ping":
+		return "pong", nil
+	case "list":
+		managedPorts.Lock()
+		ports := make([]*managedPort, 0, len(managedPorts.m))
+		for _, p := range managedPorts.m {
+			ports = append(ports, p)
+		}
+		managedPorts.Unlock()
+		sort.Slice(ports, func(i, j int) bool { return ports[i].port < ports[j].port })
+		// without the passwords, which only the panel needs to know
+		list := []map[string]string{}
+		for _, p := range ports {
+			list = append(list, map[string]string{
+				"server_port": strconv.Itoa(p.port),
+				"method":      p.keys.Load().method,
+			})
+		}
+		b, _ := json.Marshal(list)
+		return string(b), nil
+	case "add", "remove":
+	default:
+		return "", fmt.Errorf("unknown command %q", cmd)
+	}
+	var req managerRequest
+	if err := json.Unmarshal(bytes.TrimRight(arg, "\x00"), &req); err != nil {
+		return "", err
+	}
+	if req.Port <= 0 || req.Port > 65535 {
+		return "", errors.New("invalid server_port")
+	}
+	if cmd == "remove" {
+		removePort(req.Port)
+		return "ok", nil
+	}
+	k := &keys{method: req.Method, password: req.Password, allowPorts: config.AllowPorts, blockPorts: config.BlockPorts, allowPrivate: config.AllowPrivate}
+	if k.method == "" {
+		k.method = config.Method
+	}
+	if err := k.check(); err != nil {
+		return "", err
+	}
+	return "ok", addPort(ctx, req.Port, k)
+}
+
+// addPort serves a tunnel at port with k, or changes the keys of the port
+// when it is served already. The ports of port_password are added once at
+// start.
+func addPort(ctx context.Context, port int, k *keys) error {
+	managedPorts.Lock()
+	defer managedPorts.Unlock()
+	if p, ok := managedPorts.m[port]; ok {
+		p.keys.Store(k)
+		return nil
+	}
+	host := ""
+	if config.ServerAddr != "" {
+		host, _, _ = net.SplitHostPort(firstAddr(config.ServerAddr))
+	}
+	addr := net.JoinHostPort(host, strconv.Itoa(port))
+	ln, err := transport.Listen(addr)
+	if err != nil {
+		return err
+	}
+	p := &managedPort{port: port, ln: ln, conns: make(map[net.Conn]struct{})}
+	p.keys.Store(k)
+	managedPorts.m[port] = p
+	slog.Info("added port", "addr", addr)
+	go serve(ctx, ln, limitIP(p.handle))
+	return nil
+}
+
+// removePort stops serving port and closes its connections.
+func removePort(port int) {
+	managedPorts.Lock()
+	p, ok := managedPorts.m[port]
+	delete(managedPorts.m, port)
+	managedPorts.Unlock()
+	if !ok {
+		return
+	}
+	p.ln.Close()
+	p.Lock()
+	for c := range p.conns {
+		c.Close()
+	}
+	p.Unlock()
+	slog.Info("removed port", "port", port)
+}
+
+func (p *managedPort) handle(c net.Conn) {
+	p.Lock()
+	p.conns[c] = struct{}{}
+	p.Unlock()
+	defer func() {
+		p.Lock()
+		delete(p.conns, c)
+		p.Unlock()
+	}()
+	handleServerKeys(&countConn{Conn: c, n: &p.bytes}, p.keys.Load())
+}
+
+// sendStats sends the bytes of each port with traffic since the last time.
+func sendStats(pc net.PacketConn, to net.Addr) {
+	stats := make(map[string]int64)
+	managedPorts.Lock()
+	for _, p := range managedPorts.m {
+		n := p.bytes.Load()
+		if n > p.reported {
+			stats[strconv.Itoa(p.port)] = n - p.reported
+			p.reported = n
+		}
+	}
+	managedPorts.Unlock()
+	if len(stats) == 0 {
+		return
+	}
+	b, _ := json.Marshal(stats)
+	pc.WriteTo(append([]byte("stat: "), b...), to)
+}
+
+// countConn counts the bytes read and written.
+type countConn struct {
+	net.Conn
+	n *atomic.Int64
+}
+
+func (c *countConn) Read(b []byte) (int, error) {
+	n, err := c.Conn.Read(b)
+	c.n.Add(int64(n))
+	return n, err
+}
+
+func (c *countConn) CloseWrite() error { return closeWrite(c.Conn) }
+func (c *countConn) CloseRead() error  { return closeRead(c.Conn) }
+
+func (c *countConn) Write(b []byte) (int, error) {
+	n, err := c.Conn.Write(b)
+	c.n.Add(int64(n))
+	return n, err
+}
+
+// portBytes returns the bytes of each served port, ordered by port.
+func portBytes() (ports []int, bytes []int64) {
+	managedPorts.Lock()
+	for port := range managedPorts.m {
+		ports = append(ports, port)
+	}
+	sort.Ints(ports)
+	for _, port := range ports {
+		bytes = append(bytes, managedPorts.m[port].bytes.Load())
+	}
+	managedPorts.Unlock()
+	return ports, bytes
+}
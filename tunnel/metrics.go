@@ -0,0 +1,130 @@
+package tunnel
+
+import (
+	"errors"
+	"fmt"
+	"io"
+	"log/slog"
+	"net/http"
+	"sync/atomic"
+
+	"github.com/daogan/socksproxy/cipher"
+)
+
+var (
+	handshakeFailures atomic.Uint64
+	dialErrors        atomic.Uint64
+	cipherErrors      atomic.Uint64
+	refusedConns      atomic.Uint64
+)
+
+// countHandshakeError counts a tunnel connection failing before its target,
+// and separately the ones that didn't decrypt or were replayed. Connections
+// closed before sending anything, like the probes, aren't counted.
+func countHandshakeError(err error) {
+	if err == io.EOF {
+		return
+	}
+	handshakeFailures.Add(1)
+	if errors.Is(err, cipher.ErrDecrypt) || errors.Is(err, cipher.ErrReplay) {
+		cipherErrors.Add(1)
+	}
+}
+
+// countDialError counts a failed dial, targets rejected by the rules aren't.
+func countDialError(err error) {
+	if !errors.Is(err, errRejected) {
+		dialErrors.Add(1)
+	}
+}
+
+// serveMetrics serves the counters at addr in the prometheus text format.
+func serveMetrics(addr string) {
+	ln, err := listenTCP(addr)
+	if err != nil {
+		slog.Error("metrics server error", "err", err)
+		return
+	}
+	mux := http.NewServeMux()
+	mux.HandleFunc("/metrics", func(w http.ResponseWriter, r *http.Request) {
+		w.Header().Set("Content-Type", "text/plain; version=0.0.4")
+		writeMetrics(w)
+	})
+	slog.Info("serving metrics", "url", "http://"+addr+"/metrics")
+	go func() {
+		if err := http.Serve(ln, mux); err != nil {
+			slog.Error("metrics server error", "err", err)
+		}
+	}()
+}
+
+func writeMetrics(w io.Writer) {
+	metric := func(name, typ, help string) {
+		fmt.Fprintf(w, "# HELP socksproxy_%s %s\n# TYPE socksproxy_%s %s\n", name, help, name, typ)
+	}
+	active, total, up, down := sessions.stats()
+	metric("active_connections", "gauge", "Connections being relayed.")
+	fmt.Fprintf(w, "socksproxy_active_connections %d\n", active)
+	metric("connections_total", "counter", "Connections relayed.")
+	fmt.Fprintf(w, "socksproxy_connections_total %d\n", total)
+	metric("bytes_total", "counter", "Bytes relayed, up from the clients and down to them.")
+	fmt.Fprintf(w, "socksproxy_bytes_total{direction=\"up\"} %d\n", up)
+	fmt.Fprintf(w, "socksproxy_bytes_total{direction=\"down\"} %d\n", down)
+	metric("handshake_failures_total", "counter", "Connections failing before their target was known.")
+	fmt.Fprintf(w, "socksproxy_handshake_failures_total %d\n", handshakeFailures.Load())
+	metric("dial_errors_total", "counter", "Targets or servers that couldn't be connected.")
+	fmt.Fprintf(w, "socksproxy_dial_errors_total %d\n", dialErrors.Load())
+	metric("cipher_errors_total", "counter", "Tunnel connections that didn't decrypt or were replayed.")
+	fmt.Fprintf(w, "socksproxy_cipher_errors_total %d\n", cipherErrors.Load())
+	if connSlots != nil || config.IPMaxConns > 0 || config.IPConnRate > 0 || config.BanFailures > 0 || activeACL.Load() != nil {
+		metric("refused_connections_total", "counter", "Connections refused for -max-conns, -allow and -deny or the limits and bans of their ip.")
+		fmt.Fprintf(w, "socksproxy_refused_connections_total %d\n", refusedConns.Load())
+	}
+	metric("udp_mappings", "gauge", "Udp associations the server has a socket open for.")
+	fmt.Fprintf(w, "socksproxy_udp_mappings %d\n", udpMappings())
+	if config.UDPMaxMappings > 0 {
+		metric("udp_mappings_refused_total", "counter", "Udp associations refused for -udp-max-mappings.")
+		fmt.Fprintf(w, "socksproxy_udp_mappings_refused_total %d\n", udpRefused.Load())
+	}
+	metric("blocked_targets_total", "counter", "Targets the server didn't dial, for their port or their private address.")
+	fmt.Fprintf(w, "socksproxy_blocked_targets_total{reason=\"port\"} %d\n", blockedPorts.Load())
+	fmt.Fprintf(w, "socksproxy_blocked_targets_total{reason=\"private\"} %d\n", blockedPrivate.Load())
+	metric("loops_total", "counter", "Targets refused for being the listeners of the proxy itself.")
+	fmt.Fprintf(w, "socksproxy_loops_total %d\n", loops.Load())
+	if config.DNSCheck != "" {
+		metric("dns_hijacks_total", "counter", "Names the local dns answered unlike the -dns-check upstreams.")
+		fmt.Fprintf(w, "socksproxy_dns_hijacks_total %d\n", dnsHijacks.Load())
+	}
+	if replayCache != nil {
+		metric("replays_total", "counter", "Tunnel connections rejected as replays.")
+		fmt.Fprintf(w, "socksproxy_replays_total %d\n", replayCache.Rejected())
+	}
+
+	if ports, bytes := portBytes(); len(ports) > 0 {
+		metric("port_bytes_total", "counter", "Bytes read and written on the ports of the users.")
+		for i, port := range ports {
+			fmt.Fprintf(w, "socksproxy_port_bytes_total{port=\"%d\"} %d\n", port, bytes[i])
+		}
+	}
+
+	p := activePool.Load()
+	if p == nil {
+		return
+	}
+	metric("server_up", "gauge", "Whether the circuit of the server is closed.")
+	for _, k := range p.servers {
+		v := 0
+		if serverHealth.up(k.server) {
+			v = 1
+		}
+		fmt.Fprintf(w, "socksproxy_server_up{server=%q} %d\n", k.server, v)
+	}
+	metric("server_rtt_seconds", "gauge", "Connect time of the last probe of the server.")
+	serverHealth.Lock()
+	for _, k := range p.servers {
+		if s, ok := serverHealth.servers[k.server]; ok && s.probed {
+			fmt.Fprintf(w, "socksproxy_server_rtt_seconds{server=%q} %g\n", k.server, s.rtt.Seconds())
+		}
+	}
+	serverHealth.Unlock()
+}
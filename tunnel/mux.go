@@ -0,0 +1,104 @@
+package tunnel
+
+import (
+	"log"
+	"log/slog"
+	"net"
+	"sync"
+
+	"github.com/daogan/socksproxy/socks5"
+	"github.com/hashicorp/yamux"
+)
+
+// With -mux the local side keeps a few tunnel connections to the magic target
+// muxHost, each carrying a yamux session. Every stream of a session starts
+// with the target address, like a tunnel connection does. The server always
+// accepts mux sessions.
+const muxHost = "sp.mux.arpa:0"
+
+type muxPool struct {
+	sync.Mutex
+	sessions []*muxSession
+	next     int
+}
+
+type muxSession struct {
+	*yamux.Session
+	server string
+}
+
+var muxSessions = &muxPool{}
+
+func muxConfig() *yamux.Config {
+	cfg := yamux.DefaultConfig()
+	cfg.LogOutput = log.Writer()
+	return cfg
+}
+
+// dial opens a stream to tgtAddr, spreading the streams over config.Mux
+// sessions.
+func (m *muxPool) dial(tgtAddr []byte) (net.Conn, string, error) {
+	s, err := m.session()
+	if err != nil {
+		return nil, "", err
+	}
+	stream, err := s.OpenStream()
+	if err != nil {
+		s.Close()
+		return nil, s.server, err
+	}
+	if _, err = stream.Write(tgtAddr); err != nil {
+		stream.Close()
+		return nil, s.server, err
+	}
+	return stream, s.server, nil
+}
+
+// session returns the next session, opening it again if it is closed.
+func (m *muxPool) session() (*muxSession, error) {
+	m.Lock()
+	defer m.Unlock()
+	if m.sessions == nil {
+		m.sessions = make([]*muxSession, config.Mux)
+	}
+	i := m.next % len(m.sessions)
+	m.next++
+	if s := m.sessions[i]; s != nil && !s.IsClosed() {
+		return s, nil
+	}
+	tgtAddr, _ := socks5.EncodeAddr(muxHost)
+	conn, server, err := dialServer(tgtAddr)
+	if err != nil {
+		return nil, err
+	}
+	sess, err := yamux.Client(conn, muxConfig())
+	if err != nil {
+		conn.Close()
+		return nil, err
+	}
+	slog.Info("mux session", "server", server)
+	m.sessions[i] = &muxSession{Session: sess, server: server}
+	return m.sessions[i], nil
+}
+
+// handleMuxServer serves the streams of a mux session, dialing the target
+// ports eg allows.
+func handleMuxServer(conn net.Conn, eg *egress) {
+	sess, err := yamux.Server(conn, muxConfig())
+	if err != nil {
+		slog.Warn("fail to start mux session", "err", err)
+		return
+	}
+	defer sess.Close()
+	slog.Debug("mux session", "client", conn.RemoteAddr().String())
+	for {
+		stream, err := sess.AcceptStream()
+		if err != nil {
+			return
+		}
+		go func() {
+			defer stream.Close()
+			serveTunnel(stream, eg)
+		}()
+	}
+}
@@ -0,0 +1,157 @@
+package tunnel
+
+import (
+	"bufio"
+	"errors"
+	"fmt"
+	"io"
+	"log/slog"
+	"net"
+	"os"
+	"os/exec"
+	"strings"
+	"sync"
+
+	"github.com/daogan/socksproxy/socks5"
+)
+
+// obfs4 is bridged through an external obfs4proxy binary speaking the tor
+// pluggable transport protocol (pt-spec.txt). On the local side the tunnel is
+// dialed through the socks5 listener obfs4proxy exposes, on the server side
+// obfs4proxy terminates obfs4 and forwards the stream to a loopback listener.
+type obfs4Transport struct {
+	bin   string
+	state string
+	args  string
+
+	once      sync.Once
+	socksAddr string
+	err       error
+
+	stdin io.WriteCloser // obfs4proxy exits once this is closed
+}
+
+func NewObfs4Transport(bin, state, bridge string) (*obfs4Transport, error) {
+	if bin == "" {
+		bin = "obfs4proxy"
+	}
+	if _, err := exec.LookPath(bin); err != nil {
+		return nil, fmt.Errorf("obfs4proxy not found: %v", err)
+	}
+	return &obfs4Transport{bin: bin, state: state, args: parseBridgeArgs(bridge)}, nil
+}
+
+// parseBridgeArgs extracts the key=value parameters from a bridge line such as
+// "obfs4 1.2.3.4:443 FINGERPRINT cert=... iat-mode=0", and encodes them as
+// socks args: "cert=...;iat-mode=0".
+func parseBridgeArgs(bridge string) string {
+	var args []string
+	f := func(r rune) bool { return r == ' ' || r == '\t' || r == ',' }
+	for _, field := range strings.FieldsFunc(bridge, f) {
+		if strings.Contains(field, "=") {
+			field = strings.NewReplacer(`\`, `\\`, `;`, `\;`).Replace(field)
+			args = append(args, field)
+		}
+	}
+	return strings.Join(args, ";")
+}
+
+// start launches obfs4proxy and returns the fields of the CMETHOD/SMETHOD
+// line announced for obfs4.
+func (t *obfs4Transport) start(env ...string) (method []string, err error) {
+	cmd := exec.Command(t.bin)
+	cmd.Env = append(os.Environ(),
+		"TOR_PT_MANAGED_TRANSPORT_VER=1",
+		"TOR_PT_STATE_LOCATION="+t.state,
+		"TOR_PT_EXIT_ON_STDIN_CLOSE=1")
+	cmd.Env = append(cmd.Env, env...)
+	cmd.Stderr = os.Stderr
+	if t.stdin, err = cmd.StdinPipe(); err != nil {
+		return
+	}
+	stdout, err := cmd.StdoutPipe()
+	if err != nil {
+		return
+	}
+	if err = cmd.Start(); err != nil {
+		return
+	}
+	scanner := bufio.NewScanner(stdout)
+	for scanner.Scan() {
+		fields := strings.Fields(scanner.Text())
+		if len(fields) == 0 {
+			continue
+		}
+		switch fields[0] {
+		case "CMETHOD", "SMETHOD":
+			if len(fields) >= 3 && fields[1] == "obfs4" {
+				method = fields
+			}
+		case "CMETHODS", "SMETHODS":
+			if method == nil {
+				cmd.Process.Kill()
+				return nil, errors.New("obfs4proxy does not support obfs4")
+			}
+			// keep draining so obfs4proxy never blocks on its stdout
+			go io.Copy(io.Discard, stdout)
+			return
+		case "VERSION-ERROR", "ENV-ERROR", "CMETHOD-ERROR", "SMETHOD-ERROR", "PROXY-ERROR":
+			cmd.Process.Kill()
+			return nil, fmt.Errorf("obfs4proxy: %s", scanner.Text())
+		}
+	}
+	cmd.Wait()
+	return nil, errors.New("obfs4proxy exited unexpectedly")
+}
+
+func (t *obfs4Transport) Dial(addr string) (net.Conn, error) {
+	t.once.Do(func() {
+		var method []string
+		method, t.err = t.start("TOR_PT_CLIENT_TRANSPORTS=obfs4")
+		if t.err == nil {
+			// CMETHOD obfs4 socks5 127.0.0.1:port
+			if len(method) < 4 || method[2] != "socks5" {
+				t.err = fmt.Errorf("obfs4proxy: unexpected method: %s", strings.Join(method, " "))
+				return
+			}
+			t.socksAddr = method[3]
+		}
+	})
+	if t.err != nil {
+		return nil, t.err
+	}
+	if t.args == "" {
+		return nil, errors.New("obfs4 bridge args are required, e.g. cert=... iat-mode=0")
+	}
+	// args longer than 255 bytes overflow into the password field, otherwise
+	// the password must be a single NUL byte
+	user, pass := t.args, "\x00"
+	if len(user) > 255 {
+		user, pass = user[:255], user[255:]
+	}
+	return socks5.Dial(t.socksAddr, user, pass, addr)
+}
+
+func (t *obfs4Transport) Listen(addr string) (net.Listener, error) {
+	ln, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		return nil, err
+	}
+	method, err := t.start(
+		"TOR_PT_SERVER_TRANSPORTS=obfs4",
+		"TOR_PT_SERVER_BINDADDR=obfs4-"+addr,
+		"TOR_PT_ORPORT="+ln.Addr().String(),
+		"TOR_PT_EXTENDED_SERVER_PORT=")
+	if err != nil {
+		ln.Close()
+		return nil, err
+	}
+	// SMETHOD obfs4 0.0.0.0:port ARGS:cert=...,iat-mode=0
+	slog.Info("obfs4 listening", "addr", method[2])
+	for _, field := range method[3:] {
+		if strings.HasPrefix(field, "ARGS:") {
+			slog.Info("obfs4 bridge", "args", strings.Replace(field[5:], ",", " ", -1))
+		}
+	}
+	return ln, nil
+}
@@ -0,0 +1,136 @@
+package tunnel
+
+import (
+	"bufio"
+	"context"
+	"encoding/base64"
+	"fmt"
+	"net"
+	"net/http"
+	"net/url"
+	"syscall"
+
+	"github.com/daogan/socksproxy/socks5"
+)
+
+// outbound is the upstream proxy the server reaches the targets through, e.g.
+// a corporate egress proxy, nil to dial them directly.
+var outbound *url.URL
+
+func parseOutbound(s string) (*url.URL, error) {
+	if s == "" {
+		return nil, nil
+	}
+	u, err := url.Parse(s)
+	if err != nil {
+		return nil, err
+	}
+	if u.Scheme != "socks5" && u.Scheme != "http" {
+		return nil, fmt.Errorf("not supported outbound proxy: %s, expect socks5:// or http://", u.Scheme)
+	}
+	if _, _, err = net.SplitHostPort(u.Host); err != nil {
+		return nil, fmt.Errorf("invalid outbound proxy address: %v", err)
+	}
+	return u, nil
+}
+
+// dialOutbound connects the server to target, through the outbound proxy if
+// there is one, tracing it in tr. eg and the loop check check the addresses
+// target resolves to. The outbound proxy resolves it itself, so eg checks a
+// name resolved here too.
+func dialOutbound(target string, tr *trace, eg *egress) (net.Conn, error) {
+	if outbound == nil {
+		control := func(network, address string, c syscall.RawConn) error {
+			if err := loopControl(network, address, c); err != nil {
+				return err
+			}
+			return eg.control(network, address, c)
+		}
+		return withRetry(func() (net.Conn, error) { return tr.dial(target, control) })
+	}
+	if err := checkOutboundTarget(target, eg); err != nil {
+		return nil, err
+	}
+	user := outbound.User.Username()
+	pass, _ := outbound.User.Password()
+	if outbound.Scheme == "socks5" {
+		return withRetry(func() (net.Conn, error) { return socksDial(outbound.Host, user, pass, target) })
+	}
+	return withRetry(func() (net.Conn, error) { return httpConnectDial(outbound.Host, user, pass, target) })
+}
+
+// checkOutboundTarget returns errPrivate if eg blocks an address the name of
+// target resolves to. A name that doesn't resolve here, like behind an egress
+// proxy without dns of its own, is left to the proxy.
+func checkOutboundTarget(target string, eg *egress) error {
+	if eg == nil || !eg.private {
+		return nil
+	}
+	host, _, err := net.SplitHostPort(target)
+	if err != nil || net.ParseIP(host) != nil {
+		// the literal ips were checked with the target
+		return err
+	}
+	ctx, cancel := context.WithTimeout(context.Background(), dnsTimeout)
+	defer cancel()
+	ips, _ := net.DefaultResolver.LookupIP(ctx, "ip", host)
+	for _, ip := range ips {
+		if err := eg.checkIP(ip); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// socksDial connects to target through the socks5 proxy at proxyAddr, like
+// socks5.Dial with the dial timeout and socket options of the server and the
+// handshake within -request-timeout.
+func socksDial(proxyAddr, user, pass, target string) (net.Conn, error) {
+	tgtAddr, err := socks5.EncodeAddr(target)
+	if err != nil {
+		return nil, err
+	}
+	conn, err := dialTCP(proxyAddr)
+	if err != nil {
+		return nil, err
+	}
+	setDeadline(conn, config.RequestTimeout)
+	if err = socks5.Connect(conn, user, pass, tgtAddr); err != nil {
+		conn.Close()
+		return nil, err
+	}
+	setDeadline(conn, 0)
+	return conn, nil
+}
+
+// httpConnectDial connects to target through the http proxy at proxyAddr with
+// a CONNECT request, authenticating with basic auth when user is not empty,
+// within -request-timeout.
+func httpConnectDial(proxyAddr, user, pass, target string) (net.Conn, error) {
+	conn, err := dialTCP(proxyAddr)
+	if err != nil {
+		return nil, err
+	}
+	setDeadline(conn, config.RequestTimeout)
+	req := "CONNECT " + target + " HTTP/1.1\r\nHost: " + target + "\r\n"
+	if user != "" {
+		req += "Proxy-Authorization: Basic " + base64.StdEncoding.EncodeToString([]byte(user+":"+pass)) + "\r\n"
+	}
+	if _, err = conn.Write([]byte(req + "\r\n")); err != nil {
+		conn.Close()
+		return nil, err
+	}
+	br := bufio.NewReader(conn)
+	// a successful CONNECT response has no body
+	resp, err := http.ReadResponse(br, &http.Request{Method: http.MethodConnect})
+	if err != nil {
+		conn.Close()
+		return nil, err
+	}
+	if resp.StatusCode != http.StatusOK {
+		conn.Close()
+		return nil, fmt.Errorf("http proxy CONNECT failed: %s", resp.Status)
+	}
+	setDeadline(conn, 0)
+	return &prefixConn{Conn: conn, r: br}, nil
+}
@@ -0,0 +1,141 @@
+package tunnel
+
+import (
+	"encoding/json"
+	"fmt"
+	"log/slog"
+	"net"
+	"net/http"
+	"strings"
+)
+
+// The proxy auto-config script served at /proxy.pac sends local and private
+// destinations and the -pac-direct domains direct, then follows the -rules,
+// everything else goes to the local proxy. Rejected targets go to the proxy
+// too, which rejects them.
+const pacTemplate = `var direct = %s;
+var rules = %s;
+var final = "%s";
+var proxies = "%s";
+
+function matchRule(r, host) {
+	var ip = /^\d+\.\d+\.\d+\.\d+$/.test(host);
+	switch (r[0]) {
+	case "DOMAIN":
+		return !ip && host == r[1];
+	case "DOMAIN-SUFFIX":
+		return !ip && (host == r[1] || dnsDomainIs(host, "." + r[1]));
+	case "DOMAIN-KEYWORD":
+		return !ip && host.indexOf(r[1]) >= 0;
+	case "DOMAIN-REGEX":
+		return !ip && new RegExp(r[1]).test(host);
+	case "IP-CIDR":
+		return ip && isInNet(host, r[1], r[2]);
+	}
+	return false;
+}
+
+function FindProxyForURL(url, host) {
+	if (isPlainHostName(host) || host == "localhost") {
+		return "DIRECT";
+	}
+	if (/^\d+\.\d+\.\d+\.\d+$/.test(host) &&
+		(isInNet(host, "10.0.0.0", "255.0.0.0") ||
+		isInNet(host, "127.0.0.0", "255.0.0.0") ||
+		isInNet(host, "169.254.0.0", "255.255.0.0") ||
+		isInNet(host, "172.16.0.0", "255.240.0.0") ||
+		isInNet(host, "192.168.0.0", "255.255.0.0"))) {
+		return "DIRECT";
+	}
+	for (var i = 0; i < direct.length; i++) {
+		if (host == direct[i] || dnsDomainIs(host, "." + direct[i])) {
+			return "DIRECT";
+		}
+	}
+	host = host.toLowerCase();
+	for (var i = 0; i < rules.length; i++) {
+		if (matchRule(rules[i], host)) {
+			return rules[i][rules[i].length - 1] == "DIRECT" ? "DIRECT" : proxies;
+		}
+	}
+	return final == "DIRECT" ? "DIRECT" : proxies;
+}
+`
+
+func servePAC(addr string) {
+	var direct []string
+	for _, d := range strings.Split(config.PACDirect, ",") {
+		if d = strings.Trim(strings.TrimSpace(d), "."); d != "" {
+			direct = append(direct, d)
+		}
+	}
+	list, _ := json.Marshal(direct)
+	if direct == nil {
+		list = []byte("[]")
+	}
+	mux := http.NewServeMux()
+	mux.HandleFunc("/proxy.pac", func(w http.ResponseWriter, r *http.Request) {
+		w.Header().Set("Content-Type", "application/x-ns-proxy-autoconfig")
+		rules, final := activeRules.Load().pac()
+		fmt.Fprintf(w, pacTemplate, list, rules, final, pacProxies(r.Host))
+	})
+	ln, err := listenTCP(addr)
+	if err != nil {
+		slog.Error("pac server error", "err", err)
+		return
+	}
+	slog.Info("serving pac", "url", "http://"+addr+"/proxy.pac")
+	go func() {
+		if err := http.Serve(ln, mux); err != nil {
+			slog.Error("pac server error", "err", err)
+		}
+	}()
+}
+
+// pacProxies lists the local proxies, reached at the host the script was
+// fetched from.
+func pacProxies(reqHost string) string {
+	host, _, err := net.SplitHostPort(reqHost)
+	if err != nil {
+		host = reqHost
+	}
+	proxy := func(addr string) string {
+		_, port, _ := net.SplitHostPort(addr)
+		return net.JoinHostPort(host, port)
+	}
+	socks := proxy(firstAddr(config.LocalAddr))
+	proxies := "SOCKS5 " + socks + "; SOCKS " + socks
+	if config.HTTPAddr != "" {
+		proxies += "; PROXY " + proxy(firstAddr(config.HTTPAddr))
+	}
+	return proxies
+}
+
+// pac returns the rules as a javascript array for the pac script, and the
+// final action. IPv6 ranges are left out, the script only tests IPv4 hosts.
+// The script can't apply GEOIP and RULE-SET rules, so it sends what reaches
+// them to the proxy, which does.
+func (s *ruleSet) pac() ([]byte, string) {
+	if s == nil {
+		return []byte("[]"), actionProxy
+	}
+	list := [][]string{}
+	final := s.final
+loop:
+	for _, r := range s.rules {
+		switch {
+		case r.kind == "GEOIP" || r.list != nil:
+			final = actionProxy
+			break loop
+		case r.ipnet != nil && r.ipnet.IP.To4() != nil:
+			list = append(list, []string{"IP-CIDR", r.ipnet.IP.String(), net.IP(r.ipnet.Mask).String(), r.action})
+		case r.ipnet != nil:
+		case r.re != nil:
+			list = append(list, []string{r.kind, r.re.String(), r.action})
+		default:
+			list = append(list, []string{r.kind, r.value, r.action})
+		}
+	}
+	b, _ := json.Marshal(list)
+	return b, final
+}
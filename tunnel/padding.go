@@ -0,0 +1,126 @@
+package tunnel
+
+import (
+	"encoding/binary"
+	"fmt"
+	"io"
+	"math/rand"
+	"net"
+	"strconv"
+	"strings"
+)
+
+// With -padding the stream is framed inside the encryption, so the record
+// sizes seen on the wire no longer follow the payload:
+//
+//	+--------+---------+----------+----------+
+//	| LENGTH | PADDING |   DATA   | PADDING  |
+//	+--------+---------+----------+----------+
+//	|   2    |    2    | Variable | Variable |
+//	+--------+---------+----------+----------+
+//
+// A frame without data is a dummy frame. Both sides must enable padding, their
+// policies may differ.
+type paddingPolicy struct {
+	max   int     // up to max padding bytes per frame
+	split int     // between split/2 and split data bytes per frame
+	dummy float64 // chance of a dummy frame before each write
+}
+
+var padding *paddingPolicy
+
+// parsePadding parses "on" for the defaults, or a list of overrides like
+// "max=255,split=1400,dummy=0.1". An empty policy disables padding.
+func parsePadding(s string) (*paddingPolicy, error) {
+	if s == "" {
+		return nil, nil
+	}
+	p := &paddingPolicy{max: 255, split: 1400, dummy: 0.1}
+	if s == "on" {
+		return p, nil
+	}
+	for _, kv := range strings.Split(s, ",") {
+		k, v, _ := strings.Cut(strings.TrimSpace(kv), "=")
+		var err error
+		switch k {
+		case "max":
+			p.max, err = strconv.Atoi(v)
+		case "split":
+			p.split, err = strconv.Atoi(v)
+		case "dummy":
+			p.dummy, err = strconv.ParseFloat(v, 64)
+		default:
+			return nil, fmt.Errorf("unknown padding option: %s", k)
+		}
+		if err != nil {
+			return nil, fmt.Errorf("invalid padding %s: %v", k, err)
+		}
+	}
+	if p.max < 0 || p.max > 0xffff || p.split < 2 || p.split > 0xffff || p.dummy < 0 || p.dummy > 1 {
+		return nil, fmt.Errorf("invalid padding: %s", s)
+	}
+	return p, nil
+}
+
+type paddingConn struct {
+	net.Conn
+	policy *paddingPolicy
+
+	hdr     [4]byte
+	buf     []byte
+	pending []byte // data not yet returned by Read
+}
+
+func newPaddingConn(c net.Conn, policy *paddingPolicy) *paddingConn {
+	return &paddingConn{Conn: c, policy: policy}
+}
+
+func (c *paddingConn) CloseWrite() error { return closeWrite(c.Conn) }
+func (c *paddingConn) CloseRead() error  { return closeRead(c.Conn) }
+
+func (c *paddingConn) Read(b []byte) (n int, err error) {
+	for len(c.pending) == 0 {
+		if _, err = io.ReadFull(c.Conn, c.hdr[:]); err != nil {
+			return
+		}
+		dataLen := int(binary.BigEndian.Uint16(c.hdr[:]))
+		padLen := int(binary.BigEndian.Uint16(c.hdr[2:]))
+		if len(c.buf) < dataLen+padLen {
+			c.buf = make([]byte, dataLen+padLen)
+		}
+		if _, err = io.ReadFull(c.Conn, c.buf[:dataLen+padLen]); err != nil {
+			return
+		}
+		c.pending = c.buf[:dataLen]
+	}
+	n = copy(b, c.pending)
+	c.pending = c.pending[n:]
+	return
+}
+
+func (c *paddingConn) appendFrame(out, data []byte) []byte {
+	padLen := rand.Intn(c.policy.max + 1)
+	out = binary.BigEndian.AppendUint16(out, uint16(len(data)))
+	out = binary.BigEndian.AppendUint16(out, uint16(padLen))
+	out = append(out, data...)
+	return append(out, make([]byte, padLen)...)
+}
+
+// Write splits b into frames of random sizes, sent together with a dummy
+// frame now and then in a single write.
+func (c *paddingConn) Write(b []byte) (int, error) {
+	out := make([]byte, 0, len(b)+(len(b)/(c.policy.split/2)+2)*(4+c.policy.max))
+	if rand.Float64() < c.policy.dummy {
+		out = c.appendFrame(out, nil)
+	}
+	for rest := b; len(rest) > 0; {
+		n := c.policy.split/2 + rand.Intn(c.policy.split-c.policy.split/2+1)
+		n = min(n, len(rest))
+		out = c.appendFrame(out, rest[:n])
+		rest = rest[n:]
+	}
+	if _, err := c.Conn.Write(out); err != nil {
+		return 0, err
+	}
+	return len(b), nil
+}
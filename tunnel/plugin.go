@@ -0,0 +1,194 @@
+package tunnel
+
+import (
+	"errors"
+	"fmt"
+	"log/slog"
+	"net"
+	"os"
+	"os/exec"
+	"sync"
+	"time"
+)
+
+// SIP003 plugins are external programs carrying the tunnel between local and
+// server, e.g. v2ray-plugin or simple-obfs. On the local side the plugin
+// listens at SS_LOCAL and connects to the server at SS_REMOTE, on the server
+// side it listens at SS_REMOTE and forwards to the server at SS_LOCAL.
+// https://shadowsocks.org/doc/sip003.html
+type pluginTransport struct {
+	bin  string
+	opts string
+
+	sync.Mutex
+	locals map[string]string // server address -> plugin address
+}
+
+func NewPluginTransport(bin, opts string) (*pluginTransport, error) {
+	if _, err := exec.LookPath(bin); err != nil {
+		return nil, fmt.Errorf("plugin not found: %v", err)
+	}
+	return &pluginTransport{bin: bin, opts: opts, locals: make(map[string]string)}, nil
+}
+
+func (t *pluginTransport) Dial(addr string) (net.Conn, error) {
+	local, err := t.local(addr)
+	if err != nil {
+		return nil, err
+	}
+	return net.Dial("tcp", local)
+}
+
+// local returns the address of the plugin for the server at addr, starting a
+// plugin for each server.
+func (t *pluginTransport) local(addr string) (string, error) {
+	t.Lock()
+	defer t.Unlock()
+	if local, ok := t.locals[addr]; ok {
+		return local, nil
+	}
+	ln, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		return "", err
+	}
+	local := ln.Addr().String()
+	ln.Close()
+	p, err := startPlugin(t.bin, t.opts, addr, local)
+	if err != nil {
+		return "", err
+	}
+	// wait for the plugin to listen
+	for i := 0; i < 50; i++ {
+		if c, err := net.Dial("tcp", local); err == nil {
+			c.Close()
+			t.locals[addr] = local
+			return local, nil
+		}
+		time.Sleep(100 * time.Millisecond)
+	}
+	p.stop()
+	return "", fmt.Errorf("plugin %s does not listen at %s", t.bin, local)
+}
+
+func (t *pluginTransport) Listen(addr string) (net.Listener, error) {
+	ln, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		return nil, err
+	}
+	if _, err = startPlugin(t.bin, t.opts, addr, ln.Addr().String()); err != nil {
+		ln.Close()
+		return nil, err
+	}
+	return ln, nil
+}
+
+// plugin is a running plugin process, restarted when it exits.
+type plugin struct {
+	bin string
+	env []string
+
+	sync.Mutex
+	cmd     *exec.Cmd
+	stopped bool
+}
+
+var plugins struct {
+	sync.Mutex
+	list []*plugin
+}
+
+func startPlugin(bin, opts, remote, local string) (*plugin, error) {
+	remoteHost, remotePort, err := net.SplitHostPort(remote)
+	if err != nil {
+		return nil, err
+	}
+	if remoteHost == "" {
+		remoteHost = "0.0.0.0"
+	}
+	localHost, localPort, err := net.SplitHostPort(local)
+	if err != nil {
+		return nil, err
+	}
+	p := &plugin{bin: bin, env: append(os.Environ(),
+		"SS_REMOTE_HOST="+remoteHost,
+		"SS_REMOTE_PORT="+remotePort,
+		"SS_LOCAL_HOST="+localHost,
+		"SS_LOCAL_PORT="+localPort,
+		"SS_PLUGIN_OPTIONS="+opts)}
+	if err = p.start(); err != nil {
+		return nil, err
+	}
+	plugins.Lock()
+	plugins.list = append(plugins.list, p)
+	plugins.Unlock()
+	go p.watch()
+	return p, nil
+}
+
+func (p *plugin) start() error {
+	p.Lock()
+	defer p.Unlock()
+	if p.stopped {
+		return errors.New("plugin stopped")
+	}
+	cmd := exec.Command(p.bin)
+	cmd.Env = p.env
+	cmd.Stdout = os.Stderr
+	cmd.Stderr = os.Stderr
+	if err := cmd.Start(); err != nil {
+		return err
+	}
+	p.cmd = cmd
+	return nil
+}
+
+// watch restarts the plugin when it exits, backing off while it keeps crashing.
+func (p *plugin) watch() {
+	backoff := time.Second
+	for {
+		p.Lock()
+		cmd := p.cmd
+		p.Unlock()
+		start := time.Now()
+		err := cmd.Wait()
+		p.Lock()
+		stopped := p.stopped
+		p.Unlock()
+		if stopped {
+			return
+		}
+		if time.Since(start) > time.Minute {
+			backoff = time.Second
+		}
+		slog.Warn("plugin exited, restarting", "plugin", p.bin, "err", err, "after", backoff)
+		time.Sleep(backoff)
+		backoff = min(2*backoff, time.Minute)
+		for p.start() != nil {
+			p.Lock()
+			stopped := p.stopped
+			p.Unlock()
+			if stopped {
+				return
+			}
+			time.Sleep(backoff)
+		}
+	}
+}
+
+func (p *plugin) stop() {
+	p.Lock()
+	defer p.Unlock()
+	p.stopped = true
+	if p.cmd != nil {
+		p.cmd.Process.Kill()
+	}
+}
+
+// stopPlugins kills the plugins on shutdown.
+func stopPlugins() {
+	plugins.Lock()
+	defer plugins.Unlock()
+	for _, p := range plugins.list {
+		p.stop()
+	}
+}
@@ -0,0 +1,106 @@
+package tunnel
+
+import (
+	"hash/fnv"
+	"net"
+	"sort"
+	"strings"
+	"sync/atomic"
+
+	"github.com/daogan/socksproxy/socks5"
+)
+
+// pool is the list of servers the local side tunnels through. Like keys, it is
+// replaced as a whole when the servers change.
+type pool struct {
+	servers []*keys
+	next    uint64 // round robin counter
+}
+
+var activePool atomic.Pointer[pool]
+
+// serverList splits the comma separated -s of c and appends the servers of the
+// config file.
+func serverList(c *Config) []string {
+	var addrs []string
+	for _, addr := range strings.Split(c.ServerAddr, ",") {
+		if addr = strings.TrimSpace(addr); addr != "" {
+			addrs = append(addrs, addr)
+		}
+	}
+	return append(addrs, c.Servers...)
+}
+
+func newPool(addrs []string, method, password string) *pool {
+	p := &pool{}
+	for _, addr := range addrs {
+		p.servers = append(p.servers, &keys{server: addr, method: method, password: password})
+	}
+	return p
+}
+
+// pick returns the server for a new connection to tgtAddr, as set by
+// -balance, skipping the servers whose circuit is open. It returns nil when
+// all of them are down, or there are none.
+func (p *pool) pick(tgtAddr []byte) *keys {
+	if p == nil || len(p.servers) == 0 {
+		return nil
+	}
+	var order []*keys
+	switch config.Balance {
+	case "hash":
+		order = p.byHash(tgtAddr)
+	case "latency":
+		order = serverHealth.byLatency(p.servers)
+	default:
+		n := int(atomic.AddUint64(&p.next, 1)-1) % len(p.servers)
+		order = append(append(order, p.servers[n:]...), p.servers[:n]...)
+	}
+	for _, k := range order {
+		if serverHealth.allow(k.server) {
+			return k
+		}
+	}
+	return nil
+}
+
+// byHash orders the servers by rendezvous hashing on the destination host: a
+// host keeps its server when other servers are added or removed.
+func (p *pool) byHash(tgtAddr []byte) []*keys {
+	host, _, _ := net.SplitHostPort(socks5.AddrString(tgtAddr))
+	score := func(k *keys) uint64 {
+		h := fnv.New64a()
+		h.Write([]byte(k.server))
+		h.Write([]byte(host))
+		return h.Sum64()
+	}
+	order := append([]*keys{}, p.servers...)
+	sort.Slice(order, func(i, j int) bool {
+		return score(order[i]) > score(order[j])
+	})
+	return order
+}
+
+// down reports whether the circuit of every server is open.
+func (p *pool) down() bool {
+	for _, k := range p.servers {
+		if serverHealth.up(k.server) {
+			return false
+		}
+	}
+	return true
+}
+
+// equal reports whether p and servers list the same servers.
+func (p *pool) equal(servers []*keys) bool {
+	if p == nil || len(p.servers) != len(servers) {
+		return false
+	}
+	for i, k := range servers {
+		s := p.servers[i]
+		if s.server != k.server || s.method != k.method || s.password != k.password || s.auth != k.auth {
+			return false
+		}
+	}
+	return true
+}
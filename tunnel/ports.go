@@ -0,0 +1,63 @@
+package tunnel
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"strconv"
+)
+
+// PortKey is the key of a port of port_password or of a user of users, given
+// as the password alone or as {"method": ..., "password": ...}. allow_ports
+// and block_ports, when given, replace the ones of the server for the user.
+type PortKey struct {
+	Method     string `json:"method,omitempty"`
+	Password   string `json:"password"`
+	AllowPorts string `json:"allow_ports,omitempty"`
+	BlockPorts string `json:"block_ports,omitempty"`
+}
+
+// ports returns the allow and block ports of k, allow and block unless given.
+func (k PortKey) ports(allow, block string) (string, string) {
+	if k.AllowPorts != "" {
+		allow = k.AllowPorts
+	}
+	if k.BlockPorts != "" {
+		block = k.BlockPorts
+	}
+	return allow, block
+}
+
+func (k *PortKey) UnmarshalJSON(b []byte) error {
+	var password string
+	if err := json.Unmarshal(b, &password); err == nil {
+		*k = PortKey{Password: password}
+		return nil
+	}
+	type plain PortKey
+	return json.Unmarshal(b, (*plain)(k))
+}
+
+// servePorts serves each port of port_password with its own password, on the
+// host of -s like the ports of the manager.
+func servePorts(ctx context.Context, ports map[string]PortKey) error {
+	for s, pk := range ports {
+		port, err := strconv.Atoi(s)
+		if err != nil || port <= 0 || port > 65535 {
+			return fmt.Errorf("port_password: invalid port %q", s)
+		}
+		k := &keys{method: pk.Method, password: pk.Password}
+		k.allowPorts, k.blockPorts = pk.ports(config.AllowPorts, config.BlockPorts)
+		k.allowPrivate = config.AllowPrivate
+		if k.method == "" {
+			k.method = config.Method
+		}
+		if err := k.check(); err != nil {
+			return fmt.Errorf("port_password: port %d: %v", port, err)
+		}
+		if err := addPort(ctx, port, k); err != nil {
+			return fmt.Errorf("port_password: port %d: %v", port, err)
+		}
+	}
+	return nil
+}
@@ -0,0 +1,187 @@
+package tunnel
+
+import (
+	"errors"
+	"log/slog"
+	"sort"
+	"sync"
+	"time"
+)
+
+const (
+	probeTimeout     = 5 * time.Second
+	breakerThreshold = 3 // consecutive failures opening the circuit
+	breakerCooldown  = 30 * time.Second
+)
+
+var errServersDown = errors.New("all servers are down")
+
+// health tracks the servers from the background probes and from the dials of
+// new connections. After breakerThreshold consecutive failures the circuit of
+// a server opens: new connections skip it, or fail fast when no server is
+// left. After breakerCooldown the circuit is half-open and a single probe or
+// connection decides whether it closes again.
+type health struct {
+	sync.Mutex
+	servers map[string]*serverState
+	best    string // fastest server, for -balance latency
+}
+
+type serverState struct {
+	rtt       time.Duration // connect time of the last probe
+	probed    bool
+	failures  int
+	openUntil time.Time
+	trial     bool // the half-open trial is in flight
+}
+
+var serverHealth = &health{servers: make(map[string]*serverState)}
+
+// state returns the state of addr, h must be locked.
+func (h *health) state(addr string) *serverState {
+	s, ok := h.servers[addr]
+	if !ok {
+		s = &serverState{}
+		h.servers[addr] = s
+	}
+	return s
+}
+
+func (s *serverState) closed() bool {
+	return s.failures < breakerThreshold
+}
+
+// up reports whether a new connection may use addr.
+func (h *health) up(addr string) bool {
+	h.Lock()
+	defer h.Unlock()
+	s := h.state(addr)
+	return s.closed() || !s.trial && !time.Now().Before(s.openUntil)
+}
+
+// allow is up, but it also claims the trial of a half-open circuit.
+func (h *health) allow(addr string) bool {
+	h.Lock()
+	defer h.Unlock()
+	s := h.state(addr)
+	if s.closed() {
+		return true
+	}
+	if s.trial || time.Now().Before(s.openUntil) {
+		return false
+	}
+	s.trial = true
+	return true
+}
+
+func (h *health) success(addr string) {
+	h.Lock()
+	defer h.Unlock()
+	s := h.state(addr)
+	if !s.closed() {
+		slog.Info("server is back", "server", addr)
+	}
+	s.failures = 0
+	s.trial = false
+}
+
+func (h *health) failure(addr string) {
+	h.Lock()
+	defer h.Unlock()
+	s := h.state(addr)
+	s.failures++
+	s.trial = false
+	if !s.closed() {
+		if s.failures == breakerThreshold {
+			slog.Warn("server is down, circuit open", "server", addr)
+		}
+		s.openUntil = time.Now().Add(breakerCooldown)
+	}
+}
+
+// probeServers connects to every server of the pool each interval, measuring
+// the connect time. Servers with an open circuit are probed once half-open.
+func probeServers(interval time.Duration) {
+	for {
+		p := activePool.Load()
+		var wg sync.WaitGroup
+		for _, k := range p.servers {
+			if !serverHealth.allow(k.server) {
+				continue
+			}
+			wg.Add(1)
+			go func(addr string) {
+				defer wg.Done()
+				rtt, err := probe(addr)
+				if err != nil {
+					serverHealth.failure(addr)
+					return
+				}
+				serverHealth.Lock()
+				s := serverHealth.state(addr)
+				s.rtt, s.probed = rtt, true
+				serverHealth.Unlock()
+				serverHealth.success(addr)
+			}(k.server)
+		}
+		wg.Wait()
+		if config.Balance == "latency" {
+			serverHealth.logFastest(p)
+		}
+		time.Sleep(interval)
+	}
+}
+
+func probe(addr string) (time.Duration, error) {
+	type result struct {
+		rtt time.Duration
+		err error
+	}
+	done := make(chan result, 1)
+	go func() {
+		start := time.Now()
+		c, err := transport.Dial(addr)
+		if err == nil {
+			c.Close()
+		}
+		done <- result{time.Since(start), err}
+	}()
+	select {
+	case r := <-done:
+		return r.rtt, r.err
+	case <-time.After(probeTimeout):
+		return 0, errors.New("probe timeout")
+	}
+}
+
+// byLatency orders servers from the fastest, the ones not probed yet last.
+func (h *health) byLatency(servers []*keys) []*keys {
+	h.Lock()
+	defer h.Unlock()
+	order := append([]*keys{}, servers...)
+	sort.SliceStable(order, func(i, j int) bool {
+		a, b := h.state(order[i].server), h.state(order[j].server)
+		if a.probed != b.probed {
+			return a.probed
+		}
+		return a.rtt < b.rtt
+	})
+	return order
+}
+
+// logFastest logs when the fastest server that is up changes.
+func (h *health) logFastest(p *pool) {
+	best := ""
+	for _, k := range h.byLatency(p.servers) {
+		if h.up(k.server) {
+			best = k.server
+			break
+		}
+	}
+	h.Lock()
+	defer h.Unlock()
+	if best != h.best && best != "" {
+		slog.Info("switch to server", "server", best, "rtt", h.state(best).rtt)
+	}
+	h.best = best
+}
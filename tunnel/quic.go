@@ -0,0 +1,272 @@
+package tunnel
+
+import (
+	"context"
+	"crypto/tls"
+	"log/slog"
+	"net"
+	"sync"
+	"time"
+
+	"github.com/quic-go/quic-go"
+)
+
+// quicTransport carries every tunnel connection to a server as a stream of a
+// single QUIC connection, with the tls settings of the tls transport. When
+// the route to the server moves to another local address, e.g. a phone goes
+// from wifi to mobile data, the connection migrates instead of breaking.
+const (
+	quicALPN            = "socksproxy"
+	quicDialTimeout     = 10 * time.Second
+	quicMigrateInterval = 5 * time.Second
+)
+
+var quicConfig = &quic.Config{
+	MaxIdleTimeout:     60 * time.Second,
+	KeepAlivePeriod:    15 * time.Second,
+	MaxIncomingStreams: 4096,
+}
+
+type quicTransport struct {
+	sync.Mutex
+	tlsConf *tls.Config
+	conns   map[string]*quic.Conn
+	dials   map[string]*quicDial // the handshakes going on
+}
+
+// quicDial is a handshake with a server, which the dials to that server
+// meanwhile wait for.
+type quicDial struct {
+	done chan struct{}
+	c    *quic.Conn
+	err  error
+}
+
+func NewQUICTransport() (*quicTransport, error) {
+	conf, err := clientTLSConfig()
+	if err != nil {
+		return nil, err
+	}
+	conf.NextProtos = []string{quicALPN}
+	return &quicTransport{tlsConf: conf, conns: make(map[string]*quic.Conn), dials: make(map[string]*quicDial)}, nil
+}
+
+// conn returns the connection to addr, dialing it if there is none. The
+// handshake is done without the lock, so a slow server doesn't hold up the
+// dials to the others.
+func (t *quicTransport) conn(addr string) (*quic.Conn, error) {
+	t.Lock()
+	if c, ok := t.conns[addr]; ok && c.Context().Err() == nil {
+		t.Unlock()
+		return c, nil
+	}
+	if d, ok := t.dials[addr]; ok {
+		t.Unlock()
+		<-d.done
+		return d.c, d.err
+	}
+	d := &quicDial{done: make(chan struct{})}
+	t.dials[addr] = d
+	t.Unlock()
+
+	d.c, d.err = t.dial(addr)
+	t.Lock()
+	delete(t.dials, addr)
+	if d.err == nil {
+		t.conns[addr] = d.c
+	}
+	t.Unlock()
+	close(d.done)
+	return d.c, d.err
+}
+
+func (t *quicTransport) dial(addr string) (*quic.Conn, error) {
+	raddr, err := net.ResolveUDPAddr("udp", addr)
+	if err != nil {
+		return nil, err
+	}
+	udp, err := net.ListenUDP("udp", nil)
+	if err != nil {
+		return nil, err
+	}
+	tr := &quic.Transport{Conn: udp}
+	ctx, cancel := context.WithTimeout(context.Background(), quicDialTimeout)
+	defer cancel()
+	c, err := tr.Dial(ctx, raddr, t.tlsConf, quicConfig)
+	if err != nil {
+		tr.Close()
+		udp.Close()
+		return nil, err
+	}
+	go migrate(c, raddr, tr)
+	return c, nil
+}
+
+// Dial opens a stream of the connection to addr. A stream failing to open,
+// e.g. at the stream limit of the server under load, leaves the connection
+// to the other streams: a dead one is dialed again by conn.
+func (t *quicTransport) Dial(addr string) (net.Conn, error) {
+	c, err := t.conn(addr)
+	if err != nil {
+		return nil, err
+	}
+	ctx, cancel := context.WithTimeout(context.Background(), quicDialTimeout)
+	defer cancel()
+	stream, err := c.OpenStreamSync(ctx)
+	if err != nil {
+		return nil, err
+	}
+	return &quicStream{Stream: stream, conn: c}, nil
+}
+
+// localIP returns the local address the system routes raddr from.
+func localIP(raddr *net.UDPAddr) string {
+	// connecting a udp socket sends nothing
+	c, err := net.DialUDP("udp", nil, raddr)
+	if err != nil {
+		return ""
+	}
+	defer c.Close()
+	return c.LocalAddr().(*net.UDPAddr).IP.String()
+}
+
+// migrate moves c to a new socket when the local address changes, until c is
+// closed.
+func migrate(c *quic.Conn, raddr *net.UDPAddr, tr *quic.Transport) {
+	// a transport closes the connections on it, so they all live as long as c
+	transports := []*quic.Transport{tr}
+	defer func() {
+		for _, tr := range transports {
+			tr.Close()
+			tr.Conn.Close()
+		}
+	}()
+	ticker := time.NewTicker(quicMigrateInterval)
+	defer ticker.Stop()
+	ip := localIP(raddr)
+	for {
+		select {
+		case <-c.Context().Done():
+			return
+		case <-ticker.C:
+		}
+		newIP := localIP(raddr)
+		if newIP == "" || newIP == ip {
+			continue
+		}
+		udp, err := net.ListenUDP("udp", nil)
+		if err != nil {
+			continue
+		}
+		tr := &quic.Transport{Conn: udp}
+		transports = append(transports, tr)
+		path, err := c.AddPath(tr)
+		if err == nil {
+			ctx, cancel := context.WithTimeout(c.Context(), quicDialTimeout)
+			if err = path.Probe(ctx); err == nil {
+				err = path.Switch()
+			}
+			cancel()
+		}
+		if err != nil {
+			slog.Warn("fail to migrate quic connection", "ip", newIP, "err", err)
+			continue
+		}
+		slog.Info("quic connection migrated", "server", raddr, "ip", newIP)
+		ip = newIP
+	}
+}
+
+func (t *quicTransport) Listen(addr string) (net.Listener, error) {
+	conf, err := serverTLSConfig()
+	if err != nil {
+		return nil, err
+	}
+	conf.NextProtos = []string{quicALPN}
+	pc, err := listenUDP(addr)
+	if err != nil {
+		return nil, err
+	}
+	ln, err := quic.Listen(pc, conf, quicConfig)
+	if err != nil {
+		pc.Close()
+		return nil, err
+	}
+	ctx, cancel := context.WithCancel(context.Background())
+	l := &quicListener{ln: ln, pc: pc, streams: make(chan net.Conn), ctx: ctx, cancel: cancel}
+	go l.serve()
+	return l, nil
+}
+
+// quicListener accepts the streams of all connections. streams is never
+// closed, the senders and Accept stop once ctx is done by Close.
+type quicListener struct {
+	ln      *quic.Listener
+	pc      net.PacketConn
+	streams chan net.Conn
+	ctx     context.Context
+	cancel  context.CancelFunc
+}
+
+func (l *quicListener) serve() {
+	for {
+		c, err := l.ln.Accept(l.ctx)
+		if err != nil {
+			return
+		}
+		go func() {
+			for {
+				stream, err := c.AcceptStream(l.ctx)
+				if err != nil {
+					return
+				}
+				select {
+				case l.streams <- &quicStream{Stream: stream, conn: c}:
+				case <-l.ctx.Done():
+					stream.CancelRead(0)
+					stream.CancelWrite(0)
+					return
+				}
+			}
+		}()
+	}
+}
+
+func (l *quicListener) Accept() (net.Conn, error) {
+	select {
+	case c := <-l.streams:
+		return c, nil
+	case <-l.ctx.Done():
+		return nil, net.ErrClosed
+	}
+}
+
+func (l *quicListener) Close() error {
+	l.cancel()
+	err := l.ln.Close()
+	l.pc.Close()
+	return err
+}
+
+func (l *quicListener) Addr() net.Addr {
+	return l.ln.Addr()
+}
+
+type quicStream struct {
+	*quic.Stream
+	conn *quic.Conn
+}
+
+func (s *quicStream) LocalAddr() net.Addr {
+	return s.conn.LocalAddr()
+}
+
+func (s *quicStream) RemoteAddr() net.Addr {
+	return s.conn.RemoteAddr()
+}
+
+// Close closes both directions, Stream.Close only closes the write side.
+func (s *quicStream) Close() error {
+	s.CancelRead(0)
+	return s.Stream.Close()
+}
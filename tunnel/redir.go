@@ -0,0 +1,57 @@
+package tunnel
+
+import (
+	"context"
+	"log/slog"
+	"net"
+
+	"github.com/daogan/socksproxy/socks5"
+)
+
+// handleRedir tunnels a connection redirected by iptables to its original
+// destination, e.g. on a router:
+//
+//	iptables -t nat -A PREROUTING -p tcp -j REDIRECT --to-ports 1082
+func handleRedir(conn net.Conn) {
+	defer conn.Close()
+	dst, err := originalDst(conn)
+	if err != nil {
+		slog.Warn("fail to get original destination", "err", err)
+		return
+	}
+	// connecting to the listener itself would loop forever
+	if dst.String() == conn.LocalAddr().String() {
+		slog.Warn("refuse connection, not redirected", "client", conn.RemoteAddr().String())
+		return
+	}
+	tgtAddr, err := socks5.EncodeAddr(dst.String())
+	if err != nil {
+		return
+	}
+	tr := startTrace("redir", conn)
+	defer tr.finish(nil)
+	tunnel(conn, tgtAddr, tr, nil)
+}
+
+// handleTProxy tunnels a tcp connection intercepted by TPROXY, whose original
+// destination is the local address of the socket.
+func handleTProxy(conn net.Conn) {
+	defer conn.Close()
+	tgtAddr, err := socks5.EncodeAddr(conn.LocalAddr().String())
+	if err != nil {
+		return
+	}
+	tr := startTrace("tproxy", conn)
+	defer tr.finish(nil)
+	tunnel(conn, tgtAddr, tr, nil)
+}
+
+// runTProxy intercepts tcp and udp at addr.
+func runTProxy(ctx context.Context, addr string) {
+	pc, err := listenTProxyUDP(addr)
+	if err != nil {
+		fatal("listen error", "addr", addr, "err", err)
+	}
+	go serveTProxyUDP(pc)
+	run(ctx, addr, listenTProxy, handleTProxy)
+}
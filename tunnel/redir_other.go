@@ -0,0 +1,12 @@
+//go:build !linux
+
+package tunnel
+
+import (
+	"errors"
+	"net"
+)
+
+func originalDst(c net.Conn) (*net.TCPAddr, error) {
+	return nil, errors.New("transparent proxy is only supported on linux")
+}
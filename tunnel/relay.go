@@ -0,0 +1,20 @@
+package tunnel
+
+import (
+	"log/slog"
+	"net"
+)
+
+// handleRelay forwards the still encrypted tunnel to the next hop server, so
+// a relay node never needs to know the password.
+func handleRelay(conn net.Conn) {
+	defer conn.Close()
+	remote, err := dialTCP(config.RelayAddr)
+	if err != nil {
+		slog.Warn("fail to dial next hop", "server", config.RelayAddr, "err", err)
+		return
+	}
+	defer remote.Close()
+	slog.Debug("relaying", "client", conn.RemoteAddr().String(), "server", config.RelayAddr)
+	relay(conn, remote, config.RelayAddr)
+}
@@ -0,0 +1,351 @@
+package tunnel
+
+import (
+	"errors"
+	"fmt"
+	"log/slog"
+	"net"
+	"os"
+	"os/exec"
+	"strconv"
+	"strings"
+	"sync"
+	"syscall"
+)
+
+// A restart starts the executable again with the same arguments and hands it
+// the listening sockets, so the port never closes. The new process reports
+// it is running through the ready pipe, then the old one quits like on
+// SIGTERM, draining its connections.
+const (
+	// "tcp:addr,udp:addr,..." naming the handed over sockets, from fd 3
+	envListenFDs = "SOCKSPROXY_LISTEN_FDS"
+	envReadyFD   = "SOCKSPROXY_READY_FD"
+)
+
+type filer interface {
+	File() (*os.File, error)
+}
+
+var sockets = struct {
+	sync.Mutex
+	inherited map[string]*os.File
+	open      map[string]filer
+}{open: make(map[string]filer)}
+
+func init() {
+	sockets.inherited = make(map[string]*os.File)
+	inheritSystemd()
+	names := os.Getenv(envListenFDs)
+	if names == "" {
+		return
+	}
+	os.Unsetenv(envListenFDs)
+	for i, name := range strings.Split(names, ",") {
+		sockets.inherited[name] = os.NewFile(uintptr(3+i), name)
+	}
+}
+
+// inherit returns the socket named key handed over by the old process or
+// systemd, or nil. Other than the exact address a socket of systemd matches
+// the same port on the same ip, with any unspecified ip alike.
+func inherit(key string) *os.File {
+	sockets.Lock()
+	defer sockets.Unlock()
+	for k, f := range sockets.inherited {
+		if k == key || sameAddr(key, k) {
+			delete(sockets.inherited, k)
+			return f
+		}
+	}
+	return nil
+}
+
+// sameAddr compares the keys "tcp:addr" a and b, e.g. "tcp::1080" and
+// "tcp:[::]:1080".
+func sameAddr(a, b string) bool {
+	na, addrA, _ := strings.Cut(a, ":")
+	nb, addrB, _ := strings.Cut(b, ":")
+	if na != nb {
+		return false
+	}
+	hostA, portA, err := net.SplitHostPort(addrA)
+	if err != nil {
+		return false
+	}
+	hostB, portB, err := net.SplitHostPort(addrB)
+	if err != nil || portA != portB {
+		return false
+	}
+	ipA, ipB := net.ParseIP(hostA), net.ParseIP(hostB)
+	unspecified := func(host string, ip net.IP) bool {
+		return host == "" || ip != nil && ip.IsUnspecified()
+	}
+	if unspecified(hostA, ipA) && unspecified(hostB, ipB) {
+		return true
+	}
+	return ipA != nil && ipA.Equal(ipB)
+}
+
+func keep(key string, s filer) {
+	sockets.Lock()
+	defer sockets.Unlock()
+	sockets.open[key] = s
+}
+
+// dualStack holds the addresses being listened at by run on both the ipv4
+// and the ipv6 wildcard of a port, like 0.0.0.0:1080 and [::]:1080. Each of
+// the two sockets only takes its own family, where Go would make both dual
+// stack and clash.
+var dualStack sync.Map
+
+// markDualStack adds the dual stack addresses of addrs, before they are
+// listened at, and returns them for unmarkDualStack once they are.
+func markDualStack(addrs []string) []string {
+	v4 := make(map[string]bool)
+	for _, addr := range addrs {
+		if host, port, err := net.SplitHostPort(addr); err == nil && host == "0.0.0.0" {
+			v4[port] = true
+		}
+	}
+	var marked []string
+	for _, addr := range addrs {
+		if host, port, err := net.SplitHostPort(addr); err == nil && isV6Wildcard(host) && v4[port] {
+			marked = append(marked, addr, net.JoinHostPort("0.0.0.0", port))
+		}
+	}
+	for _, addr := range marked {
+		dualStack.Store(addr, true)
+	}
+	return marked
+}
+
+func unmarkDualStack(marked []string) {
+	for _, addr := range marked {
+		dualStack.Delete(addr)
+	}
+}
+
+func isV6Wildcard(host string) bool {
+	ip := net.ParseIP(host)
+	return ip != nil && ip.To4() == nil && ip.IsUnspecified()
+}
+
+// listenNetwork returns the network to listen at addr with, like tcp4 and
+// tcp6 for the wildcards of a dual stack port.
+func listenNetwork(network, addr string) string {
+	if _, ok := dualStack.Load(addr); !ok {
+		return network
+	}
+	host, _, _ := net.SplitHostPort(addr)
+	switch {
+	case host == "0.0.0.0":
+		return network + "4"
+	case isV6Wildcard(host):
+		return network + "6"
+	}
+	return network
+}
+
+// unixPath returns the path of the unix socket addr names: unix:path, or a
+// path with a slash like /run/socksproxy.sock or ./socks.sock. Anything else
+// is a host and port, so a typo like 1080 still fails.
+func unixPath(addr string) (string, bool) {
+	if path, ok := strings.CutPrefix(addr, "unix:"); ok {
+		return path, true
+	}
+	return addr, strings.Contains(addr, "/")
+}
+
+// checkLocalAddr refuses an addr of the config entry key that isn't a
+// loopback one or a unix socket, for the listeners that would let anyone
+// reaching them in: the manager, the debug server and the admin api
+// without a token.
+func checkLocalAddr(key, addr string) error {
+	if _, ok := unixPath(addr); ok {
+		// its permissions restrict the access
+		return nil
+	}
+	host, _, err := net.SplitHostPort(addr)
+	if err != nil {
+		return fmt.Errorf("invalid %s %s: %v", key, addr, err)
+	}
+	if ip := net.ParseIP(host); host != "localhost" && (ip == nil || !ip.IsLoopback()) {
+		return fmt.Errorf("%s %s is not a loopback address, use 127.0.0.1 or a unix socket", key, addr)
+	}
+	return nil
+}
+
+// listenTCP listens at addr, or takes over the listener of the old process.
+// An addr naming a path is a unix socket, see unixPath.
+func listenTCP(addr string) (net.Listener, error) {
+	if path, ok := unixPath(addr); ok {
+		return listenUnix(path)
+	}
+	key := "tcp:" + addr
+	if f := inherit(key); f != nil {
+		defer f.Close()
+		ln, err := net.FileListener(f)
+		if err != nil {
+			return nil, err
+		}
+		keep(key, ln.(filer))
+		return ln, nil
+	}
+	ln, err := net.Listen(listenNetwork("tcp", addr), addr)
+	if err != nil {
+		return nil, err
+	}
+	keep(key, ln.(filer))
+	return ln, nil
+}
+
+// unixMode is the permissions of the unix sockets listened at with
+// -unix-mode, 0 to leave them to the umask.
+var unixMode os.FileMode
+
+// listenUnix is listenTCP for the unix socket at path. A socket left there
+// by a process gone, which refuses connections, is removed first, one still
+// served is an error.
+func listenUnix(path string) (net.Listener, error) {
+	key := "unix:" + path
+	if f := inherit(key); f != nil {
+		defer f.Close()
+		ln, err := net.FileListener(f)
+		if err != nil {
+			return nil, err
+		}
+		if ul, ok := ln.(*net.UnixListener); ok {
+			// removed on close as if listened here
+			ul.SetUnlinkOnClose(true)
+		}
+		keep(key, ln.(filer))
+		return ln, nil
+	}
+	if fi, err := os.Lstat(path); err == nil && fi.Mode()&os.ModeSocket != 0 {
+		c, err := net.Dial("unix", path)
+		if err == nil {
+			c.Close()
+			return nil, fmt.Errorf("listen unix %s: in use by another process", path)
+		}
+		if errors.Is(err, syscall.ECONNREFUSED) {
+			os.Remove(path)
+		}
+	}
+	ln, err := listenUnixMode(path, unixMode)
+	if err != nil {
+		return nil, err
+	}
+	keep(key, ln.(filer))
+	return ln, nil
+}
+
+// listenUDP is listenTCP for udp, the packets of the sources -allow and
+// -deny refuse are dropped.
+func listenUDP(addr string) (net.PacketConn, error) {
+	key := "udp:" + addr
+	if f := inherit(key); f != nil {
+		defer f.Close()
+		pc, err := net.FilePacketConn(f)
+		if err != nil {
+			return nil, err
+		}
+		keep(key, pc.(filer))
+		return aclPacketConn{pc}, nil
+	}
+	pc, err := net.ListenPacket(listenNetwork("udp", addr), addr)
+	if err != nil {
+		return nil, err
+	}
+	keep(key, pc.(filer))
+	return aclPacketConn{pc}, nil
+}
+
+// restart starts the new process and waits until it is ready.
+func restart() error {
+	exe, err := os.Executable()
+	if err != nil {
+		return err
+	}
+	var names []string
+	var files []*os.File
+	sockets.Lock()
+	for key, s := range sockets.open {
+		f, err := s.File()
+		if err != nil {
+			// closed since, e.g. a port hopped away from
+			delete(sockets.open, key)
+			continue
+		}
+		if ul, ok := s.(*net.UnixListener); ok {
+			// the path is the new process's now, closing must not remove it
+			ul.SetUnlinkOnClose(false)
+		}
+		names = append(names, key)
+		files = append(files, f)
+	}
+	sockets.Unlock()
+	defer func() {
+		for _, f := range files {
+			f.Close()
+		}
+	}()
+
+	r, w, err := os.Pipe()
+	if err != nil {
+		return err
+	}
+	defer r.Close()
+	cmd := exec.Command(exe, os.Args[1:]...)
+	cmd.Stdin, cmd.Stdout, cmd.Stderr = os.Stdin, os.Stdout, os.Stderr
+	// the watchdog is for the new process once it is ready
+	var env []string
+	for _, kv := range os.Environ() {
+		if !strings.HasPrefix(kv, "WATCHDOG_PID=") {
+			env = append(env, kv)
+		}
+	}
+	cmd.Env = append(env,
+		envListenFDs+"="+strings.Join(names, ","),
+		envReadyFD+"="+strconv.Itoa(3+len(files)))
+	cmd.ExtraFiles = append(files, w)
+	err = cmd.Start()
+	w.Close()
+	if err != nil {
+		return err
+	}
+	go cmd.Wait()
+
+	// EOF if the new process exits before it is ready
+	if n, _ := r.Read(make([]byte, 1)); n == 0 {
+		return errors.New("new process failed to start")
+	}
+	slog.Info("restarted", "pid", cmd.Process.Pid)
+	return nil
+}
+
+// restarted tells the old process, if any, that this one is running and
+// closes the sockets handed over that are no longer used.
+func restarted() {
+	sockets.Lock()
+	for key, f := range sockets.inherited {
+		slog.Info("closing unused socket", "socket", key)
+		f.Close()
+	}
+	sockets.inherited = nil
+	sockets.Unlock()
+
+	fd := os.Getenv(envReadyFD)
+	if fd == "" {
+		return
+	}
+	os.Unsetenv(envReadyFD)
+	n, err := strconv.Atoi(fd)
+	if err != nil {
+		slog.Error("restart error", "err", "bad "+envReadyFD, "fd", fd)
+		return
+	}
+	f := os.NewFile(uintptr(n), "ready")
+	f.Write([]byte{1})
+	f.Close()
+}
@@ -0,0 +1,33 @@
+//go:build !windows
+
+package tunnel
+
+import (
+	"net"
+	"os"
+	"sync"
+	"syscall"
+)
+
+var restartSignals = []os.Signal{syscall.SIGUSR2}
+
+func isRestartSignal(sig os.Signal) bool {
+	return sig == syscall.SIGUSR2
+}
+
+// umaskMu serializes the listens changing the umask of the process.
+var umaskMu sync.Mutex
+
+// listenUnixMode listens at the unix socket path with the permissions mode,
+// or those of the umask for 0. The umask is set to mode during the listen,
+// rather than chmoding after, so the socket is never reachable with others.
+func listenUnixMode(path string, mode os.FileMode) (net.Listener, error) {
+	if mode == 0 {
+		return net.Listen("unix", path)
+	}
+	umaskMu.Lock()
+	defer umaskMu.Unlock()
+	old := syscall.Umask(int(^mode & 0o777))
+	defer syscall.Umask(old)
+	return net.Listen("unix", path)
+}
@@ -0,0 +1,19 @@
+package tunnel
+
+import (
+	"net"
+	"os"
+)
+
+// windows has no SIGUSR2, and can't hand sockets over with ExtraFiles
+var restartSignals []os.Signal
+
+func isRestartSignal(sig os.Signal) bool {
+	return false
+}
+
+// listenUnixMode listens at the unix socket path, windows has no permission
+// bits to set: the acl of the directory decides.
+func listenUnixMode(path string, mode os.FileMode) (net.Listener, error) {
+	return net.Listen("unix", path)
+}
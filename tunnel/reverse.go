@@ -0,0 +1,147 @@
+package tunnel
+
+import (
+	"context"
+	"errors"
+	"log/slog"
+	"net"
+	"sync"
+	"time"
+
+	"github.com/daogan/socksproxy/socks5"
+	"github.com/hashicorp/yamux"
+)
+
+// In reverse mode the server, behind NAT or a firewall blocking inbound
+// connections, dials the public local side at its -reverse-listen address and
+// sends the magic target reverseHost. The tunnel connection then carries a
+// yamux session whose streams the local side opens, each starting with the
+// target address like a mux stream.
+const reverseHost = "sp.reverse.arpa:0"
+
+var errNoReverse = errors.New("no reverse server connected")
+
+type reversePool struct {
+	sync.Mutex
+	sessions []*muxSession
+	next     int
+}
+
+var reverseSessions = &reversePool{}
+
+func (r *reversePool) add(s *muxSession) {
+	r.Lock()
+	defer r.Unlock()
+	r.sessions = append(r.sessions, s)
+}
+
+// dial opens a stream to tgtAddr, spreading the streams over the sessions of
+// the connected reverse servers.
+func (r *reversePool) dial(tgtAddr []byte) (net.Conn, string, error) {
+	s, err := r.session()
+	if err != nil {
+		return nil, "", err
+	}
+	stream, err := s.OpenStream()
+	if err != nil {
+		s.Close()
+		return nil, s.server, err
+	}
+	if _, err = stream.Write(tgtAddr); err != nil {
+		stream.Close()
+		return nil, s.server, err
+	}
+	return stream, s.server, nil
+}
+
+// session returns the next open session, forgetting the closed ones.
+func (r *reversePool) session() (*muxSession, error) {
+	r.Lock()
+	defer r.Unlock()
+	open := r.sessions[:0]
+	for _, s := range r.sessions {
+		if !s.IsClosed() {
+			open = append(open, s)
+		}
+	}
+	r.sessions = open
+	if len(open) == 0 {
+		return nil, errNoReverse
+	}
+	r.next++
+	return open[r.next%len(open)], nil
+}
+
+// handleReverseLocal takes the session of a reverse server connected to the
+// local side.
+func handleReverseLocal(c net.Conn) {
+	conn, err := newTunnelConn(c, activeKeys.Load(), false)
+	if err != nil {
+		slog.Warn("fail to init tunnel", "err", err)
+		c.Close()
+		return
+	}
+	tgtHost, err := readTargetHost(conn)
+	if err != nil || tgtHost != reverseHost {
+		slog.Warn("not a reverse server", "client", c.RemoteAddr().String(), "err", err)
+		c.Close()
+		return
+	}
+	sess, err := yamux.Client(conn, muxConfig())
+	if err != nil {
+		slog.Warn("fail to start reverse session", "err", err)
+		c.Close()
+		return
+	}
+	slog.Info("reverse session", "server", c.RemoteAddr().String())
+	reverseSessions.add(&muxSession{Session: sess, server: c.RemoteAddr().String()})
+}
+
+// runReverse keeps a reverse session to the local side at addr, dialing it
+// again with a growing delay when it fails.
+func runReverse(ctx context.Context, addr string) {
+	tgtAddr, _ := socks5.EncodeAddr(reverseHost)
+	delay := time.Second
+	for {
+		start := time.Now()
+		if err := reverse(addr, tgtAddr); err != nil {
+			slog.Warn("fail to connect reverse session", "addr", addr, "err", err)
+		} else {
+			slog.Info("reverse session closed", "addr", addr)
+		}
+		if time.Since(start) > time.Minute {
+			delay = time.Second
+		}
+		select {
+		case <-ctx.Done():
+			return
+		case <-time.After(delay):
+		}
+		if delay < time.Minute {
+			delay *= 2
+		}
+	}
+}
+
+// reverse connects to the local side at addr and serves the streams it opens
+// until the session ends.
+func reverse(addr string, tgtAddr []byte) error {
+	c, err := transport.Dial(addr)
+	if err != nil {
+		return err
+	}
+	conn, err := newTunnelConn(c, activeKeys.Load(), true)
+	if err != nil {
+		c.Close()
+		return err
+	}
+	if _, err = conn.Write(tgtAddr); err != nil {
+		c.Close()
+		return err
+	}
+	slog.Info("reverse session", "addr", addr)
+	// the targets are checked like those of a server, -allow-private lets
+	// the local side reach the networks of this one
+	handleMuxServer(conn, activeKeys.Load().egress)
+	return nil
+}
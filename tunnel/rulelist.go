@@ -0,0 +1,260 @@
+package tunnel
+
+import (
+	"bufio"
+	"bytes"
+	"encoding/base64"
+	"fmt"
+	"io"
+	"log/slog"
+	"net"
+	"net/http"
+	"net/url"
+	"os"
+	"strings"
+	"sync/atomic"
+	"time"
+)
+
+// A RULE-SET rule matches the targets of a published rule list, read from a
+// file or downloaded from a url:
+//
+//	RULE-SET,https://example.com/gfwlist.txt,PROXY
+//	RULE-SET,/etc/socksproxy/direct.list,DIRECT
+//
+// Both gfwlist (AutoProxy, optionally base64 encoded) and surge lists are
+// understood. Surge lists hold rules without an action (DOMAIN-SUFFIX,x or
+// IP-CIDR,x) or domain sets (.x for x and its subdomains, x for x alone).
+// gfwlist patterns are reduced to their host, url regexes are skipped and @@
+// exceptions are honoured.
+type ruleList struct {
+	src  string
+	data atomic.Pointer[listData]
+}
+
+type listData struct {
+	suffix    *domainTrie
+	exact     map[string]struct{}
+	keywords  []string
+	nets      []*net.IPNet
+	except    *domainTrie
+	exceptSet map[string]struct{}
+}
+
+// domainTrie holds domains by their labels from the right, so a lookup costs
+// the number of labels of the host, whatever the size of the list.
+type domainTrie struct {
+	children map[string]*domainTrie
+	end      bool
+}
+
+func (t *domainTrie) insert(domain string) {
+	labels := strings.Split(domain, ".")
+	for i := len(labels) - 1; i >= 0; i-- {
+		if t.children == nil {
+			t.children = make(map[string]*domainTrie)
+		}
+		next, ok := t.children[labels[i]]
+		if !ok {
+			next = &domainTrie{}
+			t.children[labels[i]] = next
+		}
+		t = next
+	}
+	t.end = true
+}
+
+// hasSuffix reports whether host or one of its parent domains is in t.
+func (t *domainTrie) hasSuffix(host string) bool {
+	labels := strings.Split(host, ".")
+	for i := len(labels) - 1; i >= 0; i-- {
+		if t = t.children[labels[i]]; t == nil {
+			return false
+		}
+		if t.end {
+			return true
+		}
+	}
+	return false
+}
+
+func newRuleList(src string) (*ruleList, error) {
+	l := &ruleList{src: src}
+	if err := l.load(); err != nil {
+		return nil, err
+	}
+	return l, nil
+}
+
+func (l *ruleList) remote() bool {
+	return strings.HasPrefix(l.src, "http://") || strings.HasPrefix(l.src, "https://")
+}
+
+func (l *ruleList) load() error {
+	var b []byte
+	var err error
+	if l.remote() {
+		b, err = fetchRuleList(l.src)
+	} else {
+		b, err = os.ReadFile(l.src)
+	}
+	if err != nil {
+		return err
+	}
+	d, err := parseRuleList(b)
+	if err != nil {
+		return fmt.Errorf("%s: %v", l.src, err)
+	}
+	l.data.Store(d)
+	return nil
+}
+
+func fetchRuleList(src string) ([]byte, error) {
+	resp, err := subscribeClient.Get(src)
+	if err != nil {
+		return nil, err
+	}
+	defer resp.Body.Close()
+	if resp.StatusCode != http.StatusOK {
+		return nil, fmt.Errorf("unexpected status: %s", resp.Status)
+	}
+	return io.ReadAll(resp.Body)
+}
+
+func parseRuleList(b []byte) (*listData, error) {
+	// gfwlist is published base64 encoded
+	if dec, err := base64.StdEncoding.DecodeString(string(bytes.Join(bytes.Fields(b), nil))); err == nil {
+		b = dec
+	}
+	gfw := bytes.HasPrefix(b, []byte("[AutoProxy"))
+	d := &listData{
+		suffix:    &domainTrie{},
+		exact:     make(map[string]struct{}),
+		except:    &domainTrie{},
+		exceptSet: make(map[string]struct{}),
+	}
+	scanner := bufio.NewScanner(bytes.NewReader(b))
+	for n := 1; scanner.Scan(); n++ {
+		line := strings.TrimSpace(scanner.Text())
+		if line == "" || line[0] == '#' || line[0] == '!' || line[0] == '[' {
+			continue
+		}
+		if err := d.add(line, gfw); err != nil {
+			return nil, fmt.Errorf("line %d: %v", n, err)
+		}
+	}
+	return d, scanner.Err()
+}
+
+func (d *listData) add(line string, gfw bool) error {
+	if kind, value, ok := strings.Cut(line, ","); ok {
+		// surge rule, without an action, maybe with options like no-resolve
+		value, _, _ = strings.Cut(value, ",")
+		value = strings.ToLower(strings.Trim(strings.TrimSpace(value), "."))
+		switch strings.ToUpper(strings.TrimSpace(kind)) {
+		case "DOMAIN":
+			d.exact[value] = struct{}{}
+		case "DOMAIN-SUFFIX":
+			d.suffix.insert(value)
+		case "DOMAIN-KEYWORD":
+			d.keywords = append(d.keywords, value)
+		case "IP-CIDR", "IP-CIDR6":
+			_, ipnet, err := net.ParseCIDR(value)
+			if err != nil {
+				return err
+			}
+			d.nets = append(d.nets, ipnet)
+		default:
+			// USER-AGENT, PROCESS-NAME and the like can't apply here
+		}
+		return nil
+	}
+	suffix, exact := d.suffix, d.exact
+	if strings.HasPrefix(line, "@@") {
+		line = line[2:]
+		suffix, exact = d.except, d.exceptSet
+	}
+	switch {
+	case strings.HasPrefix(line, "/") && strings.HasSuffix(line, "/"):
+		// url regex
+		return nil
+	case strings.HasPrefix(line, "||"):
+		if host := patternHost(line[2:]); host != "" {
+			suffix.insert(host)
+		}
+	case strings.HasPrefix(line, "|"):
+		if u, err := url.Parse(line[1:]); err == nil && u.Hostname() != "" && !strings.Contains(u.Hostname(), "*") {
+			exact[strings.ToLower(u.Hostname())] = struct{}{}
+		}
+	case strings.HasPrefix(line, ".") || strings.HasPrefix(line, "+."):
+		if host := patternHost(strings.TrimPrefix(line, "+")); host != "" {
+			suffix.insert(host)
+		}
+	default:
+		// a gfwlist keyword taken for its host, or a plain domain of a
+		// domain set
+		if host := patternHost(line); host != "" {
+			if gfw {
+				suffix.insert(host)
+			} else {
+				exact[host] = struct{}{}
+			}
+		}
+	}
+	return nil
+}
+
+// patternHost returns the host at the start of a gfwlist pattern, or "" if
+// it has wildcards.
+func patternHost(p string) string {
+	host, _, _ := strings.Cut(p, "/")
+	host, _, _ = strings.Cut(host, ":")
+	host = strings.ToLower(strings.Trim(host, ".^"))
+	if host == "" || strings.ContainsAny(host, "*|") {
+		return ""
+	}
+	return host
+}
+
+func (l *ruleList) matches(host string, ip net.IP) bool {
+	d := l.data.Load()
+	if ip != nil {
+		for _, n := range d.nets {
+			if n.Contains(ip) {
+				return true
+			}
+		}
+		return false
+	}
+	if _, ok := d.exceptSet[host]; ok || d.except.hasSuffix(host) {
+		return false
+	}
+	if _, ok := d.exact[host]; ok || d.suffix.hasSuffix(host) {
+		return true
+	}
+	for _, k := range d.keywords {
+		if strings.Contains(host, k) {
+			return true
+		}
+	}
+	return false
+}
+
+// refreshRuleLists downloads the rule lists of the rules again every
+// interval, keeping the old list when that fails.
+func refreshRuleLists(interval time.Duration) {
+	for range time.Tick(interval) {
+		s := activeRules.Load()
+		if s == nil {
+			continue
+		}
+		for _, r := range s.rules {
+			if r.list == nil || !r.list.remote() {
+				continue
+			}
+			if err := r.list.load(); err != nil {
+				slog.Warn("fail to refresh rule list", "err", err)
+			}
+		}
+	}
+}
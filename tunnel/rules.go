@@ -0,0 +1,249 @@
+package tunnel
+
+import (
+	"bufio"
+	"errors"
+	"fmt"
+	"log/slog"
+	"net"
+	"os"
+	"regexp"
+	"strings"
+	"sync/atomic"
+
+	"github.com/daogan/socksproxy/socks5"
+)
+
+// A rules file routes the targets of the local side, one rule per line, the
+// first matching rule wins:
+//
+//	DOMAIN,example.com,PROXY
+//	DOMAIN-SUFFIX,lan,DIRECT
+//	DOMAIN-KEYWORD,ads,REJECT
+//	DOMAIN-REGEX,^cdn[0-9]+\.example\.net$,PROXY
+//	IP-CIDR,192.168.0.0/16,DIRECT
+//	GEOIP,CN,DIRECT
+//	RULE-SET,https://example.com/gfwlist.txt,PROXY
+//	MATCH,PROXY
+//
+// Lines starting with # are comments. Domain rules match domain targets and
+// IP rules match IP targets, targets matching no rule go through the proxy
+// unless a MATCH rule says otherwise. GEOIP rules look up the country in the
+// -geoip database, resolving domain targets locally when they get there.
+const (
+	actionDirect = "DIRECT"
+	actionProxy  = "PROXY"
+	actionReject = "REJECT"
+)
+
+var errRejected = errors.New("rejected by rules")
+
+type rule struct {
+	kind   string
+	value  string
+	re     *regexp.Regexp
+	ipnet  *net.IPNet
+	list   *ruleList
+	action string
+}
+
+type ruleSet struct {
+	rules []rule
+	final string
+}
+
+var activeRules atomic.Pointer[ruleSet]
+
+func loadRules(path string) error {
+	f, err := os.Open(path)
+	if err != nil {
+		return err
+	}
+	defer f.Close()
+	s := &ruleSet{final: actionProxy}
+	scanner := bufio.NewScanner(f)
+	for n := 1; scanner.Scan(); n++ {
+		line := strings.TrimSpace(scanner.Text())
+		if line == "" || strings.HasPrefix(line, "#") {
+			continue
+		}
+		if err = s.add(line); err != nil {
+			return fmt.Errorf("%s:%d: %v", path, n, err)
+		}
+	}
+	if err = scanner.Err(); err != nil {
+		return err
+	}
+	activeRules.Store(s)
+	return nil
+}
+
+func parseAction(action string) (string, error) {
+	switch action = strings.ToUpper(strings.TrimSpace(action)); action {
+	case actionDirect, actionProxy, actionReject:
+		return action, nil
+	}
+	return "", fmt.Errorf("unknown action: %s", action)
+}
+
+func (s *ruleSet) add(line string) (err error) {
+	fields := strings.Split(line, ",")
+	kind := strings.ToUpper(strings.TrimSpace(fields[0]))
+	if kind == "MATCH" || kind == "FINAL" {
+		if len(fields) != 2 {
+			return fmt.Errorf("expect %s,ACTION", kind)
+		}
+		s.final, err = parseAction(fields[1])
+		return
+	}
+	if len(fields) != 3 {
+		return errors.New("expect TYPE,VALUE,ACTION")
+	}
+	r := rule{kind: kind, value: strings.ToLower(strings.Trim(strings.TrimSpace(fields[1]), "."))}
+	if r.action, err = parseAction(fields[2]); err != nil {
+		return
+	}
+	switch kind {
+	case "DOMAIN", "DOMAIN-SUFFIX", "DOMAIN-KEYWORD":
+	case "DOMAIN-REGEX":
+		// the pattern is kept as written
+		if r.re, err = regexp.Compile(strings.TrimSpace(fields[1])); err != nil {
+			return
+		}
+	case "GEOIP":
+		if geoDB.Load() == nil {
+			return errors.New("GEOIP rules need a -geoip database")
+		}
+	case "RULE-SET":
+		if r.list, err = newRuleList(strings.TrimSpace(fields[1])); err != nil {
+			return
+		}
+	case "IP-CIDR", "IP-CIDR6":
+		if _, r.ipnet, err = net.ParseCIDR(r.value); err != nil {
+			return
+		}
+	default:
+		return fmt.Errorf("unknown rule type: %s", kind)
+	}
+	s.rules = append(s.rules, r)
+	return nil
+}
+
+// match returns the action for the socks address tgtAddr, a nil set sends
+// everything through the proxy.
+func (s *ruleSet) match(tgtAddr []byte) string {
+	if s == nil {
+		return actionProxy
+	}
+	host, _, err := net.SplitHostPort(socks5.AddrString(tgtAddr))
+	if err != nil {
+		return s.final
+	}
+	host = strings.ToLower(strings.TrimSuffix(host, "."))
+	ip := net.ParseIP(host)
+	country, looked := "", false
+	for _, r := range s.rules {
+		if r.kind != "GEOIP" {
+			if r.matches(host, ip) {
+				return r.action
+			}
+			continue
+		}
+		if !looked {
+			country, looked = targetCountry(host, ip), true
+		}
+		if country != "" && country == r.value {
+			return r.action
+		}
+	}
+	return s.final
+}
+
+func targetCountry(host string, ip net.IP) string {
+	if ip == nil {
+		var err error
+		if ip, err = lookupHost(host); err != nil {
+			return ""
+		}
+	}
+	return geoCountry(ip)
+}
+
+func (r *rule) matches(host string, ip net.IP) bool {
+	if r.list != nil {
+		return r.list.matches(host, ip)
+	}
+	if r.ipnet != nil {
+		return ip != nil && r.ipnet.Contains(ip)
+	}
+	if ip != nil {
+		return false
+	}
+	switch r.kind {
+	case "DOMAIN":
+		return host == r.value
+	case "DOMAIN-SUFFIX":
+		return host == r.value || strings.HasSuffix(host, "."+r.value)
+	case "DOMAIN-KEYWORD":
+		return strings.Contains(host, r.value)
+	case "DOMAIN-REGEX":
+		return r.re.MatchString(host)
+	}
+	return false
+}
+
+// routeAction returns the action for tgtAddr, with fake IPs standing for
+// their domains.
+func routeAction(tgtAddr []byte) string {
+	return activeRules.Load().match(fakeIPs.resolve(tgtAddr))
+}
+
+// dialTarget connects to tgtAddr as the rules say: directly, through the
+// tunnel, or not at all. It returns the connection and the server it goes
+// through, or "direct".
+func dialTarget(tgtAddr []byte) (net.Conn, string, error) {
+	tgtAddr = fakeIPs.resolve(tgtAddr)
+	switch activeRules.Load().match(tgtAddr) {
+	case actionReject:
+		return nil, "", errRejected
+	case actionDirect:
+		d := &net.Dialer{Timeout: dialTimeout, Control: loopControl}
+		conn, err := withRetry(func() (net.Conn, error) {
+			return d.Dial("tcp", socks5.AddrString(tgtAddr))
+		})
+		if err == nil {
+			setSockOpts(conn)
+		}
+		return conn, "direct", err
+	}
+	tgtAddr, err := targetAddr(tgtAddr)
+	if err != nil {
+		return nil, "", err
+	}
+	// each try picks a server of the pool again
+	var server string
+	conn, err := withRetry(func() (conn net.Conn, err error) {
+		conn, server, err = dialTunnel(tgtAddr)
+		return conn, err
+	})
+	return conn, server, err
+}
+
+// reloadRouting reloads the geoip database and the rules file on SIGHUP, it
+// reports whether there was any to reload.
+func reloadRouting() bool {
+	for _, f := range []struct {
+		path string
+		load func(string) error
+	}{{config.GeoIP, loadGeoIP}, {config.Rules, loadRules}} {
+		if f.path == "" {
+			continue
+		}
+		if err := f.load(f.path); err != nil {
+			slog.Error("reload error", "err", err)
+			continue
+		}
+		slog.Info("reloaded", "path", f.path)
+	}
+	return config.GeoIP != "" || config.Rules != ""
+}
@@ -0,0 +1,167 @@
+package tunnel
+
+import (
+	"errors"
+	"log/slog"
+	"net"
+	"sort"
+	"sync"
+	"sync/atomic"
+	"time"
+)
+
+// session is an active relay between a client and its target.
+type session struct {
+	id       uint64
+	client   string
+	target   string
+	start    time.Time
+	up, down int64 // bytes, updated atomically
+
+	conns []net.Conn
+}
+
+type sessionTable struct {
+	sync.Mutex
+	nextID   uint64
+	m        map[uint64]*session
+	total    uint64
+	up, down int64 // bytes of closed sessions
+}
+
+var sessions = &sessionTable{m: make(map[uint64]*session)}
+
+func (t *sessionTable) add(client, target string, conns ...net.Conn) *session {
+	t.Lock()
+	defer t.Unlock()
+	t.nextID++
+	t.total++
+	s := &session{id: t.nextID, client: client, target: target, start: time.Now(), conns: conns}
+	t.m[s.id] = s
+	return s
+}
+
+func (t *sessionTable) remove(s *session) {
+	t.Lock()
+	defer t.Unlock()
+	delete(t.m, s.id)
+	t.up += atomic.LoadInt64(&s.up)
+	t.down += atomic.LoadInt64(&s.down)
+}
+
+// list returns the active sessions ordered by id.
+func (t *sessionTable) list() []*session {
+	t.Lock()
+	defer t.Unlock()
+	l := make([]*session, 0, len(t.m))
+	for _, s := range t.m {
+		l = append(l, s)
+	}
+	sort.Slice(l, func(i, j int) bool { return l[i].id < l[j].id })
+	return l
+}
+
+// kill closes the connections of a session, which ends its relay.
+func (t *sessionTable) kill(id uint64) bool {
+	t.Lock()
+	s, ok := t.m[id]
+	t.Unlock()
+	if !ok {
+		return false
+	}
+	for _, c := range s.conns {
+		c.Close()
+	}
+	return true
+}
+
+// closeAll closes the connections of all active sessions.
+func (t *sessionTable) closeAll() {
+	for _, s := range t.list() {
+		for _, c := range s.conns {
+			c.Close()
+		}
+	}
+}
+
+// stats returns the number of active and total sessions, and bytes relayed.
+func (t *sessionTable) stats() (active int, total uint64, up, down int64) {
+	t.Lock()
+	defer t.Unlock()
+	up, down = t.up, t.down
+	for _, s := range t.m {
+		up += atomic.LoadInt64(&s.up)
+		down += atomic.LoadInt64(&s.down)
+	}
+	return len(t.m), t.total, up, down
+}
+
+// relay copies data between client and remote until both directions are
+// done, then logs the session. A side closing its write half only ends the
+// direction from it.
+func relay(client, remote net.Conn, target string) {
+	s := sessions.add(client.RemoteAddr().String(), target, client, remote)
+	defer sessions.remove(s)
+	up := make(chan error, 1)
+	down := make(chan error, 1)
+	connUp, connDown := NewLimiter(config.ConnLimitUp*1024), NewLimiter(config.ConnLimitDown*1024)
+	// the deadlines of the handshake are done with
+	client.SetDeadline(time.Time{})
+	remote.SetDeadline(time.Time{})
+	idle := watchIdle(client, remote)
+	defer idle.stop()
+	go func() { up <- transfer(remote, client, &s.up, idle, connUp, upLimiter) }()
+	go func() { down <- transfer(client, remote, &s.down, idle, connDown, downLimiter) }()
+	var reason string
+	select {
+	case err := <-up:
+		reason = closeReason("client", err)
+		halfClose(remote, client, err)
+		<-down
+	case err := <-down:
+		reason = closeReason("target", err)
+		halfClose(client, remote, err)
+		<-up
+	}
+	slog.Info("closed", "client", s.client, "target", target,
+		"up", atomic.LoadInt64(&s.up), "down", atomic.LoadInt64(&s.down),
+		"duration", time.Since(s.start).Round(time.Millisecond), "reason", reason)
+}
+
+// closeReason tells why the relay ended, as the transfer from side returned
+// err first.
+func closeReason(side string, err error) string {
+	var ne net.Error
+	switch {
+	case err == nil:
+		return side + " closed"
+	case errors.Is(err, net.ErrClosed):
+		// by ctl kill or on quit
+		return "killed"
+	case errors.As(err, &ne) && ne.Timeout():
+		return "idle timeout"
+	default:
+		return side + " error: " + err.Error()
+	}
+}
+
+// drain waits up to timeout for the active sessions to end once the
+// listeners are closed, then closes the ones left.
+func drain(timeout time.Duration) {
+	active, _, _, _ := sessions.stats()
+	if active == 0 {
+		return
+	}
+	slog.Info("waiting for connections to finish, interrupt again to quit now", "connections", active, "timeout", timeout)
+	deadline := time.Now().Add(timeout)
+	tick := time.NewTicker(100 * time.Millisecond)
+	defer tick.Stop()
+	for time.Now().Before(deadline) {
+		<-tick.C
+		if active, _, _, _ = sessions.stats(); active == 0 {
+			return
+		}
+	}
+	slog.Info("closing connections", "connections", active)
+	sessions.closeAll()
+}
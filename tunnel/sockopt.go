@@ -0,0 +1,37 @@
+package tunnel
+
+import (
+	"net"
+	"time"
+)
+
+// setSockOpts applies -keepalive, -delay and -linger to c, the tcp conn of a
+// client or a dial, or the tls conn over one. Other conns are left as they
+// are. The zero value of each leaves Go's default, so a Config made without
+// the flags behaves like them.
+func setSockOpts(c net.Conn) {
+	if nc, ok := c.(interface{ NetConn() net.Conn }); ok {
+		c = nc.NetConn()
+	}
+	tc, ok := c.(*net.TCPConn)
+	if !ok {
+		return
+	}
+	switch {
+	case config.KeepAlive > 0:
+		d := time.Duration(config.KeepAlive) * time.Second
+		tc.SetKeepAliveConfig(net.KeepAliveConfig{Enable: true, Idle: d, Interval: d})
+	case config.KeepAlive < 0:
+		tc.SetKeepAlive(false)
+	}
+	if config.Delay {
+		tc.SetNoDelay(false)
+	}
+	switch {
+	case config.Linger > 0:
+		tc.SetLinger(config.Linger)
+	case config.Linger < 0:
+		// reset at once
+		tc.SetLinger(0)
+	}
+}
@@ -0,0 +1,74 @@
+package tunnel
+
+import (
+	"net"
+
+	"golang.org/x/sys/unix"
+)
+
+// maxSplice is the most moved in one splice call, the default size of a pipe.
+const maxSplice = 64 * 1024
+
+// splice moves src to dst through a pipe with splice(2), so the data of two
+// plain tcp connections, like those of direct targets or of -m none, never
+// comes to userspace. m is told of what moved as transfer does. handled is
+// false if no pipe could be made, and the caller should copy instead.
+func splice(dst, src *net.TCPConn, m *meter) (handled bool, err error) {
+	rc, err := src.SyscallConn()
+	if err != nil {
+		return false, nil
+	}
+	wc, err := dst.SyscallConn()
+	if err != nil {
+		return false, nil
+	}
+	var p [2]int
+	if err := unix.Pipe2(p[:], unix.O_CLOEXEC|unix.O_NONBLOCK); err != nil {
+		return false, nil
+	}
+	defer unix.Close(p[0])
+	defer unix.Close(p[1])
+	for {
+		var n int64
+		var serr error
+		err = rc.Read(func(fd uintptr) bool {
+			for {
+				n, serr = unix.Splice(int(fd), nil, p[1], nil, maxSplice, unix.SPLICE_F_MOVE|unix.SPLICE_F_NONBLOCK)
+				if serr != unix.EINTR {
+					// wait for data on EAGAIN
+					return serr != unix.EAGAIN
+				}
+			}
+		})
+		if err == nil {
+			err = serr
+		}
+		if err != nil {
+			return true, err
+		}
+		if n == 0 {
+			// EOF
+			return true, nil
+		}
+		m.wait(int(n))
+		for n > 0 {
+			var w int64
+			err = wc.Write(func(fd uintptr) bool {
+				for {
+					w, serr = unix.Splice(p[0], nil, int(fd), nil, int(n), unix.SPLICE_F_MOVE|unix.SPLICE_F_NONBLOCK)
+					if serr != unix.EINTR {
+						return serr != unix.EAGAIN
+					}
+				}
+			})
+			if err == nil {
+				err = serr
+			}
+			if err != nil {
+				return true, err
+			}
+			n -= w
+			m.done(int(w))
+		}
+	}
+}
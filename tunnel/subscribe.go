@@ -0,0 +1,93 @@
+package tunnel
+
+import (
+	"encoding/json"
+	"errors"
+	"fmt"
+	"log/slog"
+	"net"
+	"net/http"
+	"strconv"
+	"time"
+)
+
+// SIP008 online configuration:
+// https://shadowsocks.org/doc/sip008.html
+type sip008 struct {
+	Version int `json:"version"`
+	Servers []struct {
+		ID         string `json:"id"`
+		Remarks    string `json:"remarks"`
+		Server     string `json:"server"`
+		ServerPort int    `json:"server_port"`
+		Password   string `json:"password"`
+		Method     string `json:"method"`
+		Plugin     string `json:"plugin"`
+	} `json:"servers"`
+}
+
+var subscribeClient = &http.Client{Timeout: 30 * time.Second}
+
+// fetchServers downloads the SIP008 document at url and returns the servers
+// it lists that can be used, in order.
+func fetchServers(url string) ([]*keys, error) {
+	resp, err := subscribeClient.Get(url)
+	if err != nil {
+		return nil, err
+	}
+	defer resp.Body.Close()
+	if resp.StatusCode != http.StatusOK {
+		return nil, fmt.Errorf("unexpected status: %s", resp.Status)
+	}
+	var doc sip008
+	if err = json.NewDecoder(resp.Body).Decode(&doc); err != nil {
+		return nil, err
+	}
+	if doc.Version != 1 {
+		return nil, fmt.Errorf("unsupported version: %d", doc.Version)
+	}
+	var servers []*keys
+	for _, s := range doc.Servers {
+		k := &keys{
+			server:   net.JoinHostPort(s.Server, strconv.Itoa(s.ServerPort)),
+			method:   s.Method,
+			password: s.Password,
+		}
+		if s.Plugin != "" {
+			slog.Warn("subscription: skip server, plugins are not supported", "server", k.server)
+			continue
+		}
+		if err := k.check(); err != nil {
+			slog.Warn("subscription: skip server", "server", k.server, "err", err)
+			continue
+		}
+		servers = append(servers, k)
+	}
+	if len(servers) == 0 {
+		return nil, errors.New("no usable server")
+	}
+	return servers, nil
+}
+
+// subscribe makes the servers of the subscription the pool of the local side.
+func subscribe(url string) error {
+	servers, err := fetchServers(url)
+	if err != nil {
+		return err
+	}
+	if activePool.Load().equal(servers) {
+		return nil
+	}
+	activePool.Store(&pool{servers: servers})
+	slog.Info("subscription: using servers", "servers", len(servers))
+	return nil
+}
+
+// refreshSubscription fetches the subscription again every interval.
+func refreshSubscription(url string, interval time.Duration) {
+	for range time.Tick(interval) {
+		if err := subscribe(url); err != nil {
+			slog.Warn("fail to refresh subscription", "err", err)
+		}
+	}
+}
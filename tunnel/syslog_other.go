@@ -0,0 +1,53 @@
+//go:build !windows
+
+package tunnel
+
+import (
+	"log/slog"
+	"log/syslog"
+	"strings"
+	"sync"
+)
+
+// syslogWriter writes each record with the severity of its level.
+type syslogWriter struct {
+	sync.Mutex
+	w     *syslog.Writer
+	level slog.Level
+}
+
+// dialSyslog connects to the local syslog for "syslog", which journald reads
+// as well, or to the remote one of syslog://host:port or
+// syslog+tcp://host:port.
+func dialSyslog(target string) (*syslogWriter, error) {
+	network, addr := "", ""
+	if rest, ok := strings.CutPrefix(target, "syslog://"); ok {
+		network, addr = "udp", rest
+	} else if rest, ok := strings.CutPrefix(target, "syslog+tcp://"); ok {
+		network, addr = "tcp", rest
+	}
+	w, err := syslog.Dial(network, addr, syslog.LOG_INFO|syslog.LOG_DAEMON, "socksproxy")
+	if err != nil {
+		return nil, err
+	}
+	return &syslogWriter{w: w}, nil
+}
+
+func (s *syslogWriter) Write(p []byte) (int, error) {
+	msg := strings.TrimSuffix(string(p), "\n")
+	var err error
+	switch {
+	case s.level >= slog.LevelError:
+		err = s.w.Err(msg)
+	case s.level >= slog.LevelWarn:
+		err = s.w.Warning(msg)
+	case s.level >= slog.LevelInfo:
+		err = s.w.Info(msg)
+	default:
+		err = s.w.Debug(msg)
+	}
+	if err != nil {
+		return 0, err
+	}
+	return len(p), nil
+}
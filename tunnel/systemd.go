@@ -0,0 +1,94 @@
+package tunnel
+
+import (
+	"fmt"
+	"log/slog"
+	"net"
+	"os"
+	"strconv"
+	"time"
+)
+
+// systemd passes the sockets of socket activation from fd 3 on, with
+// LISTEN_PID set to the pid they are for.
+const listenFDsStart = 3
+
+// inheritSystemd takes the sockets systemd passed, keyed by their address
+// like the listeners, so listenTCP and listenUDP use them instead of
+// listening again.
+func inheritSystemd() {
+	pid, err := strconv.Atoi(os.Getenv("LISTEN_PID"))
+	if err != nil || pid != os.Getpid() {
+		return
+	}
+	n, _ := strconv.Atoi(os.Getenv("LISTEN_FDS"))
+	os.Unsetenv("LISTEN_PID")
+	os.Unsetenv("LISTEN_FDS")
+	os.Unsetenv("LISTEN_FDNAMES")
+	for fd := listenFDsStart; fd < listenFDsStart+n; fd++ {
+		f := os.NewFile(uintptr(fd), "systemd")
+		if key := socketKey(f); key != "" {
+			sockets.inherited[key] = f
+		} else {
+			f.Close()
+		}
+	}
+}
+
+// socketKey returns "tcp:addr" or "udp:addr" for the socket f, or "" if it is
+// neither.
+func socketKey(f *os.File) string {
+	if ln, err := net.FileListener(f); err == nil {
+		defer ln.Close()
+		return ln.Addr().Network() + ":" + ln.Addr().String()
+	}
+	if pc, err := net.FilePacketConn(f); err == nil {
+		defer pc.Close()
+		return pc.LocalAddr().Network() + ":" + pc.LocalAddr().String()
+	}
+	return ""
+}
+
+// sdNotify sends state to systemd for Type=notify units, it does nothing
+// outside of systemd.
+func sdNotify(state string) {
+	path := os.Getenv("NOTIFY_SOCKET")
+	if path == "" {
+		return
+	}
+	// a leading @ is the abstract namespace, which net handles itself
+	conn, err := net.DialUnix("unixgram", nil, &net.UnixAddr{Name: path, Net: "unixgram"})
+	if err != nil {
+		slog.Warn("sd_notify error", "err", err)
+		return
+	}
+	defer conn.Close()
+	if _, err = conn.Write([]byte(state)); err != nil {
+		slog.Warn("sd_notify error", "err", err)
+	}
+}
+
+// notifyReady tells systemd the listeners are open. MAINPID follows the
+// process a restart started, if the unit has NotifyAccess=all.
+func notifyReady() {
+	sdNotify(fmt.Sprintf("READY=1\nMAINPID=%d", os.Getpid()))
+	usec, err := strconv.Atoi(os.Getenv("WATCHDOG_USEC"))
+	if err != nil || usec <= 0 {
+		return
+	}
+	if pid, err := strconv.Atoi(os.Getenv("WATCHDOG_PID")); err == nil && pid != os.Getpid() {
+		return
+	}
+	go watchdog(time.Duration(usec) * time.Microsecond / 2)
+}
+
+// watchdog pings systemd for WatchdogSec= of the unit, which restarts the
+// proxy when the pings stop.
+func watchdog(interval time.Duration) {
+	for range time.Tick(interval) {
+		// every relay takes the session table lock, so the pings stop when
+		// it wedges
+		sessions.stats()
+		sdNotify("WATCHDOG=1")
+	}
+}
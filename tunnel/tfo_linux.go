@@ -0,0 +1,93 @@
+package tunnel
+
+import (
+	"log/slog"
+	"net"
+	"os"
+	"syscall"
+	"time"
+
+	"golang.org/x/sys/unix"
+)
+
+// fastOpenQueue is the number of TFO connections a listener keeps waiting to
+// be accepted.
+const fastOpenQueue = 256
+
+// fastOpenDial is the net.Dialer Control of the dials to the server with
+// -fast-open: the data of the first write goes with the SYN once the server
+// gave its cookie. A kernel without TFO dials as usual.
+func fastOpenDial(network, address string, c syscall.RawConn) error {
+	var serr error
+	if err := c.Control(func(fd uintptr) {
+		serr = unix.SetsockoptInt(int(fd), unix.IPPROTO_TCP, unix.TCP_FASTOPEN_CONNECT, 1)
+	}); err != nil {
+		return err
+	}
+	if serr != nil {
+		slog.Debug("fail to enable tcp fast open", "addr", address, "err", serr)
+	}
+	return nil
+}
+
+// fastOpen lets ln accept connections with data in their SYN, with
+// -fast-open.
+func fastOpen(ln net.Listener) {
+	tl, ok := ln.(*net.TCPListener)
+	if !ok {
+		return
+	}
+	raw, err := tl.SyscallConn()
+	if err != nil {
+		return
+	}
+	var serr error
+	raw.Control(func(fd uintptr) {
+		serr = unix.SetsockoptInt(int(fd), unix.IPPROTO_TCP, unix.TCP_FASTOPEN, fastOpenQueue)
+	})
+	if serr != nil {
+		slog.Warn("fail to enable tcp fast open", "addr", ln.Addr().String(), "err", serr)
+	}
+}
+
+// fastOpenConnected waits for the handshake of conn, dialed with -fast-open,
+// to end. The SYN only leaves with the first write, so until then a server
+// down looks connected: waiting after the write of the target address makes
+// it a dial error, retried and counted by the circuit breaker, and still
+// lets that address go with the SYN.
+func fastOpenConnected(conn net.Conn) error {
+	tc, ok := conn.(*net.TCPConn)
+	if !ok {
+		return nil
+	}
+	raw, err := tc.SyscallConn()
+	if err != nil {
+		return err
+	}
+	tc.SetWriteDeadline(time.Now().Add(dialTimeout))
+	defer tc.SetWriteDeadline(time.Time{})
+	var serr error
+	err = raw.Write(func(fd uintptr) bool {
+		if errno, err := unix.GetsockoptInt(int(fd), unix.SOL_SOCKET, unix.SO_ERROR); err != nil || errno != 0 {
+			serr = err
+			if errno != 0 {
+				serr = syscall.Errno(errno)
+			}
+			return true
+		}
+		info, err := unix.GetsockoptTCPInfo(int(fd), unix.IPPROTO_TCP, unix.TCP_INFO)
+		if err != nil {
+			serr = err
+			return true
+		}
+		// writable once the SYN is answered
+		return info.State != unix.BPF_TCP_SYN_SENT
+	})
+	if err != nil {
+		return err
+	}
+	if serr != nil {
+		return &net.OpError{Op: "dial", Net: "tcp", Addr: tc.RemoteAddr(), Err: os.NewSyscallError("connect", serr)}
+	}
+	return nil
+}
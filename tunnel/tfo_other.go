@@ -0,0 +1,15 @@
+//go:build !linux
+
+package tunnel
+
+import (
+	"net"
+	"syscall"
+)
+
+// tcp fast open is only done on linux, -fast-open is ignored elsewhere
+var fastOpenDial func(network, address string, c syscall.RawConn) error
+
+func fastOpen(ln net.Listener) {}
+
+func fastOpenConnected(conn net.Conn) error { return nil }
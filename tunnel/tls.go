@@ -0,0 +1,103 @@
+package tunnel
+
+import (
+	"crypto/tls"
+	"crypto/x509"
+	"errors"
+	"fmt"
+	"net"
+	"os"
+)
+
+func listenTLS(addr string) (net.Listener, error) {
+	tlsConfig, err := serverTLSConfig()
+	if err != nil {
+		return nil, err
+	}
+	ln, err := listenTCP(addr)
+	if err != nil {
+		return nil, err
+	}
+	return tls.NewListener(ln, tlsConfig), nil
+}
+
+// serverTLSConfig uses -tls-cert and -tls-key, and requires client
+// certificates signed by -tls-client-ca if set.
+func serverTLSConfig() (*tls.Config, error) {
+	if config.TLSCert == "" || config.TLSKey == "" {
+		return nil, errors.New("tls certificate and key are required")
+	}
+	cert, err := tls.LoadX509KeyPair(config.TLSCert, config.TLSKey)
+	if err != nil {
+		return nil, err
+	}
+	tlsConfig := &tls.Config{Certificates: []tls.Certificate{cert}}
+	if config.TLSClientCA != "" {
+		pool, err := loadCertPool(config.TLSClientCA)
+		if err != nil {
+			return nil, err
+		}
+		tlsConfig.ClientCAs = pool
+		tlsConfig.ClientAuth = tls.RequireAndVerifyClientCert
+	}
+	return tlsConfig, nil
+}
+
+func loadCertPool(file string) (*x509.CertPool, error) {
+	pem, err := os.ReadFile(file)
+	if err != nil {
+		return nil, err
+	}
+	pool := x509.NewCertPool()
+	if !pool.AppendCertsFromPEM(pem) {
+		return nil, fmt.Errorf("no certificate found in %s", file)
+	}
+	return pool, nil
+}
+
+// tlsTransport runs the tunnel inside tls. The local side checks the server
+// certificate against -tls-ca, or the system roots, and presents
+// -tls-client-cert when the server asks for one.
+type tlsTransport struct {
+	conf *tls.Config
+}
+
+func NewTLSTransport() (*tlsTransport, error) {
+	conf, err := clientTLSConfig()
+	if err != nil {
+		return nil, err
+	}
+	return &tlsTransport{conf: conf}, nil
+}
+
+func clientTLSConfig() (*tls.Config, error) {
+	conf := &tls.Config{ServerName: config.TLSServerName}
+	if config.TLSCA != "" {
+		pool, err := loadCertPool(config.TLSCA)
+		if err != nil {
+			return nil, err
+		}
+		conf.RootCAs = pool
+	}
+	if config.TLSClientCert != "" {
+		cert, err := tls.LoadX509KeyPair(config.TLSClientCert, config.TLSClientKey)
+		if err != nil {
+			return nil, err
+		}
+		conf.Certificates = []tls.Certificate{cert}
+	}
+	return conf, nil
+}
+
+func (t *tlsTransport) Dial(addr string) (net.Conn, error) {
+	conn, err := tls.DialWithDialer(&net.Dialer{Timeout: dialTimeout}, "tcp", addr, t.conf)
+	if err != nil {
+		return nil, err
+	}
+	setSockOpts(conn)
+	return conn, nil
+}
+
+func (t *tlsTransport) Listen(addr string) (net.Listener, error) {
+	return listenTLS(addr)
+}
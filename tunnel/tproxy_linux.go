@@ -0,0 +1,183 @@
+package tunnel
+
+import (
+	"context"
+	"encoding/binary"
+	"errors"
+	"log/slog"
+	"net"
+	"sync"
+	"syscall"
+	"time"
+
+	"github.com/daogan/socksproxy/socks5"
+	"golang.org/x/sys/unix"
+)
+
+// transparentControl marks a socket IP_TRANSPARENT, so it accepts traffic for
+// any destination and may bind to foreign addresses.
+func transparentControl(network, address string, c syscall.RawConn) error {
+	var err error
+	cerr := c.Control(func(fd uintptr) {
+		if err = unix.SetsockoptInt(int(fd), unix.SOL_IP, unix.IP_TRANSPARENT, 1); err != nil {
+			return
+		}
+		// only for ipv6 sockets
+		unix.SetsockoptInt(int(fd), unix.SOL_IPV6, unix.IPV6_TRANSPARENT, 1)
+		if network == "udp" || network == "udp4" || network == "udp6" {
+			if err = unix.SetsockoptInt(int(fd), unix.SOL_SOCKET, unix.SO_REUSEADDR, 1); err != nil {
+				return
+			}
+			if err = unix.SetsockoptInt(int(fd), unix.SOL_IP, unix.IP_RECVORIGDSTADDR, 1); err != nil {
+				return
+			}
+			unix.SetsockoptInt(int(fd), unix.SOL_IPV6, unix.IPV6_RECVORIGDSTADDR, 1)
+		}
+	})
+	if cerr != nil {
+		return cerr
+	}
+	return err
+}
+
+var transparent = net.ListenConfig{Control: transparentControl}
+
+func listenTProxy(addr string) (net.Listener, error) {
+	return transparent.Listen(context.Background(), "tcp", addr)
+}
+
+func listenTProxyUDP(addr string) (*net.UDPConn, error) {
+	pc, err := transparent.ListenPacket(context.Background(), "udp", addr)
+	if err != nil {
+		return nil, err
+	}
+	return pc.(*net.UDPConn), nil
+}
+
+// origDstUDP returns the destination of a udp packet intercepted by TPROXY,
+// from its IP_ORIGDSTADDR control message.
+func origDstUDP(oob []byte) (*net.UDPAddr, error) {
+	msgs, err := unix.ParseSocketControlMessage(oob)
+	if err != nil {
+		return nil, err
+	}
+	for _, m := range msgs {
+		// sockaddr_in: family, port, addr
+		if m.Header.Level == unix.SOL_IP && m.Header.Type == unix.IP_ORIGDSTADDR && len(m.Data) >= 8 {
+			return &net.UDPAddr{IP: net.IP(m.Data[4:8]), Port: int(binary.BigEndian.Uint16(m.Data[2:]))}, nil
+		}
+		// sockaddr_in6: family, port, flow info, addr
+		if m.Header.Level == unix.SOL_IPV6 && m.Header.Type == unix.IPV6_ORIGDSTADDR && len(m.Data) >= 24 {
+			return &net.UDPAddr{IP: net.IP(m.Data[8:24]), Port: int(binary.BigEndian.Uint16(m.Data[2:]))}, nil
+		}
+	}
+	return nil, errors.New("no original destination")
+}
+
+// tproxyAssoc is the udp tunnel of one intercepted client. Replies are sent
+// back from sockets bound to the address they come from, so the client sees
+// the real source.
+type tproxyAssoc struct {
+	client  *net.UDPAddr
+	tun     net.Conn
+	replies map[string]net.PacketConn // by source address
+}
+
+type tproxyUDP struct {
+	sync.Mutex
+	assocs map[string]*tproxyAssoc // by client address
+}
+
+func serveTProxyUDP(pc *net.UDPConn) {
+	s := &tproxyUDP{assocs: make(map[string]*tproxyAssoc)}
+	buf := make([]byte, maxUDPSize)
+	oob := make([]byte, 1024)
+	names := make(nameCache)
+	for {
+		n, oobn, _, client, err := pc.ReadMsgUDP(buf, oob)
+		if err != nil {
+			slog.Error("udp read error", "err", err)
+			return
+		}
+		if !activeACL.Load().permits(client) {
+			continue
+		}
+		dst, err := origDstUDP(oob[:oobn])
+		if err != nil {
+			continue
+		}
+		dstAddr, err := socks5.EncodeAddr(dst.String())
+		if err != nil {
+			continue
+		}
+		a, err := s.assoc(client)
+		if err != nil {
+			slog.Warn("fail to open udp tunnel", "err", err)
+			continue
+		}
+		a.tun.SetDeadline(time.Now().Add(udpTimeout()))
+		if dstAddr, err = names.target(dstAddr); err != nil {
+			continue
+		}
+		if err = writePacket(a.tun, dstAddr, buf[:n]); err != nil {
+			a.tun.Close()
+		}
+	}
+}
+
+// assoc returns the association of client, dialing its tunnel if needed,
+// without the lock the tunnels of the other clients take to end.
+func (s *tproxyUDP) assoc(client *net.UDPAddr) (*tproxyAssoc, error) {
+	s.Lock()
+	a, ok := s.assocs[client.String()]
+	s.Unlock()
+	if ok {
+		return a, nil
+	}
+	tgtAddr, _ := socks5.EncodeAddr(udpOverTCPHost)
+	tun, _, err := dialTunnel(tgtAddr)
+	if err != nil {
+		return nil, err
+	}
+	s.Lock()
+	defer s.Unlock()
+	if a, ok := s.assocs[client.String()]; ok {
+		tun.Close()
+		return a, nil
+	}
+	a = &tproxyAssoc{client: client, tun: tun, replies: make(map[string]net.PacketConn)}
+	s.assocs[client.String()] = a
+	go s.readTunnel(a)
+	return a, nil
+}
+
+func (s *tproxyUDP) readTunnel(a *tproxyAssoc) {
+	defer func() {
+		s.Lock()
+		delete(s.assocs, a.client.String())
+		s.Unlock()
+		a.tun.Close()
+		for _, pc := range a.replies {
+			pc.Close()
+		}
+	}()
+	buf := make([]byte, maxUDPSize)
+	for {
+		// returns on idle timeout too
+		addr, data, err := readPacket(a.tun, buf)
+		if err != nil {
+			return
+		}
+		a.tun.SetDeadline(time.Now().Add(udpTimeout()))
+		src := socks5.AddrString(addr)
+		pc, ok := a.replies[src]
+		if !ok {
+			if pc, err = transparent.ListenPacket(context.Background(), "udp", src); err != nil {
+				slog.Warn("fail to bind udp reply address", "addr", src, "err", err)
+				continue
+			}
+			a.replies[src] = pc
+		}
+		pc.WriteTo(data, a.client)
+	}
+}
@@ -0,0 +1,20 @@
+//go:build !linux
+
+package tunnel
+
+import (
+	"errors"
+	"net"
+)
+
+var errNoTProxy = errors.New("tproxy is only supported on linux")
+
+func listenTProxy(addr string) (net.Listener, error) {
+	return nil, errNoTProxy
+}
+
+func listenTProxyUDP(addr string) (*net.UDPConn, error) {
+	return nil, errNoTProxy
+}
+
+func serveTProxyUDP(pc *net.UDPConn) {}
@@ -0,0 +1,274 @@
+package tunnel
+
+import (
+	"bytes"
+	"crypto/rand"
+	"encoding/hex"
+	"encoding/json"
+	"fmt"
+	"log/slog"
+	mrand "math/rand"
+	"net"
+	"net/http"
+	"strconv"
+	"strings"
+	"sync"
+	"syscall"
+	"time"
+)
+
+// A trace follows one connection through its handshake, the dial of its
+// target, on the server side split in the name resolution and the connect,
+// and the relay. The spans are sent to an OTLP collector over http in the
+// json encoding.
+
+const (
+	spanKindInternal = 1
+	spanKindServer   = 2
+	spanStatusError  = 2
+
+	traceBatch = 512
+)
+
+// traceSpans queues finished spans for the exporter, or is nil when tracing
+// is off.
+var traceSpans chan *span
+
+type span struct {
+	trace  *trace
+	id     [8]byte
+	parent [8]byte
+	name   string
+	kind   int
+	start  time.Time
+	end    time.Time
+	attrs  map[string]string
+	err    string
+}
+
+type trace struct {
+	id   [16]byte
+	root *span
+}
+
+// startTrace starts the trace of a connection accepted by what, or returns
+// nil when tracing is off or the trace isn't sampled. The methods of a nil
+// trace or span do nothing.
+func startTrace(what string, conn net.Conn) *trace {
+	if traceSpans == nil || !sampled() {
+		return nil
+	}
+	t := &trace{}
+	rand.Read(t.id[:])
+	t.root = t.newSpan(what, spanKindServer)
+	t.root.set("client", conn.RemoteAddr().String())
+	return t
+}
+
+func sampled() bool {
+	return config.OTLPSample >= 1 || mrand.Float64() < config.OTLPSample
+}
+
+func (t *trace) newSpan(name string, kind int) *span {
+	s := &span{trace: t, name: name, kind: kind, start: time.Now()}
+	rand.Read(s.id[:])
+	if t.root != nil {
+		s.parent = t.root.id
+	}
+	return s
+}
+
+// start starts a span of the connection.
+func (t *trace) start(name string) *span {
+	if t == nil {
+		return nil
+	}
+	return t.newSpan(name, spanKindInternal)
+}
+
+// set sets the attribute k of the connection.
+func (t *trace) set(k, v string) {
+	if t != nil {
+		t.root.set(k, v)
+	}
+}
+
+// finish ends the trace with err, if any, and queues it for export.
+func (t *trace) finish(err error) {
+	if t != nil {
+		t.root.finish(err)
+	}
+}
+
+// dial connects to target with the Dialer Control control, the addresses of
+// a host name with dialHappy, with a resolve span ending as the first
+// address is dialed and a connect span from there.
+func (t *trace) dial(target string, control func(network, address string, c syscall.RawConn) error) (net.Conn, error) {
+	d := &net.Dialer{Timeout: dialTimeout, Control: control}
+	if t == nil {
+		conn, err := dialHappy(d, target)
+		if err == nil {
+			setSockOpts(conn)
+		}
+		return conn, err
+	}
+	resolve := t.start("resolve")
+	var connect *span
+	var once sync.Once
+	d.Control = func(network, address string, c syscall.RawConn) error {
+		once.Do(func() {
+			resolve.set("address", address)
+			resolve.finish(nil)
+			connect = t.start("connect")
+		})
+		if control != nil {
+			return control(network, address, c)
+		}
+		return nil
+	}
+	conn, err := dialHappy(d, target)
+	once.Do(func() { resolve.finish(err) })
+	if connect != nil {
+		if err == nil {
+			connect.set("address", conn.RemoteAddr().String())
+		}
+		connect.finish(err)
+	}
+	if err == nil {
+		setSockOpts(conn)
+	}
+	return conn, err
+}
+
+func (s *span) set(k, v string) {
+	if s == nil {
+		return
+	}
+	if s.attrs == nil {
+		s.attrs = make(map[string]string)
+	}
+	s.attrs[k] = v
+}
+
+// finish ends the span, failed unless err is nil.
+func (s *span) finish(err error) {
+	if s == nil {
+		return
+	}
+	s.end = time.Now()
+	if err != nil {
+		s.err = err.Error()
+	}
+	select {
+	case traceSpans <- s:
+	default:
+		// the collector is behind, drop it
+	}
+}
+
+// initTracing starts exporting the traces to endpoint, e.g.
+// http://127.0.0.1:4318.
+func initTracing(endpoint string) {
+	url := strings.TrimSuffix(endpoint, "/")
+	if !strings.HasSuffix(url, "/v1/traces") {
+		url += "/v1/traces"
+	}
+	traceSpans = make(chan *span, 4*traceBatch)
+	go exportTraces(url)
+}
+
+func exportTraces(url string) {
+	client := &http.Client{Timeout: 10 * time.Second}
+	tick := time.NewTicker(5 * time.Second)
+	defer tick.Stop()
+	var batch []*span
+	for {
+		select {
+		case s := <-traceSpans:
+			if batch = append(batch, s); len(batch) < traceBatch {
+				continue
+			}
+		case <-tick.C:
+			if len(batch) == 0 {
+				continue
+			}
+		}
+		if err := postSpans(client, url, batch); err != nil {
+			slog.Warn("fail to export traces", "err", err)
+		}
+		batch = nil
+	}
+}
+
+type otlpValue struct {
+	StringValue string `json:"stringValue"`
+}
+
+type otlpAttr struct {
+	Key   string    `json:"key"`
+	Value otlpValue `json:"value"`
+}
+
+type otlpStatus struct {
+	Code    int    `json:"code,omitempty"`
+	Message string `json:"message,omitempty"`
+}
+
+type otlpSpan struct {
+	TraceID      string     `json:"traceId"`
+	SpanID       string     `json:"spanId"`
+	ParentSpanID string     `json:"parentSpanId,omitempty"`
+	Name         string     `json:"name"`
+	Kind         int        `json:"kind"`
+	Start        string     `json:"startTimeUnixNano"`
+	End          string     `json:"endTimeUnixNano"`
+	Attributes   []otlpAttr `json:"attributes,omitempty"`
+	Status       otlpStatus `json:"status"`
+}
+
+func postSpans(client *http.Client, url string, batch []*span) error {
+	spans := make([]otlpSpan, 0, len(batch))
+	for _, s := range batch {
+		o := otlpSpan{
+			TraceID: hex.EncodeToString(s.trace.id[:]),
+			SpanID:  hex.EncodeToString(s.id[:]),
+			Name:    s.name,
+			Kind:    s.kind,
+			Start:   strconv.FormatInt(s.start.UnixNano(), 10),
+			End:     strconv.FormatInt(s.end.UnixNano(), 10),
+		}
+		if s.parent != [8]byte{} {
+			o.ParentSpanID = hex.EncodeToString(s.parent[:])
+		}
+		for k, v := range s.attrs {
+			o.Attributes = append(o.Attributes, otlpAttr{k, otlpValue{v}})
+		}
+		if s.err != "" {
+			o.Status = otlpStatus{spanStatusError, s.err}
+		}
+		spans = append(spans, o)
+	}
+	body, err := json.Marshal(map[string]any{
+		"resourceSpans": []any{map[string]any{
+			"resource": map[string]any{
+				"attributes": []otlpAttr{{"service.name", otlpValue{"socksproxy"}}},
+			},
+			"scopeSpans": []any{map[string]any{
+				"scope": map[string]string{"name": "github.com/daogan/socksproxy/tunnel"},
+				"spans": spans,
+			}},
+		}},
+	})
+	if err != nil {
+		return err
+	}
+	resp, err := client.Post(url, "application/json", bytes.NewReader(body))
+	if err != nil {
+		return err
+	}
+	resp.Body.Close()
+	if resp.StatusCode/100 != 2 {
+		return fmt.Errorf("collector answered %s", resp.Status)
+	}
+	return nil
+}
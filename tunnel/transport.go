@@ -0,0 +1,62 @@
+package tunnel
+
+import (
+	"fmt"
+	"net"
+)
+
+// Transport carries the encrypted tunnel between local and server.
+type Transport interface {
+	Dial(addr string) (net.Conn, error)
+	Listen(addr string) (net.Listener, error)
+}
+
+type tcpTransport struct{}
+
+func (tcpTransport) Dial(addr string) (net.Conn, error) {
+	if !config.FastOpen {
+		return dialTCP(addr)
+	}
+	d := &net.Dialer{Timeout: dialTimeout, Control: fastOpenDial}
+	conn, err := d.Dial("tcp", addr)
+	if err == nil {
+		setSockOpts(conn)
+	}
+	return conn, err
+}
+
+func (tcpTransport) Listen(addr string) (net.Listener, error) {
+	ln, err := listenTCP(addr)
+	if err == nil && config.FastOpen {
+		fastOpen(ln)
+	}
+	return ln, err
+}
+
+var transport Transport = tcpTransport{}
+
+func NewTransport(name string) (Transport, error) {
+	if config.Plugin != "" {
+		if name != "" && name != "tcp" {
+			return nil, fmt.Errorf("plugins run over tcp, not %s", name)
+		}
+		return NewPluginTransport(config.Plugin, config.PluginOpts)
+	}
+	switch name {
+	case "", "tcp":
+		return tcpTransport{}, nil
+	case "obfs4":
+		return NewObfs4Transport(config.Obfs4Proxy, config.Obfs4State, config.Obfs4Bridge)
+	case "tls":
+		return NewTLSTransport()
+	case "quic":
+		return NewQUICTransport()
+	case "kcp":
+		return NewKCPTransport(config.KCPWindow, config.KCPDataShards, config.KCPParityShards), nil
+	case "ws", "wss":
+		return NewWSTransport(config.WSPath, config.WSHost, name == "wss")
+	case "http":
+		return NewHTTPObfsTransport(config.ObfsHost), nil
+	}
+	return nil, fmt.Errorf("unknown transport: %s", name)
+}
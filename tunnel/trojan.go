@@ -0,0 +1,127 @@
+package tunnel
+
+import (
+	"bytes"
+	"crypto/sha256"
+	"crypto/subtle"
+	"encoding/hex"
+	"errors"
+	"io"
+	"log/slog"
+	"net"
+
+	"github.com/daogan/socksproxy/socks5"
+)
+
+// https://trojan-gfw.github.io/trojan/protocol
+//
+//	+-----------------------+---------+----------------+---------+----------+
+//	| hex(SHA224(password)) |  CRLF   | Trojan Request |  CRLF   | Payload  |
+//	+-----------------------+---------+----------------+---------+----------+
+//	|          56           | X'0D0A' |    Variable    | X'0D0A' | Variable |
+//	+-----------------------+---------+----------------+---------+----------+
+//
+// Trojan Request is {CMD, ATYP, DST.ADDR, DST.PORT}. Anything that doesn't
+// start with the right password hash is handed to the fallback site, so the
+// server looks like an ordinary https host to probes.
+const trojanHashLen = 56
+
+func trojanHash(password string) []byte {
+	sum := sha256.Sum224([]byte(password))
+	return []byte(hex.EncodeToString(sum[:]))
+}
+
+var errTrojanHead = errors.New("invalid trojan request")
+
+// readTrojanHead reads into buf the len(head) bytes of the password hash and
+// CRLF, however they are split in segments, then compares them with head
+// once. Stopping at the first byte that differs would tell a prober by the
+// time of the fallback how much of the hash it got right, so only what
+// can't be a head at all, like the GET of a browser, stops the read early.
+func readTrojanHead(c net.Conn, buf, head []byte) (int, error) {
+	n := 0
+	for n < len(head) {
+		m, err := c.Read(buf[n:])
+		for i := n; i < n+m && i < len(head); i++ {
+			if i < trojanHashLen && !isLowerHex(buf[i]) || i >= trojanHashLen && buf[i] != head[i] {
+				return n + m, errTrojanHead
+			}
+		}
+		n += m
+		if err != nil && n < len(head) {
+			return n, err
+		}
+	}
+	if subtle.ConstantTimeCompare(buf[:len(head)], head) != 1 {
+		return n, errTrojanHead
+	}
+	return n, nil
+}
+
+// isLowerHex reports whether b is a digit of hex.EncodeToString.
+func isLowerHex(b byte) bool {
+	return '0' <= b && b <= '9' || 'a' <= b && b <= 'f'
+}
+
+func handleTrojan(c net.Conn) {
+	defer c.Close()
+	buf := make([]byte, bufSize)
+	setDeadline(c, config.RequestTimeout)
+	n, err := readTrojanHead(c, buf, append(trojanHash(activeKeys.Load().password), '\r', '\n'))
+	setDeadline(c, 0)
+	if err != nil && n == 0 {
+		return
+	}
+	if err != nil {
+		slog.Warn("invalid trojan request", "client", c.RemoteAddr().String())
+		handshakeFailures.Add(1)
+		failIP(c.RemoteAddr())
+		fallback(c, buf[:n])
+		return
+	}
+	r := io.MultiReader(bytes.NewReader(buf[trojanHashLen+2:n]), c)
+	cmd := make([]byte, 2)
+	if _, err = io.ReadFull(r, cmd[:1]); err != nil {
+		return
+	}
+	if cmd[0] != socks5.CmdConnect {
+		slog.Warn("not supported trojan command", "cmd", cmd[0])
+		return
+	}
+	tgtHost, err := readTargetHost(r)
+	if err != nil {
+		slog.Warn("fail to get target host from connection", "client", c.RemoteAddr().String(), "err", err)
+		return
+	}
+	// CRLF
+	if _, err = io.ReadFull(r, cmd); err != nil {
+		return
+	}
+	conn := &prefixConn{Conn: c, r: r}
+	if l := lookupListener(tgtHost); l != nil {
+		l.serve(conn)
+		return
+	}
+	eg := activeKeys.Load().egress
+	if err := eg.check("tcp", tgtHost); err != nil {
+		slog.Info("fail to dial target", "client", c.RemoteAddr().String(), "target", tgtHost, "err", err)
+		return
+	}
+	if err := checkLoop(tgtHost); err != nil {
+		slog.Warn("fail to dial target", "client", c.RemoteAddr().String(), "target", tgtHost, "err", err)
+		return
+	}
+	remote, err := dialOutbound(tgtHost, nil, eg)
+	if errors.Is(err, errPrivate) || errors.Is(err, errLoop) {
+		slog.Info("fail to dial target", "client", c.RemoteAddr().String(), "target", tgtHost, "err", err)
+		return
+	}
+	if err != nil {
+		slog.Warn("fail to dial target", "target", tgtHost, "err", err)
+		dialErrors.Add(1)
+		return
+	}
+	defer remote.Close()
+	slog.Debug("connecting", "client", c.RemoteAddr().String(), "target", tgtHost)
+	relay(conn, remote, tgtHost)
+}
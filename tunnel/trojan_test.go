@@ -0,0 +1,65 @@
+package tunnel
+
+import (
+	"errors"
+	"net"
+	"os"
+	"testing"
+	"time"
+)
+
+func TestTrojanHash(t *testing.T) {
+	// sha224sum of "password"
+	const want = "d63dc919e201d7bc4c825630d2cf25fdc93d4b2f0d46706d29038d01"
+	if got := string(trojanHash("password")); got != want {
+		t.Errorf("trojanHash = %s, want %s", got, want)
+	}
+}
+
+// readHead sends the segments to readTrojanHead one write at a time, giving
+// up after wait.
+func readHead(t *testing.T, head []byte, wait time.Duration, segments ...string) (int, error) {
+	t.Helper()
+	c, peer := net.Pipe()
+	defer c.Close()
+	defer peer.Close()
+	go func() {
+		for _, s := range segments {
+			if _, err := peer.Write([]byte(s)); err != nil {
+				return
+			}
+		}
+	}()
+	c.SetDeadline(time.Now().Add(wait))
+	return readTrojanHead(c, make([]byte, 512), head)
+}
+
+func TestReadTrojanHead(t *testing.T) {
+	hash := string(trojanHash("password"))
+	head := []byte(hash + "\r\n")
+	other := string(trojanHash("other"))
+
+	n, err := readHead(t, head, time.Second, hash[:10], hash[10:50], hash[50:]+"\r", "\n\x01\x01")
+	if err != nil || n < len(head) {
+		t.Errorf("split head: %d, %v", n, err)
+	}
+	if _, err = readHead(t, head, time.Second, other+"\r\n"); !errors.Is(err, errTrojanHead) {
+		t.Errorf("wrong hash: %v, want errTrojanHead", err)
+	}
+	if _, err = readHead(t, head, time.Second, hash+"\n\n"); !errors.Is(err, errTrojanHead) {
+		t.Errorf("no CRLF: %v, want errTrojanHead", err)
+	}
+
+	// what can't be a hash fails at once, a probe of the wrong hash waits for
+	// all of it whether its prefix is right or not
+	start := time.Now()
+	if _, err = readHead(t, head, time.Second, "GET / HTTP/1.1\r\n"); !errors.Is(err, errTrojanHead) || time.Since(start) > 500*time.Millisecond {
+		t.Errorf("http request: %v after %v, want errTrojanHead at once", err, time.Since(start))
+	}
+	for _, prefix := range []string{hash[:40], other[:40]} {
+		n, err = readHead(t, head, 100*time.Millisecond, prefix)
+		if !errors.Is(err, os.ErrDeadlineExceeded) || n != 40 {
+			t.Errorf("prefix %s: %d, %v, want the deadline", prefix[:8], n, err)
+		}
+	}
+}
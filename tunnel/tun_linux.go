@@ -0,0 +1,147 @@
+package tunnel
+
+import (
+	"errors"
+	"log/slog"
+	"net"
+	"strconv"
+	"time"
+
+	"github.com/daogan/socksproxy/socks5"
+	"gvisor.dev/gvisor/pkg/tcpip"
+	"gvisor.dev/gvisor/pkg/tcpip/adapters/gonet"
+	"gvisor.dev/gvisor/pkg/tcpip/header"
+	"gvisor.dev/gvisor/pkg/tcpip/link/fdbased"
+	"gvisor.dev/gvisor/pkg/tcpip/link/tun"
+	"gvisor.dev/gvisor/pkg/tcpip/network/ipv4"
+	"gvisor.dev/gvisor/pkg/tcpip/network/ipv6"
+	"gvisor.dev/gvisor/pkg/tcpip/stack"
+	"gvisor.dev/gvisor/pkg/tcpip/transport/tcp"
+	"gvisor.dev/gvisor/pkg/tcpip/transport/udp"
+	"gvisor.dev/gvisor/pkg/waiter"
+)
+
+const tunNIC tcpip.NICID = 1
+
+// runTun attaches a userspace tcp/ip stack to the tun device name, every tcp
+// connection and udp flow routed to the device is tunneled to its
+// destination.
+func runTun(name string, mtu int) error {
+	fd, err := tun.Open(name)
+	if err != nil {
+		return err
+	}
+	ep, err := fdbased.New(&fdbased.Options{FDs: []int{fd}, MTU: uint32(mtu)})
+	if err != nil {
+		return err
+	}
+	s := stack.New(stack.Options{
+		NetworkProtocols:   []stack.NetworkProtocolFactory{ipv4.NewProtocol, ipv6.NewProtocol},
+		TransportProtocols: []stack.TransportProtocolFactory{tcp.NewProtocol, udp.NewProtocol},
+	})
+	sack := tcpip.TCPSACKEnabled(true)
+	s.SetTransportProtocolOption(tcp.ProtocolNumber, &sack)
+	if terr := s.CreateNIC(tunNIC, ep); terr != nil {
+		return errors.New(terr.String())
+	}
+	// accept packets for any destination, and answer from it
+	s.SetPromiscuousMode(tunNIC, true)
+	s.SetSpoofing(tunNIC, true)
+	s.SetRouteTable([]tcpip.Route{
+		{Destination: header.IPv4EmptySubnet, NIC: tunNIC},
+		{Destination: header.IPv6EmptySubnet, NIC: tunNIC},
+	})
+
+	tcpFwd := tcp.NewForwarder(s, 0, 1024, func(r *tcp.ForwarderRequest) {
+		id := r.ID()
+		var wq waiter.Queue
+		ep, terr := r.CreateEndpoint(&wq)
+		if terr != nil {
+			r.Complete(true)
+			return
+		}
+		r.Complete(false)
+		go handleTunTCP(gonet.NewTCPConn(&wq, ep), tunAddr(id))
+	})
+	s.SetTransportProtocolHandler(tcp.ProtocolNumber, tcpFwd.HandlePacket)
+	udpFwd := udp.NewForwarder(s, func(r *udp.ForwarderRequest) bool {
+		id := r.ID()
+		var wq waiter.Queue
+		ep, terr := r.CreateEndpoint(&wq)
+		if terr != nil {
+			return false
+		}
+		go handleTunUDP(gonet.NewUDPConn(&wq, ep), tunAddr(id))
+		return true
+	})
+	s.SetTransportProtocolHandler(udp.ProtocolNumber, udpFwd.HandlePacket)
+	slog.Info("tun device", "name", name)
+	return nil
+}
+
+// tunAddr is the destination of a flow, the local end for the stack.
+func tunAddr(id stack.TransportEndpointID) string {
+	return net.JoinHostPort(id.LocalAddress.String(), strconv.Itoa(int(id.LocalPort)))
+}
+
+func handleTunTCP(conn net.Conn, dst string) {
+	defer conn.Close()
+	tgtAddr, err := socks5.EncodeAddr(dst)
+	if err != nil {
+		return
+	}
+	tr := startTrace("tun", conn)
+	defer tr.finish(nil)
+	tunnel(conn, tgtAddr, tr, nil)
+}
+
+// handleTunUDP relays one udp flow over its own udp tunnel, replies are sent
+// back from the flow destination.
+func handleTunUDP(conn net.Conn, dst string) {
+	defer conn.Close()
+	dstAddr, err := socks5.EncodeAddr(dst)
+	if err != nil {
+		return
+	}
+	if dstAddr, err = targetAddr(dstAddr); err != nil {
+		return
+	}
+	tgtAddr, _ := socks5.EncodeAddr(udpOverTCPHost)
+	tun, _, err := dialTunnel(tgtAddr)
+	if err != nil {
+		slog.Warn("fail to open udp tunnel", "err", err)
+		return
+	}
+	defer tun.Close()
+	timeout := udpTimeout()
+	if _, port, _ := net.SplitHostPort(dst); port == "53" {
+		timeout = udpDNSTimeout()
+	}
+	go func() {
+		defer conn.Close()
+		buf := make([]byte, maxUDPSize)
+		for {
+			_, data, err := readPacket(tun, buf)
+			if err != nil {
+				return
+			}
+			// replies keep the flow alive too
+			deadline := time.Now().Add(timeout)
+			conn.SetReadDeadline(deadline)
+			tun.SetDeadline(deadline)
+			conn.Write(data)
+		}
+	}()
+	buf := make([]byte, maxUDPSize)
+	for {
+		conn.SetReadDeadline(time.Now().Add(timeout))
+		n, err := conn.Read(buf)
+		if err != nil {
+			return
+		}
+		tun.SetDeadline(time.Now().Add(timeout))
+		if err = writePacket(tun, dstAddr, buf[:n]); err != nil {
+			return
+		}
+	}
+}
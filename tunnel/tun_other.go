@@ -0,0 +1,9 @@
+//go:build !linux
+
+package tunnel
+
+import "errors"
+
+func runTun(name string, mtu int) error {
+	return errors.New("tun is only supported on linux")
+}
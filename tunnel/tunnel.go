@@ -0,0 +1,419 @@
+// Package tunnel runs the local side and the server of socksproxy: the local
+// proxies, the encrypted tunnel over its transports, and the server relaying
+// to the targets.
+package tunnel
+
+import (
+	"bufio"
+	"context"
+	"errors"
+	"io"
+	"log/slog"
+	"net"
+	"syscall"
+
+	"github.com/daogan/socksproxy/socks5"
+)
+
+// Config holds the settings of the local side and the server, as given by
+// the command line flags and the json config file.
+type Config struct {
+	LocalAddr         string   `json:"local_address"`
+	UnixMode          string   `json:"unix_mode"`
+	ServerAddr        string   `json:"server_address"`
+	Servers           []string `json:"servers"`
+	Balance           string   `json:"balance"`
+	ProbeInterval     int      `json:"probe_interval"`
+	Mux               int      `json:"mux"`
+	Method            string   `json:"method"`
+	Password          string   `json:"password"`
+	URI               string   `json:"uri"`
+	Subscribe         string   `json:"subscribe"`
+	SubscribeInterval int      `json:"subscribe_interval"`
+	Compat            bool     `json:"compat"`
+	StreamSubkeys     bool     `json:"stream_subkeys"`
+	Transport         string   `json:"transport"`
+	Trojan            bool     `json:"trojan"`
+	Fallback          string   `json:"fallback"`
+	RelayAddr         string   `json:"relay_address"`
+	Outbound          string   `json:"outbound"`
+	Reverse           string   `json:"reverse"`
+	ReverseListen     string   `json:"reverse_listen"`
+	HTTPSAddr         string   `json:"https_address"`
+	HTTPAddr          string   `json:"http_address"`
+	RedirAddr         string   `json:"redir_address"`
+	TProxyAddr        string   `json:"tproxy_address"`
+	DNSAddr           string   `json:"dns_address"`
+	DNSServer         string   `json:"dns_server"`
+	FakeIP            string   `json:"fakeip"`
+	Resolve           string   `json:"resolve"`
+	DNSCheck          string   `json:"dns_check"`
+	Rules             string   `json:"rules"`
+	GeoIP             string   `json:"geoip"`
+	RuleListInterval  int      `json:"rule_list_interval"`
+	PACAddr           string   `json:"pac_address"`
+	PACDirect         string   `json:"pac_direct"`
+	Tun               string   `json:"tun"`
+	TunMTU            int      `json:"tun_mtu"`
+	LocalTLS          bool     `json:"local_tls"`
+	Auth              string   `json:"auth"`
+	LimitUp           int      `json:"limit_up"`
+	LimitDown         int      `json:"limit_down"`
+	Allow             string   `json:"allow"`
+	Deny              string   `json:"deny"`
+	AllowPorts        string   `json:"allow_ports"`
+	BlockPorts        string   `json:"block_ports"`
+	AllowPrivate      bool     `json:"allow_private"`
+	FastReply         bool     `json:"fast_reply"`
+	MaxConns          int      `json:"max_conns"`
+	IPMaxConns        int      `json:"ip_max_conns"`
+	IPConnRate        int      `json:"ip_conn_rate"`
+	BanFailures       int      `json:"ban_failures"`
+	BanTime           int      `json:"ban_time"`
+	ConnLimitUp       int      `json:"conn_limit_up"`
+	ConnLimitDown     int      `json:"conn_limit_down"`
+	Timeout           int      `json:"timeout"`
+	HandshakeTimeout  int      `json:"handshake_timeout"`
+	RequestTimeout    int      `json:"request_timeout"`
+	DialTimeout       int      `json:"dial_timeout"`
+	DialRetries       int      `json:"dial_retries"`
+	PreferIP          string   `json:"prefer_ip"`
+	FastOpen          bool     `json:"fast_open"`
+	KeepAlive         int      `json:"keepalive"`
+	Delay             bool     `json:"delay"`
+	Linger            int      `json:"linger"`
+	UDPTimeout        int      `json:"udp_timeout"`
+	UDPDNSTimeout     int      `json:"udp_dns_timeout"`
+	UDPMaxMappings    int      `json:"udp_max_mappings"`
+	UDPNAT            string   `json:"udp_nat"`
+	BindAddr          string   `json:"bind_address"`
+	DrainTimeout      int      `json:"drain_timeout"`
+	ReplayWindow      int      `json:"replay_window"`
+	CtlSocket         string   `json:"ctl_socket"`
+	ManagerAddr       string   `json:"manager_address"`
+	AdminAddr         string   `json:"admin_address"`
+	AdminToken        string   `json:"admin_token"`
+	MetricsAddr       string   `json:"metrics_address"`
+	DebugAddr         string   `json:"debug_address"`
+	LogLevel          string   `json:"log_level"`
+	LogFormat         string   `json:"log_format"`
+	LogTarget         string   `json:"log_target"`
+	OTLPEndpoint      string   `json:"otlp_endpoint"`
+	OTLPSample        float64  `json:"otlp_sample"`
+
+	TLSCert     string `json:"tls_cert"`
+	TLSKey      string `json:"tls_key"`
+	TLSClientCA string `json:"tls_client_ca"`
+
+	TLSCA         string `json:"tls_ca"`
+	TLSServerName string `json:"tls_server_name"`
+	TLSClientCert string `json:"tls_client_cert"`
+	TLSClientKey  string `json:"tls_client_key"`
+
+	Obfs4Proxy  string `json:"obfs4proxy"`
+	Obfs4State  string `json:"obfs4_state"`
+	Obfs4Bridge string `json:"obfs4_bridge"`
+
+	WSPath string `json:"ws_path"`
+	WSHost string `json:"ws_host"`
+
+	ObfsHost string `json:"obfs_host"`
+	Padding  string `json:"padding"`
+
+	HopInterval int    `json:"hop_interval"`
+	HopSecret   string `json:"hop_secret"`
+
+	Plugin     string `json:"plugin"`
+	PluginOpts string `json:"plugin_opts"`
+
+	KCPWindow       int `json:"kcp_window"`
+	KCPDataShards   int `json:"kcp_data_shards"`
+	KCPParityShards int `json:"kcp_parity_shards"`
+
+	// the ports of the users, each with its own password
+	PortPassword map[string]PortKey `json:"port_password"`
+	// the users on the server port by name, with their passwords or user PSKs
+	Users map[string]PortKey `json:"users"`
+}
+
+var config Config
+
+func handleLocal(conn net.Conn) {
+	defer conn.Close()
+	setDeadline(conn, config.HandshakeTimeout)
+	// socks starts with the version, anything else is taken for http
+	br := bufio.NewReader(conn)
+	first, err := br.Peek(1)
+	if err != nil {
+		return
+	}
+	conn = &prefixConn{Conn: conn, r: br}
+	if first[0] != socks5.Version5 {
+		// traced as http there
+		handleHTTP(conn)
+		return
+	}
+	tr := startTrace("socks", conn)
+	defer tr.finish(nil)
+	hs := tr.start("handshake")
+	if err := socks5.Handshake(conn, activeKeys.Load().auth); err != nil {
+		slog.Warn("handshake error", "client", conn.RemoteAddr().String(), "err", err)
+		handshakeFailures.Add(1)
+		hs.finish(err)
+		return
+	}
+	setDeadline(conn, config.RequestTimeout)
+	cmd, tgtAddr, err := socks5.ReadRequest(conn)
+	setDeadline(conn, 0)
+	hs.finish(err)
+	if err != nil {
+		slog.Warn("fail to get target address from connection", "client", conn.RemoteAddr().String(), "err", err)
+		handshakeFailures.Add(1)
+		if rep := replyCode(err); rep != socks5.RepGeneralFailure {
+			socks5.WriteReply(conn, rep, nil)
+		}
+		return
+	}
+	tr.set("target", socks5.AddrString(tgtAddr))
+	slog.Debug("socks request", "client", conn.RemoteAddr().String(), "cmd", cmd, "target", socks5.AddrString(tgtAddr))
+	switch cmd {
+	case socks5.CmdBind:
+		handleBind(conn, tgtAddr)
+		return
+	case socks5.CmdUDPAssociate:
+		handleUDPAssociate(conn)
+		return
+	}
+	if err := checkRequest(conn, tgtAddr); err != nil {
+		socks5.WriteReply(conn, replyCode(err), nil)
+		return
+	}
+	if config.FastReply {
+		if err = socks5.WriteReply(conn, socks5.RepSucceeded, nil); err != nil {
+			return
+		}
+		tunnel(conn, tgtAddr, tr, nil)
+		return
+	}
+	tunnel(conn, tgtAddr, tr, func(remote net.Conn, err error) error {
+		if err != nil {
+			return socks5.WriteReply(conn, replyCode(err), nil)
+		}
+		return socks5.WriteReply(conn, socks5.RepSucceeded, bndAddr(remote))
+	})
+}
+
+// checkRequest returns, logged, the error a request of conn for tgtAddr
+// fails with before any dial: errRejected by the rules, errLoop, or
+// errServersDown to fail fast when the circuit of every server is open.
+func checkRequest(conn net.Conn, tgtAddr []byte) error {
+	target := socks5.AddrString(tgtAddr)
+	action := routeAction(tgtAddr)
+	if action == actionReject {
+		slog.Info("fail to connect", "target", target, "err", errRejected)
+		return errRejected
+	}
+	if err := checkLoop(target); err != nil {
+		slog.Warn("fail to connect", "client", conn.RemoteAddr().String(), "target", target, "err", err)
+		return err
+	}
+	if action != actionDirect && config.ReverseListen == "" && activePool.Load().down() {
+		slog.Warn("fail to connect", "target", target, "err", errServersDown)
+		return errServersDown
+	}
+	return nil
+}
+
+// bndAddr returns the BND.ADDR and BND.PORT of a reply for the connection to
+// the target or the server remote, its local address, or nil without one.
+func bndAddr(remote net.Conn) []byte {
+	addr := remote.LocalAddr()
+	if addr == nil {
+		return nil
+	}
+	host, _, err := net.SplitHostPort(addr.String())
+	if err != nil || net.ParseIP(host) == nil {
+		return nil
+	}
+	bnd, err := socks5.EncodeAddr(addr.String())
+	if err != nil {
+		return nil
+	}
+	return bnd
+}
+
+// tunnel relays conn through the server, or directly as the rules say, to
+// tgtAddr, which is in socks {ATYP, DST.ADDR, DST.PORT} form. The dial and
+// relay are traced in tr. reply, if not nil, answers the client with the
+// result of the dial, the relay starts only once it succeeded.
+func tunnel(conn net.Conn, tgtAddr []byte, tr *trace, reply func(remote net.Conn, err error) error) {
+	host := socks5.AddrString(tgtAddr)
+	tr.set("target", host)
+	sp := tr.start("dial")
+	remote, server, err := dialTarget(tgtAddr)
+	sp.set("server", server)
+	sp.finish(err)
+	if reply != nil {
+		if rerr := reply(remote, err); rerr != nil && err == nil {
+			remote.Close()
+			return
+		}
+	}
+	if err != nil {
+		slog.Warn("fail to connect", "target", host, "err", err)
+		countDialError(err)
+		return
+	}
+	defer remote.Close()
+	slog.Debug("connecting", "client", conn.RemoteAddr().String(), "server", server, "target", host)
+	sp = tr.start("relay")
+	relay(conn, remote, host)
+	sp.finish(nil)
+}
+
+// replyCode returns the REP of the socks reply telling the client of err,
+// after RFC 1928.
+func replyCode(err error) byte {
+	var dnsErr *net.DNSError
+	var netErr net.Error
+	switch {
+	case err == nil:
+		return socks5.RepSucceeded
+	case errors.Is(err, socks5.ErrCommandNotSupported):
+		return socks5.RepCommandNotSupported
+	case errors.Is(err, socks5.ErrAddrTypeNotSupported):
+		return socks5.RepAddrTypeNotSupported
+	case errors.Is(err, errRejected), errors.Is(err, errLoop):
+		return socks5.RepNotAllowed
+	case errors.Is(err, errServersDown), errors.Is(err, syscall.ENETUNREACH):
+		return socks5.RepNetworkUnreachable
+	case errors.Is(err, syscall.ECONNREFUSED):
+		return socks5.RepConnectionRefused
+	case errors.Is(err, syscall.EHOSTUNREACH), errors.As(err, &dnsErr),
+		errors.As(err, &netErr) && netErr.Timeout():
+		return socks5.RepHostUnreachable
+	}
+	return socks5.RepGeneralFailure
+}
+
+func readTargetHost(conn io.Reader) (host string, err error) {
+	addr, err := socks5.ReadAddr(conn)
+	if err != nil {
+		return
+	}
+	return socks5.AddrString(addr), nil
+}
+
+func handleServer(c net.Conn) {
+	handleServerKeys(c, activeKeys.Load())
+}
+
+// handleServerKeys serves a tunnel connection encrypted with k.
+func handleServerKeys(c net.Conn, k *keys) {
+	defer c.Close()
+	tr := startTrace("tunnel", c)
+	defer tr.finish(nil)
+	// the key derivation and decryption of the first record
+	hs := tr.start("handshake")
+	// keep what the client sent until it is authenticated, for the fallback
+	rec := &recordConn{Conn: c}
+	setDeadline(c, config.RequestTimeout)
+	conn, err := newTunnelConn(rec, k, false)
+	if err != nil {
+		slog.Warn("fail to init tunnel", "err", err)
+		hs.finish(err)
+		return
+	}
+	tgtHost, err := readTargetHost(conn)
+	setDeadline(c, 0)
+	hs.finish(err)
+	if err != nil {
+		level := slog.LevelWarn
+		if err == io.EOF {
+			// closed without a word, like the probes
+			level = slog.LevelDebug
+		}
+		slog.Log(context.Background(), level, "fail to get target host from connection", "client", conn.RemoteAddr().String(), "err", err)
+		countHandshakeError(err)
+		if err != io.EOF {
+			failIP(c.RemoteAddr())
+		}
+		if head, ok := rec.stop(); ok {
+			fallback(c, head)
+		}
+		return
+	}
+	rec.stop()
+	args := []any{"client", conn.RemoteAddr().String(), "method", config.Method, "target", tgtHost}
+	u := k.user(conn)
+	if u >= 0 {
+		tr.set("user", k.users[u])
+		args = append(args, "user", k.users[u])
+	}
+	slog.Debug("tunnel request", args...)
+	serveTarget(conn, tgtHost, tr, k.egressOf(u))
+}
+
+// serveTunnel handles one tunnel connection, or one stream of a mux session,
+// dialing the target ports eg allows.
+func serveTunnel(conn net.Conn, eg *egress) {
+	tgtHost, err := readTargetHost(conn)
+	if err != nil {
+		slog.Warn("fail to get target host from connection", "client", conn.RemoteAddr().String(), "err", err)
+		return
+	}
+	tr := startTrace("mux stream", conn)
+	defer tr.finish(nil)
+	serveTarget(conn, tgtHost, tr, eg)
+}
+
+func serveTarget(conn net.Conn, tgtHost string, tr *trace, eg *egress) {
+	tr.set("target", tgtHost)
+	switch tgtHost {
+	case udpOverTCPHost:
+		handleUDPServer(conn, eg)
+		return
+	case bindHost:
+		handleBindServer(conn)
+		return
+	case muxHost:
+		handleMuxServer(conn, eg)
+		return
+	}
+	if l := lookupListener(tgtHost); l != nil {
+		l.serve(conn)
+		return
+	}
+	if err := eg.check("tcp", tgtHost); err != nil {
+		slog.Info("fail to dial target", "client", conn.RemoteAddr().String(), "target", tgtHost, "err", err)
+		tr.set("blocked", err.Error())
+		return
+	}
+	if err := checkLoop(tgtHost); err != nil {
+		slog.Warn("fail to dial target", "client", conn.RemoteAddr().String(), "target", tgtHost, "err", err)
+		tr.set("blocked", err.Error())
+		return
+	}
+	sp := tr.start("dial")
+	remote, err := dialOutbound(tgtHost, tr, eg)
+	sp.finish(err)
+	if errors.Is(err, errPrivate) || errors.Is(err, errLoop) {
+		level := slog.LevelInfo
+		if errors.Is(err, errLoop) {
+			level = slog.LevelWarn
+		}
+		slog.Log(context.Background(), level, "fail to dial target", "client", conn.RemoteAddr().String(), "target", tgtHost, "err", err)
+		tr.set("blocked", err.Error())
+		return
+	}
+	if err != nil {
+		slog.Warn("fail to dial target", "target", tgtHost, "err", err)
+		dialErrors.Add(1)
+		return
+	}
+	defer remote.Close()
+	slog.Debug("connecting", "client", conn.RemoteAddr().String(), "target", tgtHost)
+	sp = tr.start("relay")
+	relay(conn, remote, tgtHost)
+	sp.finish(nil)
+}
@@ -0,0 +1,325 @@
+package tunnel
+
+import (
+	"encoding/binary"
+	"io"
+	"log/slog"
+	"net"
+	"sync"
+	"sync/atomic"
+	"time"
+
+	"github.com/daogan/socksproxy/socks5"
+)
+
+// A udp association is carried over one tunnel connection to the magic
+// target udpOverTCPHost, so it works with every method and transport. Each
+// packet in the tunnel is:
+//
+//	+------+----------+----------+--------+----------+
+//	| ATYP | DST.ADDR | DST.PORT | LENGTH |   DATA   |
+//	+------+----------+----------+--------+----------+
+//	|  1   | Variable |    2     |   2    | Variable |
+//	+------+----------+----------+--------+----------+
+//
+// with the destination address on the way out, and the source address on the
+// way back.
+const udpOverTCPHost = "sp.udp-over-tcp.arpa:0"
+
+const maxUDPSize = 65535
+
+func udpTimeout() time.Duration {
+	return time.Duration(config.UDPTimeout) * time.Second
+}
+
+// udpDNSTimeout is the idle timeout of udp only sent to port 53, whose
+// answers come at once: their mappings are dropped early.
+func udpDNSTimeout() time.Duration {
+	if config.UDPDNSTimeout <= 0 {
+		return udpTimeout()
+	}
+	return time.Duration(config.UDPDNSTimeout) * time.Second
+}
+
+// udpNAT counts the udp mappings of the server, the socket of each
+// association, in total and by client ip for -udp-max-mappings.
+var udpNAT = struct {
+	sync.Mutex
+	n        int
+	byClient map[string]int
+}{byClient: make(map[string]int)}
+
+var udpRefused atomic.Uint64
+
+// openMapping takes a mapping for client, false if it has all it may.
+func openMapping(client string) bool {
+	udpNAT.Lock()
+	defer udpNAT.Unlock()
+	if config.UDPMaxMappings > 0 && udpNAT.byClient[client] >= config.UDPMaxMappings {
+		udpRefused.Add(1)
+		return false
+	}
+	udpNAT.byClient[client]++
+	udpNAT.n++
+	return true
+}
+
+func closeMapping(client string) {
+	udpNAT.Lock()
+	defer udpNAT.Unlock()
+	if udpNAT.byClient[client]--; udpNAT.byClient[client] <= 0 {
+		delete(udpNAT.byClient, client)
+	}
+	udpNAT.n--
+}
+
+func udpMappings() int {
+	udpNAT.Lock()
+	defer udpNAT.Unlock()
+	return udpNAT.n
+}
+
+func writePacket(w io.Writer, addr, data []byte) error {
+	pkt := make([]byte, 0, len(addr)+2+len(data))
+	pkt = append(pkt, addr...)
+	pkt = binary.BigEndian.AppendUint16(pkt, uint16(len(data)))
+	pkt = append(pkt, data...)
+	_, err := w.Write(pkt)
+	return err
+}
+
+// readPacket reads a packet from the tunnel, buf must hold maxUDPSize bytes.
+func readPacket(r io.Reader, buf []byte) (addr, data []byte, err error) {
+	if addr, err = socks5.ReadAddr(r); err != nil {
+		return
+	}
+	if _, err = io.ReadFull(r, buf[:2]); err != nil {
+		return
+	}
+	n := int(binary.BigEndian.Uint16(buf))
+	if _, err = io.ReadFull(r, buf[:n]); err != nil {
+		return
+	}
+	return addr, buf[:n], nil
+}
+
+type udpAssoc struct {
+	sync.Mutex
+	pc       net.PacketConn
+	clientIP string
+	client   net.Addr
+	tun      net.Conn // nil until the first packet, or after idle timeout
+}
+
+func handleUDPAssociate(conn net.Conn) {
+	host, _, err := net.SplitHostPort(conn.LocalAddr().String())
+	if err != nil {
+		// a client of a unix socket has no address to send udp from
+		socks5.WriteReply(conn, socks5.RepCommandNotSupported, nil)
+		return
+	}
+	pc, err := net.ListenPacket("udp", net.JoinHostPort(host, "0"))
+	if err != nil {
+		slog.Warn("fail to listen udp", "err", err)
+		socks5.WriteReply(conn, socks5.RepGeneralFailure, nil)
+		return
+	}
+	defer pc.Close()
+	bnd, err := socks5.EncodeAddr(pc.LocalAddr().String())
+	if err != nil {
+		return
+	}
+	if err = socks5.WriteReply(conn, socks5.RepSucceeded, bnd); err != nil {
+		return
+	}
+	// the association lasts as long as the tcp connection
+	go func() {
+		io.Copy(io.Discard, conn)
+		pc.Close()
+	}()
+	clientIP, _, _ := net.SplitHostPort(conn.RemoteAddr().String())
+	slog.Debug("udp associate", "client", conn.RemoteAddr().String(), "addr", pc.LocalAddr().String())
+	u := &udpAssoc{pc: pc, clientIP: clientIP}
+	u.serve()
+}
+
+func (u *udpAssoc) serve() {
+	defer func() {
+		u.Lock()
+		if u.tun != nil {
+			u.tun.Close()
+		}
+		u.Unlock()
+	}()
+	buf := make([]byte, maxUDPSize)
+	names := make(nameCache)
+	for {
+		n, addr, err := u.pc.ReadFrom(buf)
+		if err != nil {
+			return
+		}
+		// only the client owning the association may use it, while allowed
+		if ip, _, _ := net.SplitHostPort(addr.String()); ip != u.clientIP || !activeACL.Load().permits(addr) {
+			continue
+		}
+		// +----+------+------+----------+----------+----------+
+		// |RSV | FRAG | ATYP | DST.ADDR | DST.PORT |   DATA   |
+		// +----+------+------+----------+----------+----------+
+		// | 2  |  1   |  1   | Variable |    2     | Variable |
+		// +----+------+------+----------+----------+----------+
+		// fragmentation is not supported, drop those datagrams
+		if n < 3 || buf[2] != 0x00 {
+			continue
+		}
+		l := socks5.AddrLen(buf[3:n])
+		if l < 0 {
+			continue
+		}
+		tun, err := u.tunnel(addr)
+		if err != nil {
+			slog.Warn("fail to open udp tunnel", "err", err)
+			continue
+		}
+		tun.SetDeadline(time.Now().Add(udpTimeout()))
+		dstAddr, err := names.target(buf[3 : 3+l])
+		if err != nil {
+			slog.Debug("fail to resolve", "target", socks5.AddrString(buf[3:3+l]), "err", err)
+			continue
+		}
+		if err = writePacket(tun, dstAddr, buf[3+l:n]); err != nil {
+			tun.Close()
+		}
+	}
+}
+
+// tunnel returns the tunnel of the association, dialing it if needed.
+func (u *udpAssoc) tunnel(client net.Addr) (net.Conn, error) {
+	u.Lock()
+	defer u.Unlock()
+	u.client = client
+	if u.tun != nil {
+		return u.tun, nil
+	}
+	tgtAddr, _ := socks5.EncodeAddr(udpOverTCPHost)
+	tun, _, err := dialTunnel(tgtAddr)
+	if err != nil {
+		return nil, err
+	}
+	u.tun = tun
+	go u.readTunnel(tun)
+	return tun, nil
+}
+
+func (u *udpAssoc) readTunnel(tun net.Conn) {
+	defer func() {
+		u.Lock()
+		if u.tun == tun {
+			u.tun = nil
+		}
+		u.Unlock()
+		tun.Close()
+	}()
+	buf := make([]byte, maxUDPSize)
+	for {
+		// returns on idle timeout too, the next packet dials again
+		addr, data, err := readPacket(tun, buf)
+		if err != nil {
+			return
+		}
+		tun.SetDeadline(time.Now().Add(udpTimeout()))
+		u.Lock()
+		client := u.client
+		u.Unlock()
+		pkt := append(append([]byte{0x00, 0x00, 0x00}, addr...), data...)
+		u.pc.WriteTo(pkt, client)
+	}
+}
+
+// handleUDPServer relays the packets of a udp association through one udp
+// socket, its mapping. Full cone, replies from any host reach the client,
+// symmetric only those of the addresses it sent to.
+func handleUDPServer(conn net.Conn, eg *egress) {
+	client := hostOf(conn.RemoteAddr().String())
+	if !openMapping(client) {
+		slog.Debug("too many udp mappings of client", "client", conn.RemoteAddr().String())
+		return
+	}
+	defer closeMapping(client)
+	pc, err := net.ListenPacket("udp", "")
+	if err != nil {
+		slog.Warn("fail to listen udp", "err", err)
+		return
+	}
+	defer pc.Close()
+	slog.Debug("udp relay", "client", conn.RemoteAddr().String(), "addr", pc.LocalAddr().String())
+	// the dns timeout until a packet goes to another port than 53
+	var timeout atomic.Int64
+	timeout.Store(int64(udpTimeout()))
+	dnsOnly := true
+	refresh := func() { conn.SetDeadline(time.Now().Add(time.Duration(timeout.Load()))) }
+	refresh()
+	symmetric := config.UDPNAT == "symmetric"
+	var sent sync.Map // destinations, with symmetric
+	go func() {
+		buf := make([]byte, maxUDPSize)
+		for {
+			n, addr, err := pc.ReadFrom(buf)
+			if err != nil {
+				return
+			}
+			if _, ok := sent.Load(addr.String()); symmetric && !ok {
+				continue
+			}
+			srcAddr, err := socks5.EncodeAddr(addr.String())
+			if err != nil {
+				continue
+			}
+			refresh()
+			if err = writePacket(conn, srcAddr, buf[:n]); err != nil {
+				return
+			}
+		}
+	}()
+	buf := make([]byte, maxUDPSize)
+	resolved := make(map[string]*net.UDPAddr)
+	for {
+		addr, data, err := readPacket(conn, buf)
+		if err != nil {
+			return
+		}
+		host := socks5.AddrString(addr)
+		if err := eg.check("udp", host); err != nil {
+			slog.Debug("fail to send packet", "client", conn.RemoteAddr().String(), "target", host, "err", err)
+			continue
+		}
+		udpAddr, ok := resolved[host]
+		if !ok {
+			if udpAddr, err = net.ResolveUDPAddr("udp", host); err != nil {
+				slog.Warn("fail to resolve", "host", host, "err", err)
+				continue
+			}
+			if err := eg.checkIP(udpAddr.IP); err != nil {
+				slog.Info("fail to send packet", "client", conn.RemoteAddr().String(), "target", host, "err", err)
+				continue
+			}
+			if len(resolved) > 1024 {
+				resolved = make(map[string]*net.UDPAddr)
+			}
+			resolved[host] = udpAddr
+		}
+		switch {
+		case udpAddr.Port != 53:
+			if dnsOnly {
+				dnsOnly = false
+				timeout.Store(int64(udpTimeout()))
+			}
+		case dnsOnly:
+			timeout.Store(int64(udpDNSTimeout()))
+		}
+		refresh()
+		if symmetric {
+			sent.Store(udpAddr.String(), true)
+		}
+		pc.WriteTo(data, udpAddr)
+	}
+}
@@ -0,0 +1,82 @@
+package tunnel
+
+import (
+	"encoding/base64"
+	"errors"
+	"fmt"
+	"net"
+	"net/url"
+	"strings"
+
+	"github.com/daogan/socksproxy/cipher"
+)
+
+// SIP002 server URIs:
+//
+//	ss://base64url(method:password)@host:port#tag
+//	ss://method:password@host:port#tag (2022 methods, percent encoded)
+//
+// and the legacy form ss://base64(method:password@host:port)#tag.
+
+// parseURI returns the server address, method and password of an ss:// URI.
+func parseURI(uri string) (server, method, password string, err error) {
+	if !strings.HasPrefix(uri, "ss://") {
+		return "", "", "", errors.New("expect ss:// uri")
+	}
+	rest := strings.TrimPrefix(uri, "ss://")
+	if i := strings.IndexByte(rest, '#'); i >= 0 {
+		rest = rest[:i]
+	}
+	var userinfo string
+	if i := strings.LastIndexByte(rest, '@'); i >= 0 {
+		u, err := url.Parse(uri)
+		if err != nil {
+			return "", "", "", err
+		}
+		server = u.Host
+		if p, ok := u.User.Password(); ok {
+			userinfo = u.User.Username() + ":" + p
+		} else if userinfo, err = decodeBase64(u.User.Username()); err != nil {
+			return "", "", "", fmt.Errorf("invalid userinfo: %v", err)
+		}
+	} else {
+		// legacy, everything is base64 encoded
+		if i := strings.IndexByte(rest, '?'); i >= 0 {
+			rest = rest[:i]
+		}
+		plain, err := decodeBase64(strings.TrimSuffix(rest, "/"))
+		if err != nil {
+			return "", "", "", fmt.Errorf("invalid uri: %v", err)
+		}
+		i := strings.LastIndexByte(plain, '@')
+		if i < 0 {
+			return "", "", "", errors.New("invalid uri: no server address")
+		}
+		userinfo, server = plain[:i], plain[i+1:]
+	}
+	method, password, ok := strings.Cut(userinfo, ":")
+	if !ok {
+		return "", "", "", errors.New("invalid uri: expect method:password")
+	}
+	if _, _, err = net.SplitHostPort(server); err != nil {
+		return "", "", "", fmt.Errorf("invalid uri: %v", err)
+	}
+	return server, strings.ToLower(method), password, nil
+}
+
+func decodeBase64(s string) (string, error) {
+	s = strings.TrimRight(s, "=")
+	b, err := base64.RawURLEncoding.DecodeString(s)
+	if err != nil {
+		b, err = base64.RawStdEncoding.DecodeString(s)
+	}
+	return string(b), err
+}
+
+// formatURI is the SIP002 URI of a server.
+func formatURI(server, method, password string) string {
+	if cipher.IsSS2022(method) {
+		return "ss://" + url.UserPassword(method, password).String() + "@" + server
+	}
+	return "ss://" + base64.RawURLEncoding.EncodeToString([]byte(method+":"+password)) + "@" + server
+}
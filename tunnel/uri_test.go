@@ -0,0 +1,56 @@
+package tunnel
+
+import "testing"
+
+// The first three are the examples of SIP002.
+func TestParseURI(t *testing.T) {
+	for _, tt := range []struct {
+		uri                      string
+		server, method, password string
+	}{
+		{"ss://YWVzLTEyOC1nY206dGVzdA@192.168.100.1:8888#Example1", "192.168.100.1:8888", "aes-128-gcm", "test"},
+		{"ss://cmM0LW1kNTpwYXNzd2Q@192.168.100.1:8888/?plugin=obfs-local%3Bobfs%3Dhttp#Example2", "192.168.100.1:8888", "rc4-md5", "passwd"},
+		{"ss://2022-blake3-aes-256-gcm:YctPZ6U7xPPcU%2Bgp3u%2BOx0v4w6NZ5PbA%2BkFVsauIb2I%3D@192.168.100.1:8888#Example3",
+			"192.168.100.1:8888", "2022-blake3-aes-256-gcm", "YctPZ6U7xPPcU+gp3u+Ox0v4w6NZ5PbA+kFVsauIb2I="},
+		// legacy, with std padding and an ipv6 server
+		{"ss://YWVzLTI1Ni1jZmI6c2VjcmV0QFsyMDAxOmRiODo6MV06ODM4OA==#tag", "[2001:db8::1]:8388", "aes-256-cfb", "secret"},
+		// base64url of "AES-256-GCM:p@ss:w/rd", the method is lowered
+		{"ss://QUVTLTI1Ni1HQ006cEBzczp3L3Jk@example.com:443", "example.com:443", "aes-256-gcm", "p@ss:w/rd"},
+	} {
+		server, method, password, err := parseURI(tt.uri)
+		if err != nil {
+			t.Errorf("%s: %v", tt.uri, err)
+			continue
+		}
+		if server != tt.server || method != tt.method || password != tt.password {
+			t.Errorf("%s: got %s %s %s, want %s %s %s", tt.uri, server, method, password, tt.server, tt.method, tt.password)
+		}
+	}
+}
+
+func TestParseURIErrors(t *testing.T) {
+	for _, uri := range []string{
+		"http://example.com:80",
+		"ss://bm9jb2xvbg@example.com:443",     // "nocolon"
+		"ss://YWVzLTEyOC1nY206dGVzdA@example", // no port
+		"ss://YWVzLTEyOC1nY206dGVzdA",         // legacy without server
+		"ss://!!!@example.com:443",
+	} {
+		if _, _, _, err := parseURI(uri); err == nil {
+			t.Errorf("%s: no error", uri)
+		}
+	}
+}
+
+func TestFormatURI(t *testing.T) {
+	for _, tt := range []struct{ server, method, password string }{
+		{"1.2.3.4:8388", "aes-256-gcm", "p@ss:w/rd#?"},
+		{"[::1]:8388", "2022-blake3-aes-128-gcm", "AAAAAAAAAAAAAAAAAAAAAA=="},
+	} {
+		uri := formatURI(tt.server, tt.method, tt.password)
+		server, method, password, err := parseURI(uri)
+		if err != nil || server != tt.server || method != tt.method || password != tt.password {
+			t.Errorf("%s: parsed %s %s %s, %v", uri, server, method, password, err)
+		}
+	}
+}
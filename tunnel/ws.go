@@ -0,0 +1,182 @@
+package tunnel
+
+import (
+	"crypto/tls"
+	"errors"
+	"log/slog"
+	"net"
+	"net/http"
+	"net/url"
+	"sync"
+	"time"
+
+	"golang.org/x/net/websocket"
+)
+
+// wsTransport carries the tunnel in binary websocket frames, so it passes
+// HTTP only middleboxes and CDNs. host is the Host header sent by the local
+// side, the server address by default. With tls set, the websocket runs
+// over TLS (wss) with the certificates of the tls transport.
+type wsTransport struct {
+	path string
+	host string
+	tls  *tls.Config // of the client, nil for plain ws
+}
+
+func NewWSTransport(path, host string, secure bool) (*wsTransport, error) {
+	if path == "" {
+		path = "/"
+	}
+	if path[0] != '/' {
+		return nil, errors.New("websocket path should start with /")
+	}
+	t := &wsTransport{path: path, host: host}
+	if secure {
+		conf, err := clientTLSConfig()
+		if err != nil {
+			return nil, err
+		}
+		if conf.ServerName == "" && host != "" {
+			// the certificate is the one of the Host, e.g. of the CDN
+			conf.ServerName = hostOnly(host)
+		}
+		t.tls = conf
+	}
+	return t, nil
+}
+
+// hostOnly strips the port, if any, off host.
+func hostOnly(host string) string {
+	if h, _, err := net.SplitHostPort(host); err == nil {
+		return h
+	}
+	return host
+}
+
+func (t *wsTransport) Dial(addr string) (net.Conn, error) {
+	host := t.host
+	if host == "" {
+		host = addr
+	}
+	scheme, origin := "ws", "http://"
+	if t.tls != nil {
+		scheme, origin = "wss", "https://"
+	}
+	location := &url.URL{Scheme: scheme, Host: host, Path: t.path}
+	cfg, err := websocket.NewConfig(location.String(), origin+host+"/")
+	if err != nil {
+		return nil, err
+	}
+	var c net.Conn
+	if t.tls != nil {
+		c, err = tls.DialWithDialer(&net.Dialer{Timeout: dialTimeout}, "tcp", addr, t.tls)
+		if err == nil {
+			setSockOpts(c)
+		}
+	} else {
+		c, err = dialTCP(addr)
+	}
+	if err != nil {
+		return nil, err
+	}
+	// a server that takes the connection but never upgrades it fails the dial
+	if dialTimeout > 0 {
+		c.SetDeadline(time.Now().Add(dialTimeout))
+	}
+	ws, err := websocket.NewClient(cfg, c)
+	if err != nil {
+		c.Close()
+		return nil, err
+	}
+	c.SetDeadline(time.Time{})
+	ws.PayloadType = websocket.BinaryFrame
+	return ws, nil
+}
+
+func (t *wsTransport) Listen(addr string) (net.Listener, error) {
+	var ln net.Listener
+	var err error
+	if t.tls != nil {
+		ln, err = listenTLS(addr)
+	} else {
+		ln, err = listenTCP(addr)
+	}
+	if err != nil {
+		return nil, err
+	}
+	l := &wsListener{Listener: ln, conns: make(chan net.Conn), done: make(chan struct{})}
+	mux := http.NewServeMux()
+	// websocket.Server without Handshake accepts any Origin
+	mux.Handle(t.path, websocket.Server{Handler: l.handle})
+	// no ReadTimeout or WriteTimeout, their deadlines would stay on the
+	// hijacked websockets
+	srv := &http.Server{
+		Handler:           mux,
+		ReadHeaderTimeout: time.Duration(config.RequestTimeout) * time.Second,
+		IdleTimeout:       timeout,
+	}
+	go func() {
+		err := srv.Serve(ln)
+		slog.Error("websocket server error", "err", err)
+		l.Close()
+	}()
+	return l, nil
+}
+
+// wsListener hands the websocket connections of the http server to Accept.
+type wsListener struct {
+	net.Listener
+	conns     chan net.Conn
+	done      chan struct{}
+	closeOnce sync.Once
+}
+
+func (l *wsListener) handle(ws *websocket.Conn) {
+	ws.PayloadType = websocket.BinaryFrame
+	c := &wsConn{Conn: ws, closed: make(chan struct{})}
+	if addr, err := net.ResolveTCPAddr("tcp", ws.Request().RemoteAddr); err == nil {
+		c.remote = addr
+	}
+	select {
+	case l.conns <- c:
+	case <-l.done:
+		return
+	}
+	// the websocket is closed when the handler returns
+	<-c.closed
+}
+
+func (l *wsListener) Accept() (net.Conn, error) {
+	select {
+	case c := <-l.conns:
+		return c, nil
+	case <-l.done:
+		return nil, net.ErrClosed
+	}
+}
+
+func (l *wsListener) Close() error {
+	l.closeOnce.Do(func() { close(l.done) })
+	return l.Listener.Close()
+}
+
+type wsConn struct {
+	*websocket.Conn
+	remote    net.Addr
+	closed    chan struct{}
+	closeOnce sync.Once
+}
+
+// RemoteAddr is the address of the http client, the websocket one is the
+// client origin.
+func (c *wsConn) RemoteAddr() net.Addr {
+	if c.remote != nil {
+		return c.remote
+	}
+	return c.Conn.RemoteAddr()
+}
+
+func (c *wsConn) Close() error {
+	c.closeOnce.Do(func() { close(c.closed) })
+	return c.Conn.Close()
+}